@@ -1,12 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/puma/puma-dev/dev"
 	"github.com/puma/puma-dev/homedir"
 	"github.com/vektra/errors"
 )
@@ -15,6 +20,12 @@ func command() error {
 	switch flag.Arg(0) {
 	case "link":
 		return link()
+	case "ca":
+		return ca()
+	case "client-cert":
+		return clientCert()
+	case "route":
+		return route()
 	default:
 		return fmt.Errorf("unknown command: %s", flag.Arg(0))
 	}
@@ -86,3 +97,163 @@ func link() error {
 
 	return nil
 }
+
+func ca() error {
+	switch flag.Arg(1) {
+	case "", "show":
+		return caShow()
+	case "regenerate":
+		err := dev.RegenerateCA()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("* Generated a new CA, restart puma-dev to use it\n")
+
+		return caShow()
+	case "trust":
+		certPath, _ := dev.CAPaths()
+		return dev.TrustCert(certPath)
+	default:
+		return fmt.Errorf("unknown ca command: %s", flag.Arg(1))
+	}
+}
+
+func caShow() error {
+	certPath, _ := dev.CAPaths()
+
+	info, err := dev.LoadCertInfo(certPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no CA at %s, start puma-dev to generate one", certPath)
+		}
+
+		return err
+	}
+
+	fmt.Printf("Path:        %s\n", certPath)
+	fmt.Printf("Subject:     %s\n", info.Subject)
+	fmt.Printf("Fingerprint: %s (SHA-256)\n", info.Fingerprint)
+	fmt.Printf("Key:         %s %d bits\n", info.KeyType, info.KeyBits)
+	fmt.Printf("Valid from:  %s\n", info.NotBefore.Format(time.RFC3339))
+	fmt.Printf("Valid until: %s\n", info.NotAfter.Format(time.RFC3339))
+
+	for _, w := range info.Warnings(time.Now()) {
+		fmt.Printf("! Warning: %s\n", w)
+	}
+
+	return nil
+}
+
+func clientCert() error {
+	fs := flag.NewFlagSet("client-cert", flag.ExitOnError)
+	out := fs.String("o", ".", "directory to write the cert and key to")
+	days := fs.Int("days", 397, "how many days the cert is valid for")
+
+	err := fs.Parse(flag.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: puma-dev client-cert [-o dir] [-days n] name")
+	}
+
+	name := fs.Arg(0)
+
+	certPath, keyPath := dev.CAPaths()
+
+	parent, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no CA at %s, start puma-dev to generate one", certPath)
+		}
+
+		return errors.Context(err, "loading CA")
+	}
+
+	certPEM, keyPEM, err := dev.MakeClientCert(&parent, name, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Join(*out, strings.Replace(name, string(filepath.Separator), "_", -1))
+
+	err = ioutil.WriteFile(base+".crt", certPEM, 0644)
+	if err != nil {
+		return errors.Context(err, "writing cert")
+	}
+
+	err = ioutil.WriteFile(base+".key", keyPEM, 0600)
+	if err != nil {
+		return errors.Context(err, "writing key")
+	}
+
+	fmt.Printf("+ Client cert for '%s' written to %s.crt and %s.key\n", name, base, base)
+
+	return nil
+}
+
+func route() error {
+	if flag.NArg() != 2 {
+		return fmt.Errorf("usage: puma-dev route host[/path]")
+	}
+
+	dir, err := homedir.Expand(*fDir)
+	if err != nil {
+		return err
+	}
+
+	domains := strings.Split(*fDomains, ":")
+	sort.Sort(ByDecreasingTLDComplexity(domains))
+
+	// a broken routing file is ignored when serving, but point it out here
+	routesPath := filepath.Join(dir, dev.RoutesFile)
+
+	if data, err := ioutil.ReadFile(routesPath); err == nil {
+		if _, err := dev.ParseRoutes(routesPath, data); err != nil {
+			return err
+		}
+	}
+
+	pool := &dev.AppPool{Dir: dir, Events: &dev.Events{}}
+
+	hr := pool.ExplainHost(flag.Arg(1), domains)
+
+	fmt.Printf("Host:  %s\n", flag.Arg(1))
+
+	if hr.Route != nil {
+		fmt.Printf("Rule:  %s (%s rule, line %d of %s)\n",
+			hr.Route, hr.Route.Kind, hr.Route.Line, routesPath)
+
+		switch {
+		case hr.Route.Strip:
+			fmt.Printf("Mount: %s, removed from the path and sent as X-Forwarded-Prefix\n", hr.Route.Path)
+		case hr.Route.Path != "":
+			fmt.Printf("Mount: %s\n", hr.Route.Path)
+		}
+	} else {
+		fmt.Printf("Rule:  none, looked up by the name '%s'\n", hr.Name)
+	}
+
+	switch {
+	case hr.App == "":
+		return fmt.Errorf("no app serves %s", flag.Arg(1))
+	case hr.Path == "":
+		fmt.Printf("App:   proxy to %s\n", hr.App)
+	case hr.Default:
+		fmt.Printf("App:   default, no app is named after the host\n")
+	default:
+		fmt.Printf("App:   %s\n", hr.App)
+	}
+
+	if hr.Path != "" {
+		if dest, err := os.Readlink(hr.Path); err == nil {
+			fmt.Printf("Path:  %s -> %s\n", hr.Path, dest)
+		} else {
+			fmt.Printf("Path:  %s\n", hr.Path)
+		}
+	}
+
+	return nil
+}
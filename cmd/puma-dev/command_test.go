@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/puma/puma-dev/dev"
 	. "github.com/puma/puma-dev/dev/devtest"
 
 	"github.com/puma/puma-dev/homedir"
@@ -97,3 +101,75 @@ func TestCommand_link_reassignExistingApp(t *testing.T) {
 
 	RemoveAppSymlinkOrFail(t, appAlias)
 }
+
+func TestCommand_ca_badCommandArg(t *testing.T) {
+	StubCommandLineArgs("ca", "doesnotexist")
+	err := command()
+	assert.Equal(t, "unknown ca command: doesnotexist", err.Error())
+}
+
+func TestCommand_clientCert_noName(t *testing.T) {
+	StubCommandLineArgs("client-cert")
+	err := command()
+	assert.Equal(t, "usage: puma-dev client-cert [-o dir] [-days n] name", err.Error())
+}
+
+func TestCommand_route(t *testing.T) {
+	dir := t.TempDir()
+	appDir := t.TempDir()
+
+	assert.NoError(t, os.Symlink(appDir, filepath.Join(dir, "blog")))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, dev.RoutesFile), []byte("*.admin.test blog\napi.test 3000\nshop.test/api 4000 strip\n"), 0644))
+
+	StubCommandLineArgs("-dir", dir, "route", "x.admin.test")
+
+	actual := WithStdoutCaptured(func() {
+		assert.NoError(t, command())
+	})
+
+	assert.Equal(t, fmt.Sprintf(`Host:  x.admin.test
+Rule:  *.admin.test blog (wildcard rule, line 1 of %s)
+App:   blog
+Path:  %s -> %s
+`, filepath.Join(dir, dev.RoutesFile), filepath.Join(dir, "blog"), appDir), actual)
+
+	StubCommandLineArgs("-dir", dir, "route", "api.test")
+
+	actual = WithStdoutCaptured(func() {
+		assert.NoError(t, command())
+	})
+
+	assert.Contains(t, actual, "App:   proxy to 3000\n")
+
+	StubCommandLineArgs("-dir", dir, "route", "shop.test/api/orders")
+
+	actual = WithStdoutCaptured(func() {
+		assert.NoError(t, command())
+	})
+
+	assert.Contains(t, actual, "Host:  shop.test/api/orders\nRule:  shop.test/api 4000 strip (exact rule, line 3 of ")
+	assert.Contains(t, actual, "Mount: /api, removed from the path and sent as X-Forwarded-Prefix\nApp:   proxy to 4000\n")
+
+	StubCommandLineArgs("-dir", dir, "route", "tenant.blog.test")
+
+	actual = WithStdoutCaptured(func() {
+		assert.NoError(t, command())
+	})
+
+	assert.Contains(t, actual, "Rule:  none, looked up by the name 'tenant.blog'\nApp:   blog\n")
+
+	StubCommandLineArgs("-dir", dir, "route", "nope.test")
+
+	WithStdoutCaptured(func() {
+		err := command()
+		if assert.Error(t, err) {
+			assert.Equal(t, "no app serves nope.test", err.Error())
+		}
+	})
+}
+
+func TestCommand_route_noHost(t *testing.T) {
+	StubCommandLineArgs("route")
+	err := command()
+	assert.Equal(t, "usage: puma-dev route host[/path]", err.Error())
+}
@@ -61,6 +61,6 @@ func init() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
 
-		fmt.Fprintf(os.Stderr, "\nAvailable subcommands: link\n")
+		fmt.Fprintf(os.Stderr, "\nAvailable subcommands: link, ca [show|regenerate|trust], client-cert, route\n")
 	}
 }
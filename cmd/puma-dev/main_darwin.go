@@ -4,9 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -26,7 +28,20 @@ var (
 	fPow      = flag.Bool("pow", false, "Mimic pow's settings")
 	fLaunch   = flag.Bool("launchd", false, "Use socket from launchd")
 
+	fDNSBind    = flag.String("dns-bind", "127.0.0.1", "address to listen on dns on")
+	fDNSForward = flag.String("dns-forward", "", "forward other dns queries to these servers, separate with a comma, or system for those in /etc/resolv.conf")
+	fDNSAnswers = flag.String("dns-answers", "", "addresses to answer dns queries with, e.g. '192.168.1.20 dev.local=10.0.0.2,fd00::2'")
+
 	fNoServePublicPaths = flag.String("no-serve-public-paths", "", "Disable static file server for specific paths under /public")
+	fBootTimeout        = flag.Duration("boot-timeout", dev.DefaultBootTimeout, "how long to let an app boot before killing it")
+	fBootSplash         = flag.Bool("boot-splash", false, "show browsers the boot log of an app while it boots")
+	fMaxBootWait        = flag.Duration("max-boot-wait", 0, "how long a request waits for an app to boot, 0 to wait for the boot timeout")
+
+	fAccessLog        = flag.String("access-log", "", "file to log requests to, - for stdout")
+	fAccessLogFormat  = flag.String("access-log-format", dev.AccessLogCommon, "access log format, common or json")
+	fAccessLogMaxSize = flag.Int64("access-log-max-size", 10, "size in MB at which the access log is rotated, 0 to never rotate")
+	fRequestEvents    = flag.Bool("request-events", false, "add a request event for every request")
+	fClientCerts      = flag.String("client-certs", "", "domains to ask for client certs on over https, separate with :, add =require to require one")
 
 	fSetup = flag.Bool("setup", false, "Run system setup")
 	fStop  = flag.Bool("stop", false, "Stop all puma-dev servers")
@@ -122,6 +137,7 @@ func main() {
 	var pool dev.AppPool
 	pool.Dir = dir
 	pool.IdleTime = *fTimeout
+	pool.Readiness.Timeout = *fBootTimeout
 	pool.Events = &events
 
 	purge := make(chan os.Signal, 1)
@@ -167,7 +183,27 @@ func main() {
 		fmt.Printf("* HTTPS Server port: %d\n", *fTLSPort)
 	}
 
-	dns := dev.NewDNSResponder(fmt.Sprintf("127.0.0.1:%d", *fDNSPort), domains)
+	dns := dev.NewDNSResponder(net.JoinHostPort(*fDNSBind, strconv.Itoa(*fDNSPort)), domains)
+	dns.AppExists = pool.HasApp
+	dns.HasRoute = pool.HasRoute
+	dns.ZoneDir = pool.Dir
+	dns.Events = &events
+
+	dns.Answers, err = dev.ParseDNSAnswers(*fDNSAnswers, domains)
+	if err != nil {
+		log.Fatalf("Unable to parse -dns-answers: %s", err)
+	}
+
+	if *fDNSForward != "" {
+		upstreams, err := dev.ParseDNSUpstreams(*fDNSForward)
+		if err != nil {
+			log.Fatalf("Unable to read DNS upstreams: %s", err)
+		}
+
+		dns.Forward(upstreams)
+		fmt.Printf("* Forwarding other DNS queries to: %s\n", strings.Join(upstreams, ", "))
+	}
+
 	go func() {
 		if err := dns.Serve(); err != nil {
 			fmt.Printf("! DNS Server failed: %v\n", err)
@@ -182,6 +218,26 @@ func main() {
 	http.Debug = *fDebug
 	http.Events = &events
 	http.Domains = domains
+	http.BootSplash = *fBootSplash
+	http.MaxBootWait = *fMaxBootWait
+	http.RequestEvents = *fRequestEvents
+
+	http.ClientCerts, err = dev.ParseClientCertDomains(*fClientCerts)
+	if err != nil {
+		log.Fatalf("Unable to parse -client-certs: %s", err)
+	}
+
+	if *fAccessLog != "" {
+		accessLogPath := *fAccessLog
+		if accessLogPath != "-" {
+			accessLogPath = homedir.MustExpand(accessLogPath)
+		}
+
+		http.AccessLog, err = dev.OpenAccessLog(accessLogPath, *fAccessLogFormat, *fAccessLogMaxSize*1024*1024)
+		if err != nil {
+			log.Fatalf("Unable to open access log: %s", err)
+		}
+	}
 	if len(*fNoServePublicPaths) > 0 {
 		http.IgnoredStaticPaths = strings.Split(*fNoServePublicPaths, ":")
 		fmt.Printf("* Ignoring files under: public{%s}\n", strings.Join(http.IgnoredStaticPaths, ", "))
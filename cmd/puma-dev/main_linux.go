@@ -4,9 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -19,12 +21,35 @@ var (
 	fDebug              = flag.Bool("debug", false, "enable debug output")
 	fDir                = flag.String("dir", "~/.puma-dev", "directory to watch for apps")
 	fDomains            = flag.String("d", "test", "domains to handle, separate with :, defaults to test")
+	fDNSPort            = flag.Int("dns-port", 9253, "port to listen on dns for")
+	fDNSBind            = flag.String("dns-bind", "127.0.0.1", "address to listen on dns on")
+	fDNSForward         = flag.String("dns-forward", "", "forward other dns queries to these servers, separate with a comma, or system for those in /etc/resolv.conf")
+	fDNSAnswers         = flag.String("dns-answers", "", "addresses to answer dns queries with, e.g. '192.168.1.20 dev.local=10.0.0.2,fd00::2'")
 	fHTTPPort           = flag.Int("http-port", 9280, "port to listen on http for")
 	fNoServePublicPaths = flag.String("no-serve-public-paths", "", "Disable static file server for specific paths under /public")
 	fStop               = flag.Bool("stop", false, "Stop all puma-dev servers")
 	fSysBind            = flag.Bool("sysbind", false, "bind to ports 80 and 443")
+	fSystemd            = flag.Bool("systemd", false, "Use sockets from systemd socket activation")
 	fTimeout            = flag.Duration("timeout", 15*60*time.Second, "how long to let an app idle for")
+	fBootTimeout        = flag.Duration("boot-timeout", dev.DefaultBootTimeout, "how long to let an app boot before killing it")
+	fBootSplash         = flag.Bool("boot-splash", false, "show browsers the boot log of an app while it boots")
+	fMaxBootWait        = flag.Duration("max-boot-wait", 0, "how long a request waits for an app to boot, 0 to wait for the boot timeout")
 	fTLSPort            = flag.Int("https-port", 9283, "port to listen on https for")
+
+	fAccessLog        = flag.String("access-log", "", "file to log requests to, - for stdout")
+	fAccessLogFormat  = flag.String("access-log-format", dev.AccessLogCommon, "access log format, common or json")
+	fAccessLogMaxSize = flag.Int64("access-log-max-size", 10, "size in MB at which the access log is rotated, 0 to never rotate")
+	fRequestEvents    = flag.Bool("request-events", false, "add a request event for every request")
+	fClientCerts      = flag.String("client-certs", "", "domains to ask for client certs on over https, separate with :, add =require to require one")
+
+	fSetup             = flag.Bool("setup", false, "Configure the system resolver, run with sudo")
+	fUnprivilegedPorts = flag.Bool("unprivileged-ports", false, "With -setup, also let every user listen on ports 80 and up, for -install on ports 80 and 443")
+
+	fInstall     = flag.Bool("install", false, "Install puma-dev as a systemd user service")
+	fInstallPort = flag.Int("install-port", 80, "Port to run puma-dev on when installed")
+	fInstallTLS  = flag.Int("install-https-port", 443, "Port to run puma-dev for SSL on when installed")
+
+	fUninstall = flag.Bool("uninstall", false, "Uninstall puma-dev as a systemd user service")
 )
 
 func main() {
@@ -35,6 +60,43 @@ func main() {
 	domains := strings.Split(*fDomains, ":")
 	sort.Sort(ByDecreasingTLDComplexity(domains))
 
+	if *fUninstall {
+		err := dev.Uninstall("", dev.SystemdUnitDirPath, domains)
+		if err != nil {
+			log.Fatalf("Unable to uninstall: %s", err)
+		}
+		return
+	}
+
+	if *fInstall {
+		err := dev.InstallIntoSystem(&dev.InstallIntoSystemArgs{
+			ApplinkDirPath:     *fDir,
+			Domains:            *fDomains,
+			DNSPort:            *fDNSPort,
+			ListenPort:         *fInstallPort,
+			Timeout:            (*fTimeout).String(),
+			TlsPort:            *fInstallTLS,
+			NoServePublicPaths: *fNoServePublicPaths,
+		})
+
+		if err != nil {
+			log.Fatalf("Unable to install into system: %s", err)
+		}
+		return
+	}
+
+	if *fSetup {
+		err := dev.Setup(&dev.SetupArgs{
+			Domains:           domains,
+			DNSPort:           *fDNSPort,
+			UnprivilegedPorts: *fUnprivilegedPorts,
+		})
+		if err != nil {
+			log.Fatalf("Unable to configure system resolver: %s", err)
+		}
+		return
+	}
+
 	if *fStop {
 		err := dev.Stop()
 		if err != nil {
@@ -63,6 +125,7 @@ func main() {
 	var pool dev.AppPool
 	pool.Dir = dir
 	pool.IdleTime = *fTimeout
+	pool.Readiness.Timeout = *fBootTimeout
 	pool.Events = &events
 
 	purge := make(chan os.Signal, 1)
@@ -92,8 +155,42 @@ func main() {
 
 	fmt.Printf("* Directory for apps: %s\n", dir)
 	fmt.Printf("* Domains: %s\n", strings.Join(domains, ", "))
-	fmt.Printf("* HTTP Server port: %d\n", *fHTTPPort)
-	fmt.Printf("* HTTPS Server port: %d\n", *fTLSPort)
+	fmt.Printf("* DNS Server port: %d\n", *fDNSPort)
+
+	if *fSystemd {
+		fmt.Printf("* HTTP Server port: inherited from systemd\n")
+		fmt.Printf("* HTTPS Server port: inherited from systemd\n")
+	} else {
+		fmt.Printf("* HTTP Server port: %d\n", *fHTTPPort)
+		fmt.Printf("* HTTPS Server port: %d\n", *fTLSPort)
+	}
+
+	dns := dev.NewDNSResponder(net.JoinHostPort(*fDNSBind, strconv.Itoa(*fDNSPort)), domains)
+	dns.AppExists = pool.HasApp
+	dns.HasRoute = pool.HasRoute
+	dns.ZoneDir = pool.Dir
+	dns.Events = &events
+
+	dns.Answers, err = dev.ParseDNSAnswers(*fDNSAnswers, domains)
+	if err != nil {
+		log.Fatalf("Unable to parse -dns-answers: %s", err)
+	}
+
+	if *fDNSForward != "" {
+		upstreams, err := dev.ParseDNSUpstreams(*fDNSForward)
+		if err != nil {
+			log.Fatalf("Unable to read DNS upstreams: %s", err)
+		}
+
+		dns.Forward(upstreams)
+		fmt.Printf("* Forwarding other DNS queries to: %s\n", strings.Join(upstreams, ", "))
+	}
+
+	go func() {
+		if err := dns.Serve(); err != nil {
+			fmt.Printf("! DNS Server failed: %v\n", err)
+		}
+	}()
 
 	var http dev.HTTPServer
 
@@ -103,18 +200,53 @@ func main() {
 	http.Debug = *fDebug
 	http.Events = &events
 	http.Domains = domains
+	http.BootSplash = *fBootSplash
+	http.MaxBootWait = *fMaxBootWait
+	http.RequestEvents = *fRequestEvents
+
+	http.ClientCerts, err = dev.ParseClientCertDomains(*fClientCerts)
+	if err != nil {
+		log.Fatalf("Unable to parse -client-certs: %s", err)
+	}
+
+	if *fAccessLog != "" {
+		accessLogPath := *fAccessLog
+		if accessLogPath != "-" {
+			accessLogPath = homedir.MustExpand(accessLogPath)
+		}
+
+		http.AccessLog, err = dev.OpenAccessLog(accessLogPath, *fAccessLogFormat, *fAccessLogMaxSize*1024*1024)
+		if err != nil {
+			log.Fatalf("Unable to open access log: %s", err)
+		}
+	}
 	if len(*fNoServePublicPaths) > 0 {
 		http.IgnoredStaticPaths = strings.Split(*fNoServePublicPaths, ":")
 		fmt.Printf("* Ignoring files under: public{%s}\n", strings.Join(http.IgnoredStaticPaths, ", "))
 	}
 
 	http.Setup()
+	http.StartRPC()
+
+	var (
+		socketName    string
+		tlsSocketName string
+	)
+
+	if *fSystemd {
+		socketName = dev.SystemdHTTPFdName
+		tlsSocketName = dev.SystemdHTTPSFdName
+	}
 
 	fmt.Printf("! Puma dev listening on http and https\n")
 
-	go http.ServeTLS()
+	go func() {
+		if err := http.ServeTLS(tlsSocketName); err != nil {
+			fmt.Printf("! HTTPS Server failed: %v\n", err)
+		}
+	}()
 
-	err = http.Serve()
+	err = http.Serve(socketName)
 	if err != nil {
 		log.Fatalf("Error listening: %s", err)
 	}
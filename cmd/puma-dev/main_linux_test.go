@@ -1,12 +1,35 @@
 package main
 
 import (
+	"flag"
+	"strings"
 	"testing"
 
+	"github.com/puma/puma-dev/dev"
 	. "github.com/puma/puma-dev/dev/devtest"
 	"github.com/puma/puma-dev/homedir"
+	"github.com/stretchr/testify/assert"
 )
 
+// the service unit -install writes must only use flags this binary has, or
+// the service fails to start
+func TestMain_installServiceFlags_Linux(t *testing.T) {
+	args := dev.SystemdServiceArgs(&dev.InstallIntoSystemArgs{
+		BinPath:            "/bin/puma-dev",
+		ApplinkDirPath:     "~/.puma-dev",
+		Domains:            "test",
+		DNSPort:            9253,
+		Timeout:            "15m0s",
+		NoServePublicPaths: "/packs",
+	})
+
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			assert.NotNil(t, flag.Lookup(strings.TrimPrefix(arg, "-")), "unknown flag %s", arg)
+		}
+	}
+}
+
 func TestMainPumaDev_Linux(t *testing.T) {
 	appLinkDir := homedir.MustExpand("~/.puma-dev-test_linux-puma-dev")
 
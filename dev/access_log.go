@@ -0,0 +1,353 @@
+package dev
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vektra/errors"
+)
+
+const (
+	AccessLogCommon = "common"
+	AccessLogJSON   = "json"
+)
+
+// AccessLog writes a line for every request puma-dev handles.
+type AccessLog struct {
+	// Format is AccessLogCommon or AccessLogJSON
+	Format string
+	Out    io.Writer
+
+	lock sync.Mutex
+}
+
+// DefaultAccessLogBackups is how many rotated access logs OpenAccessLog keeps
+const DefaultAccessLogBackups = 5
+
+// OpenAccessLog sets up an access log writing to path, or to stdout if path
+// is "-". The file is rotated once it grows past maxSize bytes, unless
+// maxSize is 0.
+func OpenAccessLog(path, format string, maxSize int64) (*AccessLog, error) {
+	switch format {
+	case AccessLogCommon, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format '%s'", format)
+	}
+
+	if path == "-" {
+		return &AccessLog{Format: format, Out: os.Stdout}, nil
+	}
+
+	f, err := OpenRotatingFile(path, maxSize, DefaultAccessLogBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessLog{Format: format, Out: f}, nil
+}
+
+// accessWriter wraps the ResponseWriter of a request to record what the
+// access log needs to know about it. It keeps the Flusher and Hijacker of
+// the ResponseWriter it wraps working, for streaming responses and
+// websockets.
+type accessWriter struct {
+	http.ResponseWriter
+
+	start  time.Time
+	uri    string
+	status int
+	bytes  int64
+
+	app      string
+	upstream string
+	public   bool
+
+	bootWait      time.Duration
+	upstreamStart time.Time
+	upstreamFirst time.Duration
+}
+
+// newAccessWriter wraps w for req, before req is changed for the upstream
+func newAccessWriter(w http.ResponseWriter, req *http.Request) *accessWriter {
+	return &accessWriter{ResponseWriter: w, start: time.Now(), uri: req.URL.RequestURI()}
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	// informational responses may be followed by the real one
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+
+		if !w.upstreamStart.IsZero() {
+			w.upstreamFirst = time.Since(w.upstreamStart)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the wrapped ResponseWriter
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// startUpstream marks the request being handed to the app.
+func (w *accessWriter) startUpstream(upstream string) {
+	w.upstream = upstream
+	w.upstreamStart = time.Now()
+}
+
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	App        string    `json:"app"`
+	Upstream   string    `json:"upstream"`
+	Public     bool      `json:"public"`
+	Duration   float64   `json:"duration_ms"`
+	Latency    float64   `json:"upstream_ms"`
+	BootWait   float64   `json:"boot_wait_ms"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func newAccessEntry(w *accessWriter, req *http.Request) *accessEntry {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	return &accessEntry{
+		Time:       w.start,
+		RemoteAddr: host,
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       w.uri,
+		Proto:      req.Proto,
+		Status:     status,
+		Bytes:      w.bytes,
+		App:        w.app,
+		Upstream:   w.upstream,
+		Public:     w.public,
+		Duration:   milliseconds(time.Since(w.start)),
+		Latency:    milliseconds(w.upstreamFirst),
+		BootWait:   milliseconds(w.bootWait),
+		UserAgent:  req.UserAgent(),
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func (e *accessEntry) common() string {
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d app=%s upstream=%s public=%t upstream_ms=%.1f boot_wait_ms=%.1f duration_ms=%.1f\n",
+		e.RemoteAddr,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto,
+		e.Status, e.Bytes,
+		orDash(e.App), orDash(e.Upstream), e.Public,
+		e.Latency, e.BootWait, e.Duration,
+	)
+}
+
+func (l *AccessLog) write(e *accessEntry) error {
+	var line []byte
+
+	switch l.Format {
+	case AccessLogJSON:
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		line = append(data, '\n')
+	default:
+		line = []byte(e.common())
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, err := l.Out.Write(line)
+	return err
+}
+
+// logAccess records a finished request in the access log and as a request
+// event.
+func (h *HTTPServer) logAccess(w *accessWriter, req *http.Request) {
+	if h.AccessLog == nil && !h.RequestEvents {
+		return
+	}
+
+	e := newAccessEntry(w, req)
+
+	if h.AccessLog != nil {
+		if err := h.AccessLog.write(e); err != nil && h.Debug {
+			fmt.Fprintf(os.Stderr, "! Unable to write access log: %s\n", err)
+		}
+	}
+
+	if h.RequestEvents {
+		h.Events.Add("request",
+			"app", e.App,
+			"method", e.Method,
+			"host", e.Host,
+			"path", e.Path,
+			"status", e.Status,
+			"bytes", e.Bytes,
+			"upstream", e.Upstream,
+			"public", e.Public,
+			"upstream_ms", e.Latency,
+			"boot_wait_ms", e.BootWait,
+			"duration_ms", e.Duration,
+		)
+	}
+}
+
+// RotatingFile is an append only log file, which is moved aside once it
+// grows past MaxSize. The last MaxBackups moved aside files are kept, as
+// Path.1 (the newest) to Path.<MaxBackups>.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Context(err, "opening log file")
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = fi.Size()
+
+	return nil
+}
+
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			// the line still goes to the current file, and rotating is
+			// tried again once that has grown by MaxSize more
+			fmt.Fprintf(os.Stderr, "! Unable to rotate %s: %s\n", r.Path, err)
+			r.size = 0
+		}
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// rotate moves the file aside and opens a new one in its place. If either
+// fails, the current file is kept open to be written to.
+func (r *RotatingFile) rotate() error {
+	if r.MaxBackups > 0 {
+		for i := r.MaxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+		}
+
+		if err := os.Rename(r.Path, r.Path+".1"); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Remove(r.Path); err != nil {
+			return err
+		}
+	}
+
+	f := r.f
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.f.Close()
+}
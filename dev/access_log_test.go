@@ -0,0 +1,172 @@
+package dev
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newProxyTestApp adds an app to h's pool which proxies to backend
+func newProxyTestApp(t *testing.T, h *HTTPServer, name string, backend *httptest.Server) *App {
+	app := newBootingTestApp(t, h, name)
+
+	u, _ := url.Parse(backend.URL)
+	host, sport, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(sport)
+
+	app.SetAddress("http", host, port)
+	close(app.readyChan)
+
+	return app
+}
+
+func TestHttp_accessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "created!")
+	}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+
+	h := newTestHTTPServer(t)
+	h.AccessLog = &AccessLog{Format: AccessLogJSON, Out: &buf}
+	h.RequestEvents = true
+
+	newProxyTestApp(t, h, "blog", backend)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "http://blog.test/posts?draft=1", nil))
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var entry map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry)) {
+		return
+	}
+
+	assert.Equal(t, "blog", entry["app"])
+	assert.Equal(t, "POST", entry["method"])
+	assert.Equal(t, "/posts?draft=1", entry["path"])
+	assert.Equal(t, float64(201), entry["status"])
+	assert.Equal(t, float64(8), entry["bytes"])
+	assert.Equal(t, "http://"+strings.TrimPrefix(backend.URL, "http://"), entry["upstream"])
+	assert.Equal(t, false, entry["public"])
+
+	var events bytes.Buffer
+	h.Events.WriteTo(&events)
+	assert.Contains(t, events.String(), `"event":"request","app":"blog","method":"POST"`)
+}
+
+func TestHttp_accessLog_common(t *testing.T) {
+	var buf bytes.Buffer
+
+	h := newTestHTTPServer(t)
+	h.AccessLog = &AccessLog{Format: AccessLogCommon, Out: &buf}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://nope.test/", nil))
+
+	assert.Regexp(t, `^192\.0\.2\.1 - - \[[^\]]+\] "GET / HTTP/1.1" 500 11 app=- upstream=- public=false `, buf.String())
+}
+
+func TestAccessWriter_hijack(t *testing.T) {
+	var aw *accessWriter
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		aw = newAccessWriter(w, req)
+
+		conn, rw, err := aw.Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, http.StatusSwitchingProtocols, aw.status)
+
+	var _ http.Flusher = aw
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := OpenRotatingFile(path, 10, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+
+	read := func(p string) string {
+		data, _ := ioutil.ReadFile(p)
+		return string(data)
+	}
+
+	assert.Equal(t, "four\nfive\n", read(path))
+	assert.Equal(t, "three\n", read(path+".1"))
+	assert.Equal(t, "one\ntwo\n", read(path+".2"))
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRotatingFile_rotateFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	// a directory in the way of the backup makes the rename fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, 10, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+
+	// nothing is lost, it all stays in the file that couldn't be moved
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "one\ntwo\nthree\n", string(data))
+}
+
+func TestOpenAccessLog_badFormat(t *testing.T) {
+	_, err := OpenAccessLog("-", "apache", 0)
+	assert.EqualError(t, err, "unknown access log format 'apache'")
+}
@@ -7,12 +7,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -37,23 +34,44 @@ type App struct {
 	Public  bool
 	Events  *Events
 
+	// proxyRoutes is set for proxies with a structured proxy file
+	proxyRoutes *proxyRoutes
+
 	lines       linebuffer.LineBuffer
 	lastLogLine string
+	feed        lineFeed
 
 	address string
 	dir     string
 
 	t tomb.Tomb
 
-	stdout  io.Reader
-	pool    *AppPool
-	lastUse time.Time
+	stdout   io.Reader
+	pool     *AppPool
+	lastUse  time.Time
+	launched time.Time
 
 	lock sync.Mutex
 
 	booting bool
 
+	config *AppConfig
+
+	// bootCommand is the command the app is run with, for error pages
+	bootCommand string
+
+	readiness Readiness
+	check     readyCheck
+
+	sidecars []*Sidecar
+
 	readyChan chan struct{}
+
+	// generation counts the processes that have replaced this app's
+	// original one, see replace
+	generation int
+	restarting int32
+	inflight   int32
 }
 
 func (a *App) eventAdd(name string, args ...interface{}) {
@@ -90,7 +108,7 @@ func (a *App) Kill(reason string) error {
 	)
 
 	fmt.Printf("! Killing '%s' (%d) - '%s'\n", a.Name, a.Command.Process.Pid, reason)
-	err := a.Command.Process.Signal(syscall.SIGTERM)
+	err := a.signal(syscall.SIGTERM)
 	if err != nil {
 		a.eventAdd("killing_error",
 			"pid", a.Command.Process.Pid,
@@ -107,6 +125,16 @@ func (a *App) Kill(reason string) error {
 	return err
 }
 
+// signal sends sig to the app's process, or to its whole process group when
+// it was started in one.
+func (a *App) signal(sig syscall.Signal) error {
+	if attr := a.Command.SysProcAttr; attr != nil && attr.Setpgid {
+		return syscall.Kill(-a.Command.Process.Pid, sig)
+	}
+
+	return a.Command.Process.Signal(sig)
+}
+
 func (a *App) watch() error {
 	c := make(chan error)
 
@@ -117,7 +145,11 @@ func (a *App) watch() error {
 			line, err := r.ReadString('\n')
 			if line != "" {
 				rpcService.handleLog(a, line)
+				if lc, ok := a.check.(*logCheck); ok {
+					lc.observe(line)
+				}
 				a.lines.Append(line)
+				a.feed.publish(line)
 				a.lastLogLine = line
 				fmt.Fprintf(os.Stdout, "%s[%d]: %s", a.Name, a.Command.Process.Pid, line)
 			}
@@ -137,11 +169,16 @@ func (a *App) watch() error {
 	case err = <-c:
 		reason = "stdout/stderr closed"
 		err = fmt.Errorf("%s:\n\t%s", ErrUnexpectedExit, a.lastLogLine)
+
+		if !a.ready() && !a.isReplacement() {
+			a.pool.bootFailed(a, err)
+		}
 	case <-a.t.Dying():
 		err = nil
 	}
 
 	a.Kill(reason)
+	a.stopSidecars()
 	a.Command.Wait()
 	a.pool.remove(a)
 
@@ -149,6 +186,10 @@ func (a *App) watch() error {
 		os.Remove(a.Address())
 	}
 
+	if a.check != nil {
+		a.check.cleanup()
+	}
+
 	a.eventAdd("shutdown")
 
 	fmt.Printf("* App '%s' shutdown and cleaned up\n", a.Name)
@@ -189,7 +230,7 @@ func (a *App) restartMonitor() error {
 	f.Close()
 
 	return watch.Watch(restart, a.t.Dying(), func() {
-		a.Kill("restart.txt touched")
+		a.restart("restart.txt touched")
 	})
 }
 
@@ -209,6 +250,15 @@ func (a *App) WaitTilReady() error {
 	}
 }
 
+func (a *App) ready() bool {
+	select {
+	case <-a.readyChan:
+		return true
+	default:
+		return false
+	}
+}
+
 const (
 	Booting = iota
 	Running
@@ -261,6 +311,14 @@ if test -e .pumaenv && [ "$PUMADEV_SOURCE_PUMAENV" != "0" ]; then
 	source .pumaenv
 fi
 
+if [ -n "$PUMA_DEV_COMMAND" ]; then
+	if [ -n "$PUMA_DEV_PORT" ]; then
+		export PORT=$PUMA_DEV_PORT
+	fi
+
+	exec bash -c "$PUMA_DEV_COMMAND"
+fi
+
 if test -e Gemfile && bundle exec puma -V &>/dev/null; then
 	exec bundle exec puma -C $CONFIG --tag puma-dev:%s -w $WORKERS -t 0:$THREADS -b unix:%s
 fi
@@ -268,15 +326,9 @@ fi
 exec puma -C $CONFIG --tag puma-dev:%s -w $WORKERS -t 0:$THREADS -b unix:%s'
 `
 
-func (pool *AppPool) LaunchApp(name, dir string) (*App, error) {
-	tmpDir := filepath.Join(dir, "tmp")
-	err := os.MkdirAll(tmpDir, 0755)
-	if err != nil {
-		return nil, err
-	}
-
-	socket := filepath.Join(tmpDir, fmt.Sprintf("puma-dev-%d.sock", os.Getpid()))
-
+// shellCommand builds a command that runs executionShell for an app from
+// within the user's login shell.
+func shellCommand(name, dir, socket string) *exec.Cmd {
 	shell := os.Getenv("SHELL")
 
 	if shell == "" {
@@ -288,16 +340,126 @@ func (pool *AppPool) LaunchApp(name, dir string) (*App, error) {
 		fmt.Sprintf(executionShell, dir, name, socket, name, socket))
 
 	cmd.Dir = dir
-
 	cmd.Env = os.Environ()
+
+	return cmd
+}
+
+// runtimePath is where an app's sockets live. Replacement processes get their
+// own, so they can boot while the process they replace is still serving.
+func runtimePath(dir string, generation int, ext string) string {
+	name := fmt.Sprintf("puma-dev-%d", os.Getpid())
+	if generation > 0 {
+		name = fmt.Sprintf("%s-%d", name, generation)
+	}
+
+	return filepath.Join(dir, "tmp", name+"."+ext)
+}
+
+func (pool *AppPool) LaunchApp(name, dir string) (*App, error) {
+	return pool.launchApp(name, dir, 0)
+}
+
+func (pool *AppPool) launchApp(name, dir string, generation int) (*App, error) {
+	config, err := LoadAppConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	readiness, err := config.readiness(pool.Readiness)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir := filepath.Join(dir, "tmp")
+	err = os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	socket := runtimePath(dir, generation, "sock")
+
+	cmd := shellCommand(name, dir, socket)
+
+	threads := DefaultThreads
+	if config.Threads > 0 {
+		threads = config.Threads
+	}
+
 	cmd.Env = append(cmd.Env,
-		fmt.Sprintf("THREADS=%d", DefaultThreads),
-		"WORKERS=0",
+		fmt.Sprintf("THREADS=%d", threads),
+		fmt.Sprintf("WORKERS=%d", config.Workers),
 		"CONFIG=-",
+		"PUMA_DEV_SOCKET="+socket,
 	)
+	cmd.Env = append(cmd.Env, config.environ()...)
+
+	command, err := appCommand(dir, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// a Procfile.dev found without procfile = true isn't known to the
+	// config's own check
+	if command != "" && config.RestartMode == RestartSignal {
+		return nil, fmt.Errorf("restart_mode '%s' only works with puma, use '%s' for the web entry of %s", RestartSignal, RestartReplace, ProcfileName)
+	}
+
+	if command != "" {
+		cmd.Env = append(cmd.Env, "PUMA_DEV_COMMAND="+command)
+
+		// Custom commands are often wrappers (npm, foreman, ...) that fork
+		// the real server, so give them their own process group that can be
+		// signalled as a whole.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	app := &App{
+		Name:       name,
+		Command:    cmd,
+		Events:     pool.Events,
+		dir:        dir,
+		pool:       pool,
+		config:     config,
+		readiness:  readiness,
+		readyChan:  make(chan struct{}),
+		lastUse:    time.Now(),
+		generation: generation,
+	}
+
+	if command != "" {
+		app.bootCommand = command
+	} else {
+		app.bootCommand = fmt.Sprintf("puma -w %d -t 0:%d -b unix:%s", config.Workers, threads, socket)
+	}
+
+	app.sidecars = newSidecars(app, config.Sidecars)
+
+	if command != "" && commandBindsTCP(command, config) {
+		port, err := freePort()
+		if err != nil {
+			return nil, errors.Context(err, "finding a free port")
+		}
+
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PUMA_DEV_PORT=%d", port))
+		app.SetAddress("http", "127.0.0.1", port)
+	} else {
+		app.SetAddress("httpu", socket, 0)
+	}
+
+	app.check, err = newReadyCheck(app.readiness)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.check.setup(app, cmd)
+	if err != nil {
+		return nil, err
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
+		app.check.cleanup()
 		return nil, err
 	}
 
@@ -305,71 +467,97 @@ func (pool *AppPool) LaunchApp(name, dir string) (*App, error) {
 
 	err = cmd.Start()
 	if err != nil {
+		app.check.cleanup()
 		return nil, errors.Context(err, "starting app")
 	}
 
-	fmt.Printf("! Booting app '%s' on socket %s\n", name, socket)
+	app.stdout = stdout
+	app.launched = time.Now()
 
-	app := &App{
-		Name:      name,
-		Command:   cmd,
-		Events:    pool.Events,
-		stdout:    stdout,
-		dir:       dir,
-		pool:      pool,
-		readyChan: make(chan struct{}),
-		lastUse:   time.Now(),
+	appLaunches.WithLabelValues(name).Inc()
+
+	args := []interface{}{}
+
+	if app.Scheme == "httpu" {
+		fmt.Printf("! Booting app '%s' on socket %s\n", name, socket)
+		args = append(args, "socket", socket)
+	} else {
+		fmt.Printf("! Booting app '%s' on port %d\n", name, app.Port)
+		args = append(args, "port", app.Port)
 	}
 
-	app.eventAdd("booting_app", "socket", socket)
+	if command != "" {
+		args = append(args, "command", command)
+	}
+
+	if config.Path != "" {
+		args = append(args, "config", config.Path)
+	}
+
+	app.eventAdd("booting_app", args...)
 
 	stat, err := os.Stat(filepath.Join(dir, "public"))
 	if err == nil {
 		app.Public = stat.IsDir()
 	}
 
-	app.SetAddress("httpu", socket, 0)
-
 	app.t.Go(app.watch)
 	app.t.Go(app.idleMonitor)
 	app.t.Go(app.restartMonitor)
 
-	app.t.Go(func() error {
-		// This is a poor substitute for getting an actual readiness signal
-		// from puma but it's good enough.
-
-		app.eventAdd("waiting_on_app")
-
-		ticker := time.NewTicker(250 * time.Millisecond)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-app.t.Dying():
-				app.eventAdd("dying_on_start")
-				fmt.Printf("! Detecting app '%s' dying on start\n", name)
-				return fmt.Errorf("app died before booting")
-			case <-ticker.C:
-				c, err := net.Dial("unix", socket)
-				if err == nil {
-					c.Close()
-					app.eventAdd("app_ready")
-					fmt.Printf("! App '%s' booted\n", name)
-					close(app.readyChan)
-					return nil
-				}
-			}
-		}
-	})
+	if len(config.RestartTriggers) > 0 {
+		app.t.Go(app.triggerMonitor)
+	}
+	app.t.Go(app.waitForBoot)
 
 	return app, nil
 }
 
+// proxyFailure is a proxy file that couldn't be used, as it was when it
+// was read
+type proxyFailure struct {
+	modTime time.Time
+	size    int64
+	err     error
+}
+
+// readProxy returns a proxy app for the proxy file at path. A file with an
+// invalid config isn't read again until it changes, so its error is only
+// reported once. It's called with pool.lock held.
 func (pool *AppPool) readProxy(name, path string) (*App, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := pool.proxyFailures[path]; ok && f.modTime.Equal(stat.ModTime()) && f.size == stat.Size() {
+		return nil, f.err
+	}
+
+	delete(pool.proxyFailures, path)
+
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
+	app, err := pool.newProxy(name, path, data)
+	if cerr, ok := err.(*ProxyConfigError); ok {
+		if pool.proxyFailures == nil {
+			pool.proxyFailures = make(map[string]*proxyFailure)
+		}
+
+		pool.proxyFailures[path] = &proxyFailure{modTime: stat.ModTime(), size: stat.Size(), err: cerr}
+	}
+
+	return app, err
+}
+
+// newProxy returns a proxy app for data, in any of the formats of a proxy
+// file. path is where data came from, for errors.
+func (pool *AppPool) newProxy(name, path string, data []byte) (*App, error) {
+	var err error
+
 	app := &App{
 		Name:      name,
 		Events:    pool.Events,
@@ -378,35 +566,42 @@ func (pool *AppPool) readProxy(name, path string) (*App, error) {
 		lastUse:   time.Now(),
 	}
 
-	data = bytes.TrimSpace(data)
+	var target *proxyTarget
 
-	port, err := strconv.Atoi(string(data))
-	if err == nil {
-		app.SetAddress("http", "127.0.0.1", port)
-	} else {
-		u, err := url.Parse(string(data))
+	if proxyFormat(data) != "" {
+		cfg, err := ParseProxyConfig(path, data)
 		if err != nil {
+			if cerr, ok := err.(*ProxyConfigError); ok && cerr.Line > 0 {
+				pool.Events.Add("proxy_config_error", "app", name, "error", err.Error(), "line", cerr.Line)
+			} else {
+				pool.Events.Add("proxy_config_error", "app", name, "error", err.Error())
+			}
 			return nil, err
 		}
 
-		var (
-			sport, host string
-			port        int
-		)
+		app.proxyRoutes, err = cfg.routes()
+		if err != nil {
+			err = &ProxyConfigError{Path: path, Err: err}
+			pool.Events.Add("proxy_config_error", "app", name, "error", err.Error())
+			return nil, err
+		}
 
-		host, sport, err = net.SplitHostPort(u.Host)
-		if err == nil {
-			port, err = strconv.Atoi(sport)
-			if err != nil {
+		target = app.proxyRoutes.defaultTarget()
+	} else {
+		target, err = parseProxyTarget(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return nil, err
+		}
+
+		if target.Scheme == SchemeTCP {
+			if _, err := tcpPassthrough(target); err != nil {
 				return nil, err
 			}
-		} else {
-			host = u.Host
 		}
-
-		app.SetAddress(u.Scheme, host, port)
 	}
 
+	app.SetAddress(target.Scheme, target.Host, target.Port)
+
 	app.eventAdd("proxy_created",
 		"destination", fmt.Sprintf("%s://%s", app.Scheme, app.Address()))
 
@@ -425,25 +620,45 @@ func (pool *AppPool) readProxy(name, path string) (*App, error) {
 }
 
 type AppPool struct {
-	Dir      string
-	IdleTime time.Duration
-	Debug    bool
-	Events   *Events
+	Dir       string
+	IdleTime  time.Duration
+	Debug     bool
+	Events    *Events
+	Readiness Readiness
 
 	AppClosed func(*App)
 
-	lock sync.Mutex
-	apps map[string]*App
+	lock          sync.Mutex
+	apps          map[string]*App
+	failures      map[string]*CrashLoopError
+	proxyFailures map[string]*proxyFailure
+
+	routesLock sync.Mutex
+	routes     *routeTable
 }
 
 func (a *AppPool) maybeIdle(app *App) bool {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
+	idleTime := a.IdleTime
+	if app.config != nil && app.config.IdleTimeout > 0 {
+		idleTime = app.config.IdleTimeout
+	}
+
 	diff := time.Since(app.lastUse)
-	if diff > a.IdleTime {
+	if diff > idleTime {
 		app.eventAdd("idle_app", "last_used", diff.String())
-		delete(a.apps, app.Name)
+		appIdleKills.WithLabelValues(app.Name).Inc()
+
+		// by every name it's in the pool under, which for the proxies of
+		// routing rules isn't their own
+		for name, candidate := range a.apps {
+			if candidate == app {
+				delete(a.apps, name)
+			}
+		}
+
 		return true
 	}
 
@@ -532,6 +747,14 @@ func (a *AppPool) lookupApp(name string) (*App, error) {
 
 	app, ok = a.apps[canonicalName]
 
+	if !ok && stat.IsDir() {
+		// Don't keep relaunching an app that can't boot, every request
+		// would fork a whole new boot
+		if cl := a.crashLoop(canonicalName); cl != nil && time.Now().Before(cl.NextAttempt) {
+			return nil, cl
+		}
+	}
+
 	if !ok {
 		if stat.IsDir() {
 			app, err = a.LaunchApp(canonicalName, path)
@@ -541,7 +764,18 @@ func (a *AppPool) lookupApp(name string) (*App, error) {
 	}
 
 	if err != nil {
-		a.Events.Add("error_starting_app", "app", canonicalName, "error", err.Error())
+		switch cerr := err.(type) {
+		case *ProxyConfigError:
+			// already reported as proxy_config_error
+		case *AppConfigError:
+			if cerr.Line > 0 {
+				a.Events.Add("error_starting_app", "app", canonicalName, "error", err.Error(), "line", cerr.Line)
+			} else {
+				a.Events.Add("error_starting_app", "app", canonicalName, "error", err.Error())
+			}
+		default:
+			a.Events.Add("error_starting_app", "app", canonicalName, "error", err.Error())
+		}
 		return nil, err
 	}
 
@@ -593,6 +827,42 @@ func (a *AppPool) FindAppByDomainName(name string) (*App, error) {
 	return app, nil
 }
 
+// HasApp reports whether FindAppByDomainName finds an app for name, without
+// launching it.
+func (a *AppPool) HasApp(name string) bool {
+	app, _, _ := a.resolveName(name)
+	return app != ""
+}
+
+// resolveName returns the app FindAppByDomainName would find for name and
+// its path, without launching it. app is "" if there's none.
+func (a *AppPool) resolveName(name string) (app, path string, isDefault bool) {
+	for ; name != ""; name = pruneSub(name) {
+		if path, ok := a.appPath(name); ok {
+			return name, path, false
+		}
+	}
+
+	if path, ok := a.appPath("default"); ok {
+		return "default", path, true
+	}
+
+	return "", "", false
+}
+
+// appPath returns the path lookupApp finds the app name at.
+func (a *AppPool) appPath(name string) (string, bool) {
+	for _, candidate := range []string{name, strings.Replace(name, "-", "/", -1)} {
+		path := filepath.Join(a.Dir, candidate)
+
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
 func (a *AppPool) remove(app *App) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
@@ -0,0 +1,239 @@
+package dev
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/puma/puma-dev/watch"
+	"github.com/vektra/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// AppConfigFiles are the per-app configuration files LaunchApp looks for in
+// an app's directory, in order. Only the first one found is read.
+var AppConfigFiles = []string{".puma-dev.toml", ".puma-dev.yml", ".puma-dev.yaml"}
+
+type AppConfig struct {
+	IdleTimeout        time.Duration     `toml:"idle_timeout" yaml:"idle_timeout"`
+	Threads            int               `toml:"threads" yaml:"threads"`
+	Workers            int               `toml:"workers" yaml:"workers"`
+	Command            string            `toml:"command" yaml:"command"`
+	Procfile           bool              `toml:"procfile" yaml:"procfile"`
+	Bind               string            `toml:"bind" yaml:"bind"`
+	RestartMode        string            `toml:"restart_mode" yaml:"restart_mode"`
+	RestartTriggers    []string          `toml:"restart_triggers" yaml:"restart_triggers"`
+	RestartIgnore      []string          `toml:"restart_ignore" yaml:"restart_ignore"`
+	Env                map[string]string `toml:"env" yaml:"env"`
+	NoServePublicPaths []string          `toml:"no_serve_public_paths" yaml:"no_serve_public_paths"`
+	Ready              AppReadyConfig    `toml:"ready" yaml:"ready"`
+
+	Sidecars map[string]SidecarConfig `toml:"sidecars" yaml:"sidecars"`
+
+	// Path is the file the config was read from, empty if the app has none.
+	Path string `toml:"-" yaml:"-"`
+}
+
+type AppReadyConfig struct {
+	Strategy string        `toml:"strategy" yaml:"strategy"`
+	Path     string        `toml:"path" yaml:"path"`
+	Pattern  string        `toml:"pattern" yaml:"pattern"`
+	Timeout  time.Duration `toml:"timeout" yaml:"timeout"`
+}
+
+// AppConfigError is returned when an app's config file can't be used. Line
+// is 0 when the problem can't be pinned to a line.
+type AppConfigError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (e *AppConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("invalid app config %s, line %d: %s", e.Path, e.Line, e.Err)
+	}
+
+	return fmt.Sprintf("invalid app config %s: %s", e.Path, e.Err)
+}
+
+var (
+	tomlErrorRe = regexp.MustCompile(`^toml: line (\d+)(?: \(last key "[^"]*"\))?: (.*)$`)
+	yamlErrorRe = regexp.MustCompile(`line (\d+): (.*)$`)
+)
+
+// newAppConfigError pulls the line number out of a decoder error, as neither
+// decoder exposes it for every kind of error they return.
+func newAppConfigError(path string, err error, re *regexp.Regexp) *AppConfigError {
+	cerr := &AppConfigError{Path: path, Err: err}
+
+	if m := re.FindStringSubmatch(err.Error()); m != nil {
+		cerr.Line, _ = strconv.Atoi(m[1])
+		cerr.Err = errors.New(m[2])
+	}
+
+	return cerr
+}
+
+// LoadAppConfig reads the app config from dir. An app without a config file
+// gets an empty config.
+func LoadAppConfig(dir string) (*AppConfig, error) {
+	for _, name := range AppConfigFiles {
+		path := filepath.Join(dir, name)
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if strings.HasSuffix(name, ".toml") {
+			return parseTOMLAppConfig(path, data)
+		}
+
+		return parseYAMLAppConfig(path, data)
+	}
+
+	return &AppConfig{}, nil
+}
+
+func parseTOMLAppConfig(path string, data []byte) (*AppConfig, error) {
+	cfg := &AppConfig{Path: path}
+
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return nil, newAppConfigError(path, err, tomlErrorRe)
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, &AppConfigError{
+			Path: path,
+			Err:  fmt.Errorf("unknown key '%s'", undecoded[0]),
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+func parseYAMLAppConfig(path string, data []byte) (*AppConfig, error) {
+	cfg := &AppConfig{Path: path}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	err := dec.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return nil, newAppConfigError(path, err, yamlErrorRe)
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (c *AppConfig) validate() error {
+	fail := func(format string, args ...interface{}) error {
+		return &AppConfigError{Path: c.Path, Err: fmt.Errorf(format, args...)}
+	}
+
+	if c.Threads < 0 {
+		return fail("threads must not be negative")
+	}
+
+	if c.Workers < 0 {
+		return fail("workers must not be negative")
+	}
+
+	if c.Bind != "" && c.Bind != BindUnix && c.Bind != BindTCP {
+		return fail("bind must be '%s' or '%s'", BindUnix, BindTCP)
+	}
+
+	switch c.RestartMode {
+	case "", RestartKill, RestartReplace, RestartSignal:
+	default:
+		return fail("restart_mode must be '%s', '%s' or '%s'", RestartKill, RestartReplace, RestartSignal)
+	}
+
+	// only puma knows what USR1 and USR2 mean, other servers would likely
+	// just exit
+	if c.RestartMode == RestartSignal && (c.Command != "" || c.Procfile) {
+		return fail("restart_mode '%s' only works with puma, use '%s' with a custom command", RestartSignal, RestartReplace)
+	}
+
+	for _, glob := range append(c.RestartTriggers, c.RestartIgnore...) {
+		if err := watch.ValidGlob(glob); err != nil {
+			return fail("%s", err)
+		}
+	}
+
+	if c.IdleTimeout < 0 {
+		return fail("idle_timeout must not be negative")
+	}
+
+	for name, sidecar := range c.Sidecars {
+		if strings.TrimSpace(sidecar.Command) == "" {
+			return fail("sidecar '%s' has no command", name)
+		}
+	}
+
+	if _, err := c.readiness(Readiness{}); err != nil {
+		return fail("%s", err)
+	}
+
+	return nil
+}
+
+// readiness overlays the app's ready settings on top of the pool's defaults.
+func (c *AppConfig) readiness(base Readiness) (Readiness, error) {
+	r := base
+
+	if c.Ready.Strategy != "" {
+		r.Strategy = c.Ready.Strategy
+	}
+
+	if c.Ready.Path != "" {
+		r.HealthPath = c.Ready.Path
+	}
+
+	if c.Ready.Pattern != "" {
+		re, err := regexp.Compile(c.Ready.Pattern)
+		if err != nil {
+			return r, fmt.Errorf("bad ready pattern: %s", err)
+		}
+
+		r.LogPattern = re
+	}
+
+	if c.Ready.Timeout > 0 {
+		r.Timeout = c.Ready.Timeout
+	}
+
+	if _, err := newReadyCheck(r); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// environ returns the configured env vars in a stable order
+func (c *AppConfig) environ() []string {
+	var env []string
+
+	for k, v := range c.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	sort.Strings(env)
+
+	return env
+}
@@ -0,0 +1,137 @@
+package dev
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeAppConfig(t *testing.T, name, body string) string {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestLoadAppConfig_missing(t *testing.T) {
+	cfg, err := LoadAppConfig(t.TempDir())
+
+	assert.NoError(t, err)
+	assert.Equal(t, &AppConfig{}, cfg)
+}
+
+func TestLoadAppConfig_toml(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.toml", `
+idle_timeout = "1h"
+threads = 8
+workers = 2
+command = "bin/rails server -b unix:$PUMA_DEV_SOCKET"
+no_serve_public_paths = ["/packs"]
+
+[env]
+RAILS_ENV = "development"
+
+[ready]
+strategy = "http"
+path = "/up"
+timeout = "2m"
+`)
+
+	cfg, err := LoadAppConfig(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, filepath.Join(dir, ".puma-dev.toml"), cfg.Path)
+	assert.Equal(t, time.Hour, cfg.IdleTimeout)
+	assert.Equal(t, 8, cfg.Threads)
+	assert.Equal(t, 2, cfg.Workers)
+	assert.Equal(t, "bin/rails server -b unix:$PUMA_DEV_SOCKET", cfg.Command)
+	assert.Equal(t, []string{"/packs"}, cfg.NoServePublicPaths)
+	assert.Equal(t, []string{"RAILS_ENV=development"}, cfg.environ())
+
+	r, err := cfg.readiness(Readiness{Timeout: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, ReadyHTTP, r.Strategy)
+	assert.Equal(t, "/up", r.HealthPath)
+	assert.Equal(t, 2*time.Minute, r.Timeout)
+}
+
+func TestLoadAppConfig_yaml(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.yml", `
+threads: 3
+ready:
+  strategy: log
+  pattern: "Listening on"
+`)
+
+	cfg, err := LoadAppConfig(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 3, cfg.Threads)
+
+	r, err := cfg.readiness(Readiness{Timeout: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, ReadyLog, r.Strategy)
+	assert.True(t, r.LogPattern.MatchString("* Listening on unix:///tmp/puma.sock"))
+	assert.Equal(t, time.Minute, r.Timeout)
+}
+
+func TestLoadAppConfig_tomlSyntaxError(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.toml", "threads = 4\nworkers = \"two\nthreads = 2\n")
+
+	_, err := LoadAppConfig(dir)
+
+	cerr, ok := err.(*AppConfigError)
+	if assert.True(t, ok, "expected an AppConfigError, got %v", err) {
+		assert.Equal(t, 2, cerr.Line)
+		assert.Contains(t, cerr.Error(), ".puma-dev.toml, line 2: strings cannot contain newlines")
+	}
+}
+
+func TestLoadAppConfig_yamlTypeError(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.yaml", "env:\n  A: b\nthreads: lots\n")
+
+	_, err := LoadAppConfig(dir)
+
+	cerr, ok := err.(*AppConfigError)
+	if assert.True(t, ok, "expected an AppConfigError, got %v", err) {
+		assert.Equal(t, 3, cerr.Line)
+	}
+}
+
+func TestLoadAppConfig_tomlTypeError(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.toml", "\nthreads = \"five\"\n")
+
+	_, err := LoadAppConfig(dir)
+
+	cerr, ok := err.(*AppConfigError)
+	if assert.True(t, ok, "expected an AppConfigError, got %v", err) {
+		assert.Equal(t, 2, cerr.Line)
+	}
+}
+
+func TestLoadAppConfig_unknownKey(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.toml", "treads = 4\n")
+
+	_, err := LoadAppConfig(dir)
+
+	assert.EqualError(t, err, "invalid app config "+filepath.Join(dir, ".puma-dev.toml")+": unknown key 'treads'")
+}
+
+func TestLoadAppConfig_badReadiness(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.toml", "[ready]\nstrategy = \"log\"\npattern = \"(\"\n")
+
+	_, err := LoadAppConfig(dir)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bad ready pattern")
+}
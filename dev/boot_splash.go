@@ -0,0 +1,219 @@
+package dev
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vektra/errors"
+)
+
+// BootEventsPath is where the splash page of a booting app streams the app's
+// boot log from, on the app's own host and under the path it's mounted at.
+const BootEventsPath = "/__puma-dev/boot-events"
+
+// how many log lines the boot event stream starts with
+const bootEventsBacklog = 200
+
+var ErrStillBooting = errors.New("app is still booting")
+
+// lineFeed passes the lines an app logs on to whoever is following them.
+// Followers that don't keep up miss lines rather than holding up the app.
+type lineFeed struct {
+	lock sync.Mutex
+	subs map[chan string]struct{}
+}
+
+func (f *lineFeed) publish(line string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for c := range f.subs {
+		select {
+		case c <- line:
+		default:
+		}
+	}
+}
+
+func (f *lineFeed) subscribe() (<-chan string, func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.subs == nil {
+		f.subs = make(map[chan string]struct{})
+	}
+
+	c := make(chan string, 100)
+	f.subs[c] = struct{}{}
+
+	return c, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		delete(f.subs, c)
+	}
+}
+
+// WaitTilReadyFor is WaitTilReady, giving up with ErrStillBooting after d.
+// A d of 0 waits as long as the app takes.
+func (a *App) WaitTilReadyFor(d time.Duration) error {
+	if d <= 0 {
+		return a.WaitTilReady()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-a.readyChan:
+		return a.WaitTilReady()
+	case <-a.t.Dying():
+		return a.t.Err()
+	case <-timer.C:
+		return ErrStillBooting
+	}
+}
+
+func (a *App) isBooting() bool {
+	select {
+	case <-a.t.Dying():
+		return false
+	default:
+		return !a.ready()
+	}
+}
+
+// isNavigation reports whether req is a browser loading a page, rather than
+// a script or API client that wants the app's actual response.
+func isNavigation(req *http.Request) bool {
+	if req.Method != "GET" || req.Header.Get("X-Requested-With") != "" {
+		return false
+	}
+
+	if mode := req.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate" && req.Header.Get("Sec-Fetch-Dest") != "iframe"
+	}
+
+	return wantsHTML(req)
+}
+
+var bootSplashTemplate = template.Must(template.New("splash").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Booting {{.App}}</title>
+<noscript><meta http-equiv="refresh" content="2"></noscript>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #222; }
+pre { background: #222; color: #eee; padding: 1em; overflow-x: auto; max-height: 30em; }
+</style>
+</head>
+<body>
+<h1>Booting {{.App}}&hellip;</h1>
+<p id="status">The page will load as soon as the app is ready.</p>
+<pre id="log"></pre>
+<script>
+(function () {
+  var log = document.getElementById("log");
+  var source = new EventSource({{.EventsPath}});
+  source.addEventListener("log", function (e) {
+    log.textContent += e.data + "\n";
+    log.scrollTop = log.scrollHeight;
+  });
+  source.addEventListener("ready", function () {
+    source.close();
+    location.reload();
+  });
+  source.addEventListener("failed", function () {
+    source.close();
+    location.reload();
+  });
+  source.onerror = function () {
+    source.close();
+    setTimeout(function () { location.reload(); }, 2000);
+  };
+})();
+</script>
+</body>
+</html>
+`))
+
+// bootEventsPath returns where the splash page of an app matched by route
+// streams its boot events from, under the path the app is mounted at so the
+// request comes back to it.
+func bootEventsPath(route *Route) string {
+	if route == nil {
+		return BootEventsPath
+	}
+
+	return route.Path + BootEventsPath
+}
+
+func (h *HTTPServer) serveBootSplash(w http.ResponseWriter, req *http.Request, app *App, eventsPath string) {
+	h.Events.Add("boot_splash", "app", app.Name, "host", req.Host)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	bootSplashTemplate.Execute(w, struct {
+		App        string
+		EventsPath string
+	}{app.Name, eventsPath})
+}
+
+// serveBootEvents streams the app's log as server-sent events until it's
+// ready or has died.
+func (h *HTTPServer) serveBootEvents(w http.ResponseWriter, req *http.Request, app *App) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lines, unsubscribe := app.feed.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event, data string) {
+		data = strings.TrimRight(data, "\n")
+
+		fmt.Fprintf(w, "event: %s\n", event)
+		for _, l := range strings.Split(data, "\n") {
+			fmt.Fprintf(w, "data: %s\n", l)
+		}
+		fmt.Fprint(w, "\n")
+	}
+
+	for _, line := range logLines(app.tailLog(bootEventsBacklog)) {
+		send("log", line)
+	}
+
+	flusher.Flush()
+
+	for {
+		select {
+		case line := <-lines:
+			send("log", line)
+			flusher.Flush()
+		case <-app.readyChan:
+			send("ready", app.Name)
+			flusher.Flush()
+			return
+		case <-app.t.Dying():
+			send("failed", app.Name)
+			flusher.Flush()
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
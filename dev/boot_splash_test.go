@@ -0,0 +1,162 @@
+package dev
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newBootingTestApp(t *testing.T, h *HTTPServer, name string) *App {
+	app := &App{
+		Name:      name,
+		Events:    h.Events,
+		pool:      h.Pool,
+		readyChan: make(chan struct{}),
+	}
+
+	// stands in for App.watch, which keeps the tomb alive in a real app
+	app.t.Go(func() error {
+		<-app.t.Dying()
+		return nil
+	})
+
+	t.Cleanup(func() {
+		app.t.Kill(nil)
+		app.t.Wait()
+	})
+
+	h.Pool.apps = map[string]*App{name: app}
+
+	return app
+}
+
+func TestIsNavigation(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://blog.test/", nil)
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	assert.True(t, isNavigation(req))
+
+	req = httptest.NewRequest("GET", "http://blog.test/api", nil)
+	req.Header.Set("Sec-Fetch-Mode", "cors")
+	req.Header.Set("Accept", "text/html")
+	assert.False(t, isNavigation(req))
+
+	req = httptest.NewRequest("GET", "http://blog.test/", nil)
+	req.Header.Set("Accept", "text/html,*/*")
+	assert.True(t, isNavigation(req))
+
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	assert.False(t, isNavigation(req))
+
+	req = httptest.NewRequest("POST", "http://blog.test/", nil)
+	req.Header.Set("Accept", "text/html")
+	assert.False(t, isNavigation(req))
+}
+
+func TestHttp_bootSplash(t *testing.T) {
+	h := newTestHTTPServer(t)
+	h.BootSplash = true
+	h.MaxBootWait = 100 * time.Millisecond
+
+	newBootingTestApp(t, h, "blog")
+
+	req := httptest.NewRequest("GET", "http://blog.test/", nil)
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "Booting blog")
+	assert.Contains(t, w.Body.String(), BootEventsPath)
+
+	// other requests still block, up to MaxBootWait
+	req = httptest.NewRequest("GET", "http://blog.test/api/posts", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Sec-Fetch-Mode", "cors")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"title":"App is still booting"`)
+}
+
+func TestHttp_bootSplash_mounted(t *testing.T) {
+	h := newTestHTTPServer(t)
+	h.BootSplash = true
+
+	writeRoutes(t, h.Pool, "shop.test/admin blog strip\n")
+
+	app := newBootingTestApp(t, h, "blog")
+
+	req := httptest.NewRequest("GET", "http://shop.test/admin/posts", nil)
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"/admin`+BootEventsPath+`"`)
+
+	done := make(chan *httptest.ResponseRecorder)
+
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://shop.test/admin"+BootEventsPath, nil))
+		done <- w
+	}()
+
+	assert.Eventually(t, func() bool {
+		app.feed.lock.Lock()
+		defer app.feed.lock.Unlock()
+
+		return len(app.feed.subs) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	close(app.readyChan)
+
+	w = <-done
+
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "event: ready\ndata: blog\n\n")
+}
+
+func TestHttp_bootEvents(t *testing.T) {
+	h := newTestHTTPServer(t)
+	h.BootSplash = true
+
+	app := newBootingTestApp(t, h, "blog")
+	app.lines.Append("=> Booting Puma\n")
+
+	done := make(chan *httptest.ResponseRecorder)
+
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://blog.test"+BootEventsPath, nil))
+		done <- w
+	}()
+
+	assert.Eventually(t, func() bool {
+		app.feed.lock.Lock()
+		defer app.feed.lock.Unlock()
+
+		return len(app.feed.subs) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	app.feed.publish("* Listening on unix:///tmp/puma.sock\n")
+
+	// give the handler a chance to pass the line on before the app is ready
+	time.Sleep(50 * time.Millisecond)
+	close(app.readyChan)
+
+	w := <-done
+
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "event: log\ndata: => Booting Puma\n\n"+
+		"event: log\ndata: * Listening on unix:///tmp/puma.sock\n\n"+
+		"event: ready\ndata: blog\n\n", w.Body.String())
+}
@@ -0,0 +1,166 @@
+package dev
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/puma/puma-dev/homedir"
+	"github.com/vektra/errors"
+)
+
+const (
+	// LeafValidity is how long issued certs are valid for, within the 398
+	// days browsers accept
+	LeafValidity = 397 * 24 * time.Hour
+
+	// caExpiryWarning is how long before the CA expires puma-dev starts
+	// warning about it
+	caExpiryWarning = 30 * 24 * time.Hour
+
+	minRSABits = 2048
+)
+
+// CAPaths returns where the CA cert and key are kept.
+func CAPaths() (string, string) {
+	dir := homedir.MustExpand(SupportDir)
+
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+// CertInfo describes a certificate, the CA or one issued for a host.
+type CertInfo struct {
+	Subject     string
+	DNSNames    []string
+	Serial      string
+	Fingerprint string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	KeyType     string
+	KeyBits     int
+	Signature   string
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded cert, in the
+// usual colon separated form.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+func NewCertInfo(cert *x509.Certificate) *CertInfo {
+	info := &CertInfo{
+		Subject:     cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		Serial:      cert.SerialNumber.Text(16),
+		Fingerprint: Fingerprint(cert.Raw),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Signature:   cert.SignatureAlgorithm.String(),
+	}
+
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.KeyType = "RSA"
+		info.KeyBits = key.N.BitLen()
+	case *ecdsa.PublicKey:
+		info.KeyType = "ECDSA"
+		info.KeyBits = key.Curve.Params().BitSize
+	default:
+		info.KeyType = cert.PublicKeyAlgorithm.String()
+	}
+
+	return info
+}
+
+// Warnings returns what's wrong with the cert as a CA: that it's expired or
+// about to, or that its key or signature is weak.
+func (c *CertInfo) Warnings(now time.Time) []string {
+	var warnings []string
+
+	switch {
+	case now.After(c.NotAfter):
+		warnings = append(warnings, fmt.Sprintf("the CA expired on %s", c.NotAfter.Format("2006-01-02")))
+	case c.NotAfter.Sub(now) < caExpiryWarning:
+		warnings = append(warnings, fmt.Sprintf("the CA expires on %s", c.NotAfter.Format("2006-01-02")))
+	}
+
+	if c.KeyType == "RSA" && c.KeyBits < minRSABits {
+		warnings = append(warnings, fmt.Sprintf("the CA uses a weak %d bit RSA key", c.KeyBits))
+	}
+
+	if strings.Contains(c.Signature, "MD5") || strings.Contains(c.Signature, "SHA1") {
+		warnings = append(warnings, fmt.Sprintf("the CA uses a weak %s signature", c.Signature))
+	}
+
+	return warnings
+}
+
+// LoadCertInfo reads the PEM encoded cert at path.
+func LoadCertInfo(path string) (*CertInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Context(err, "parsing "+path)
+	}
+
+	return NewCertInfo(cert), nil
+}
+
+// warnAboutCA prints the CA's warnings, if it has any.
+func warnAboutCA(cert *x509.Certificate) {
+	for _, w := range NewCertInfo(cert).Warnings(time.Now()) {
+		fmt.Printf("! Warning: %s, regenerate it with 'puma-dev ca regenerate'\n", w)
+	}
+}
+
+// RegenerateCA replaces the CA with a new one and trusts it instead of the
+// old one. Certs issued by the old CA stop being trusted, so puma-dev has to
+// be restarted to issue new ones.
+func RegenerateCA() error {
+	certPath, keyPath := CAPaths()
+
+	err := os.MkdirAll(filepath.Dir(certPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(certPath); err == nil {
+		if err := UntrustCert(certPath); err != nil {
+			fmt.Printf("! Unable to untrust the old CA: %s\n", err)
+		}
+	}
+
+	err = GeneratePumaDevCertificateAuthority(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	// the kept app certs were issued by the old CA
+	os.RemoveAll(filepath.Join(filepath.Dir(certPath), CertsDir))
+
+	return TrustCert(certPath)
+}
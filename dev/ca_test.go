@@ -0,0 +1,90 @@
+package dev
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCA(t *testing.T) (*tls.Certificate, string) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	require.NoError(t, GeneratePumaDevCertificateAuthority(certPath, keyPath))
+
+	ca, err := tls.LoadX509KeyPair(certPath, keyPath)
+	require.NoError(t, err)
+
+	return &ca, certPath
+}
+
+func TestLoadCertInfo(t *testing.T) {
+	_, certPath := newTestCA(t)
+
+	info, err := LoadCertInfo(certPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Puma-dev CA", info.Subject)
+	assert.Equal(t, "RSA", info.KeyType)
+	assert.Equal(t, 2048, info.KeyBits)
+	assert.Regexp(t, "^([0-9A-F]{2}:){31}[0-9A-F]{2}$", info.Fingerprint)
+	assert.Empty(t, info.Warnings(time.Now()))
+
+	_, err = LoadCertInfo(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+}
+
+func TestCertInfo_Warnings(t *testing.T) {
+	now := time.Now()
+
+	expired := &CertInfo{KeyType: "RSA", KeyBits: 2048, NotAfter: now.Add(-time.Hour)}
+	assert.Len(t, expired.Warnings(now), 1)
+	assert.Contains(t, expired.Warnings(now)[0], "the CA expired on")
+
+	expiring := &CertInfo{KeyType: "RSA", KeyBits: 2048, NotAfter: now.Add(10 * 24 * time.Hour)}
+	assert.Contains(t, expiring.Warnings(now)[0], "the CA expires on")
+
+	weak := &CertInfo{KeyType: "RSA", KeyBits: 1024, Signature: "SHA1-RSA", NotAfter: now.Add(1000 * 24 * time.Hour)}
+	assert.Equal(t, []string{
+		"the CA uses a weak 1024 bit RSA key",
+		"the CA uses a weak SHA1-RSA signature",
+	}, weak.Warnings(now))
+}
+
+func TestMakeCert_validity(t *testing.T) {
+	ca, _ := newTestCA(t)
+
+	cert, err := makeCert(ca, "blog.test")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"blog.test"}, cert.Leaf.DNSNames)
+	assert.WithinDuration(t, time.Now().Add(LeafValidity), cert.Leaf.NotAfter, time.Minute)
+}
+
+func TestCertCache_Certificates(t *testing.T) {
+	ca, _ := newTestCA(t)
+
+	orig := CACert
+	CACert = ca
+	defer func() { CACert = orig }()
+
+	c := NewCertCache()
+
+	for _, name := range []string{"shop.test", "blog.test", "blog.test"} {
+		_, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		require.NoError(t, err)
+	}
+
+	certs := c.Certificates()
+	require.Len(t, certs, 2)
+
+	assert.Equal(t, "blog.test", certs[0].Subject)
+	assert.Equal(t, []string{"blog.test", "*.blog.test"}, certs[0].DNSNames)
+	assert.Equal(t, "shop.test", certs[1].Subject)
+	assert.Equal(t, "ECDSA", certs[1].KeyType)
+}
@@ -0,0 +1,268 @@
+package dev
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/vektra/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+// CertsDir is where issued certs are kept across restarts, below SupportDir
+const CertsDir = "certs"
+
+// certs kept on disk are issued again this long before they expire
+const certRenewBefore = 30 * 24 * time.Hour
+
+type certCache struct {
+	// Dir is where issued certs are kept across restarts, nothing is kept
+	// if it's empty
+	Dir string
+
+	// Domains are the domains puma-dev handles. Names below them get
+	// wildcard certs for their app's domain, see certNames.
+	Domains []string
+
+	lock  sync.Mutex
+	cache *lru.ARCCache
+
+	// issuing makes concurrent handshakes for names sharing a cert wait for
+	// the same one to be issued
+	issuing singleflight.Group
+}
+
+func NewCertCache() *certCache {
+	cache, err := lru.NewARC(1024)
+	if err != nil {
+		panic(err)
+	}
+
+	return &certCache{
+		cache: cache,
+	}
+}
+
+// certNames returns the names of the cert to serve name with, the first
+// being the key it's cached by. Names below one of Domains share a wildcard
+// cert: tenant1.app.test and tenant2.app.test are both served
+// app.test and *.app.test. No wildcard is issued for a domain itself, which
+// browsers wouldn't accept.
+func (c *certCache) certNames(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if name == "" || net.ParseIP(name) != nil {
+		return []string{name}
+	}
+
+	// c.Domains is sorted by decreasing complexity, like HTTPServer.Domains
+	domain := ""
+	for _, d := range c.Domains {
+		if strings.HasSuffix(name, "."+d) {
+			domain = d
+			break
+		}
+	}
+
+	if domain == "" {
+		dot := strings.LastIndexByte(name, '.')
+		if dot == -1 {
+			return []string{name}
+		}
+
+		domain = name[dot+1:]
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."+domain), ".")
+
+	base := name
+	if len(labels) > 1 {
+		base = strings.Join(labels[1:], ".") + "." + domain
+	}
+
+	return []string{base, "*." + base}
+}
+
+func (c *certCache) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	names := c.certNames(clientHello.ServerName)
+	key := names[0]
+
+	c.lock.Lock()
+	val, ok := c.cache.Get(key)
+	c.lock.Unlock()
+
+	if ok {
+		certCacheHits.Inc()
+		return val.(*tls.Certificate), nil
+	}
+
+	// only the caller whose function runs issues the cert, the others
+	// waiting on it get it like from the cache
+	issued := false
+
+	val, err, _ := c.issuing.Do(key, func() (interface{}, error) {
+		// issued while this caller was on its way here
+		c.lock.Lock()
+		val, ok := c.cache.Get(key)
+		c.lock.Unlock()
+
+		if ok {
+			return val, nil
+		}
+
+		issued = true
+
+		cert := c.load(key, names)
+
+		if cert == nil {
+			var err error
+
+			cert, err = makeCert(CACert, names...)
+			if err != nil {
+				return nil, err
+			}
+
+			c.save(key, cert)
+		}
+
+		c.lock.Lock()
+		c.cache.Add(key, cert)
+		c.lock.Unlock()
+
+		return cert, nil
+	})
+
+	if issued {
+		certCacheMisses.Inc()
+	} else {
+		certCacheHits.Inc()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return val.(*tls.Certificate), nil
+}
+
+func (c *certCache) path(key string) string {
+	return filepath.Join(c.Dir, strings.Replace(key, "*", "_", -1)+".pem")
+}
+
+// load returns the cert for key kept on disk, if there's one that's for
+// names, was issued by the current CA and isn't about to expire.
+func (c *certCache) load(key string, names []string) *tls.Certificate {
+	if c.Dir == "" || CACert == nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+
+	ca, err := x509.ParseCertificate(CACert.Certificate[0])
+	if err != nil || leaf.CheckSignatureFrom(ca) != nil {
+		return nil
+	}
+
+	if time.Until(leaf.NotAfter) < certRenewBefore || strings.Join(leaf.DNSNames, " ") != strings.Join(names, " ") {
+		return nil
+	}
+
+	cert.Leaf = leaf
+
+	return &cert
+}
+
+// save keeps cert on disk for key, so it's not issued again after a restart.
+func (c *certCache) save(key string, cert *tls.Certificate) {
+	if c.Dir == "" {
+		return
+	}
+
+	err := c.write(key, cert)
+	if err != nil {
+		fmt.Printf("! Unable to save cert for %s: %s\n", key, err)
+	}
+}
+
+func (c *certCache) write(key string, cert *tls.Certificate) error {
+	priv, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("unexpected key type %T", cert.PrivateKey)
+	}
+
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(c.Dir, 0700)
+	if err != nil {
+		return errors.Context(err, "creating certs directory")
+	}
+
+	tmp, err := ioutil.TempFile(c.Dir, ".cert")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	pem.Encode(tmp, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	pem.Encode(tmp, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// Certificates describes the certs in the cache, ordered by name.
+func (c *certCache) Certificates() []*CertInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var certs []*CertInfo
+
+	for _, key := range c.cache.Keys() {
+		val, ok := c.cache.Peek(key)
+		if !ok {
+			continue
+		}
+
+		if leaf := val.(*tls.Certificate).Leaf; leaf != nil {
+			certs = append(certs, NewCertInfo(leaf))
+		}
+	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].Subject < certs[j].Subject
+	})
+
+	return certs
+}
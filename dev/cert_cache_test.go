@@ -0,0 +1,142 @@
+package dev
+
+import (
+	"crypto/tls"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withTestCA(t *testing.T) {
+	ca, _ := newTestCA(t)
+
+	orig := CACert
+	CACert = ca
+	t.Cleanup(func() { CACert = orig })
+}
+
+func hello(name string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{ServerName: name}
+}
+
+func TestCertCache_certNames(t *testing.T) {
+	c := &certCache{Domains: []string{"dev.local", "test"}}
+
+	for name, expected := range map[string][]string{
+		"app.test":                 {"app.test", "*.app.test"},
+		"tenant1.app.test":         {"app.test", "*.app.test"},
+		"a.tenant1.app.test":       {"tenant1.app.test", "*.tenant1.app.test"},
+		"App.Test.":                {"app.test", "*.app.test"},
+		"shop.dev.local":           {"shop.dev.local", "*.shop.dev.local"},
+		"www.shop.dev.local":       {"shop.dev.local", "*.shop.dev.local"},
+		"test":                     {"test"},
+		"localhost":                {"localhost"},
+		"app.localhost":            {"app.localhost", "*.app.localhost"},
+		"127.0.0.1":                {"127.0.0.1"},
+		"":                         {""},
+		"blog.192.168.1.10.nip.io": {"192.168.1.10.nip.io", "*.192.168.1.10.nip.io"},
+	} {
+		assert.Equal(t, expected, c.certNames(name), name)
+	}
+}
+
+func TestCertCache_wildcard(t *testing.T) {
+	withTestCA(t)
+
+	c := NewCertCache()
+	c.Domains = []string{"test"}
+
+	misses := metricValue(certCacheMisses)
+
+	one, err := c.GetCertificate(hello("tenant1.app.test"))
+	require.NoError(t, err)
+
+	two, err := c.GetCertificate(hello("tenant2.app.test"))
+	require.NoError(t, err)
+
+	base, err := c.GetCertificate(hello("app.test"))
+	require.NoError(t, err)
+
+	assert.Same(t, one, two)
+	assert.Same(t, one, base)
+	assert.Equal(t, []string{"app.test", "*.app.test"}, one.Leaf.DNSNames)
+	assert.NoError(t, one.Leaf.VerifyHostname("tenant1.app.test"))
+	assert.Equal(t, misses+1, metricValue(certCacheMisses))
+}
+
+func TestCertCache_concurrent(t *testing.T) {
+	withTestCA(t)
+
+	c := NewCertCache()
+	c.Domains = []string{"test"}
+
+	var (
+		wg    sync.WaitGroup
+		certs = make([]*tls.Certificate, 20)
+
+		hits   = metricValue(certCacheHits)
+		misses = metricValue(certCacheMisses)
+	)
+
+	for i := range certs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			cert, err := c.GetCertificate(hello("tenant.app.test"))
+			assert.NoError(t, err)
+			certs[i] = cert
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, cert := range certs {
+		assert.Same(t, certs[0], cert)
+	}
+
+	// one lookup issued the cert, the others waited for it or found it
+	// cached
+	assert.Equal(t, misses+1, metricValue(certCacheMisses))
+	assert.Equal(t, hits+float64(len(certs)-1), metricValue(certCacheHits))
+}
+
+func TestCertCache_persisted(t *testing.T) {
+	withTestCA(t)
+
+	dir := t.TempDir()
+
+	c := NewCertCache()
+	c.Domains = []string{"test"}
+	c.Dir = dir
+
+	first, err := c.GetCertificate(hello("app.test"))
+	require.NoError(t, err)
+
+	assert.FileExists(t, c.path("app.test"))
+
+	// a restarted puma-dev serves the same cert
+	restarted := NewCertCache()
+	restarted.Domains = []string{"test"}
+	restarted.Dir = dir
+
+	again, err := restarted.GetCertificate(hello("www.app.test"))
+	require.NoError(t, err)
+
+	assert.Equal(t, first.Certificate[0], again.Certificate[0])
+
+	// but not one issued by another CA
+	withTestCA(t)
+
+	regenerated := NewCertCache()
+	regenerated.Domains = []string{"test"}
+	regenerated.Dir = dir
+
+	other, err := regenerated.GetCertificate(hello("app.test"))
+	require.NoError(t, err)
+
+	assert.NotEqual(t, first.Certificate[0], other.Certificate[0])
+}
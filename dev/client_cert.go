@@ -0,0 +1,324 @@
+package dev
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vektra/errors"
+)
+
+const (
+	// ClientCertRequest asks browsers for a client cert, but lets them go
+	// on without one
+	ClientCertRequest = "request"
+
+	// ClientCertRequire refuses connections without a client cert
+	ClientCertRequire = "require"
+)
+
+// The headers telling an app about the client cert of a request. They're
+// removed from requests to apps that ask for client certs, so they can't be
+// forged.
+const (
+	ClientVerifyHeader      = "X-Client-Verify"
+	ClientCertHeader        = "X-Client-Cert"
+	ClientSubjectHeader     = "X-Client-Subject"
+	ClientFingerprintHeader = "X-Client-Fingerprint"
+)
+
+// ClientCertDomain asks for client certs on a domain and its subdomains.
+type ClientCertDomain struct {
+	Domain string
+
+	// Mode is ClientCertRequest or ClientCertRequire
+	Mode string
+}
+
+// ParseClientCertDomains parses domains separated with ":", each optionally
+// followed by "=request" (the default) or "=require".
+func ParseClientCertDomains(spec string) ([]ClientCertDomain, error) {
+	var domains []ClientCertDomain
+
+	for _, part := range strings.Split(spec, ":") {
+		if part == "" {
+			continue
+		}
+
+		domain, mode, _ := strings.Cut(part, "=")
+
+		switch mode {
+		case "":
+			mode = ClientCertRequest
+		case ClientCertRequest, ClientCertRequire:
+		default:
+			return nil, fmt.Errorf("unknown client cert mode '%s' for %s, use request or require", mode, domain)
+		}
+
+		domains = append(domains, ClientCertDomain{Domain: strings.ToLower(domain), Mode: mode})
+	}
+
+	return domains, nil
+}
+
+// clientCertMode returns how client certs are asked for on host, "" if they
+// aren't. The most specific domain wins.
+func (h *HTTPServer) clientCertMode(host string) string {
+	if hst, _, err := net.SplitHostPort(host); err == nil {
+		host = hst
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	mode, matched := "", ""
+
+	for _, d := range h.ClientCerts {
+		if (host == d.Domain || strings.HasSuffix(host, "."+d.Domain)) && len(d.Domain) > len(matched) {
+			mode, matched = d.Mode, d.Domain
+		}
+	}
+
+	return mode
+}
+
+// tlsConfig is the config of the https listener. Handshakes for domains in
+// h.ClientCerts ask for a client cert signed by the puma-dev CA.
+func (h *HTTPServer) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: h.certCache.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if len(h.ClientCerts) == 0 {
+		return config
+	}
+
+	clientCAs := clientCertPool()
+
+	base := config.Clone()
+
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mode := h.clientCertMode(hello.ServerName)
+		if mode == "" {
+			return nil, nil
+		}
+
+		c := base.Clone()
+		c.ClientCAs = clientCAs
+		c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyClientCert(clientCAs, rawCerts)
+		}
+
+		if mode == ClientCertRequire {
+			c.ClientAuth = tls.RequireAnyClientCert
+		} else {
+			c.ClientAuth = tls.RequestClientCert
+		}
+
+		return c, nil
+	}
+
+	return config
+}
+
+// clientCertPool holds the CA client certs have to be issued by.
+func clientCertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+
+	if CACert != nil {
+		if ca, err := x509.ParseCertificate(CACert.Certificate[0]); err == nil {
+			pool.AddCert(ca)
+		}
+	}
+
+	return pool
+}
+
+// verifyClientCert checks the client cert given in a handshake, if there is
+// one, was issued by the CA. Client certs are verified here rather than by
+// crypto/tls because CAs generated by older versions of puma-dev are limited
+// to server auth, which would fail the chain's key usage check.
+func verifyClientCert(roots *x509.CertPool, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Context(err, "parsing client cert")
+		}
+
+		certs[i] = cert
+	}
+
+	_, err := verifyClientCertChain(roots, certs)
+	return err
+}
+
+// verifyClientCertChain returns the chains from the client cert certs[0] to
+// the CA, or an error if it wasn't issued by it for client auth.
+func verifyClientCertChain(roots *x509.CertPool, certs []*x509.Certificate) ([][]*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, errors.Context(err, "verifying client cert")
+	}
+
+	for _, usage := range certs[0].ExtKeyUsage {
+		if usage == x509.ExtKeyUsageClientAuth || usage == x509.ExtKeyUsageAny {
+			return chains, nil
+		}
+	}
+
+	if len(certs[0].ExtKeyUsage) == 0 {
+		return chains, nil
+	}
+
+	return nil, fmt.Errorf("client cert for %s isn't for client auth", certs[0].Subject.CommonName)
+}
+
+// verifiedClientCert returns the client cert the connection of req was made
+// with, or nil if it has none issued by the CA. The cert is checked again
+// rather than trusting the handshake, which went by the connection's SNI
+// and not by the host of req.
+func verifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	if len(req.TLS.VerifiedChains) > 0 {
+		return req.TLS.VerifiedChains[0][0]
+	}
+
+	chains, err := verifyClientCertChain(clientCertPool(), req.TLS.PeerCertificates)
+	if err != nil || len(chains) == 0 {
+		return nil
+	}
+
+	return chains[0][0]
+}
+
+// clientCertRequired returns the error page for a request to a host that
+// requires a client cert without one, or nil if req can go on. It's either
+// plain http or an https connection whose handshake was for another host,
+// like a browser reusing a connection for several hosts of a wildcard cert.
+func (h *HTTPServer) clientCertRequired(req *http.Request) *errorPage {
+	if len(h.ClientCerts) == 0 || h.clientCertMode(req.Host) != ClientCertRequire || verifiedClientCert(req) != nil {
+		return nil
+	}
+
+	if req.TLS == nil {
+		return &errorPage{
+			Status:  http.StatusForbidden,
+			Title:   "Client certificate required",
+			Message: req.Host + " requires a client certificate, connect to it over https",
+			text:    "client certificate required",
+		}
+	}
+
+	// browsers retry these on a new connection, with a handshake for the
+	// host
+	return &errorPage{
+		Status:  http.StatusMisdirectedRequest,
+		Title:   "Client certificate required",
+		Message: req.Host + " requires a client certificate, which this connection wasn't made with",
+		text:    "client certificate required",
+	}
+}
+
+// setClientCertHeaders tells the app about the verified client cert of req,
+// if its domain asks for them.
+func (h *HTTPServer) setClientCertHeaders(req *http.Request) {
+	if len(h.ClientCerts) == 0 || h.clientCertMode(req.Host) == "" {
+		return
+	}
+
+	for _, header := range []string{ClientVerifyHeader, ClientCertHeader, ClientSubjectHeader, ClientFingerprintHeader} {
+		req.Header.Del(header)
+	}
+
+	cert := verifiedClientCert(req)
+	if cert == nil {
+		req.Header.Set(ClientVerifyHeader, "NONE")
+		return
+	}
+
+	req.Header.Set(ClientVerifyHeader, "SUCCESS")
+	req.Header.Set(ClientSubjectHeader, cert.Subject.String())
+	req.Header.Set(ClientFingerprintHeader, Fingerprint(cert.Raw))
+	req.Header.Set(ClientCertHeader, url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+}
+
+// MakeClientCert issues a client cert for name signed by parent, returning
+// the PEM encoded cert and key.
+func MakeClientCert(parent *tls.Certificate, name string, validity time.Duration) ([]byte, []byte, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %v", err)
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	x509parent, err := x509.ParseCertificate(parent.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notBefore := time.Now()
+	notAfter := notBefore.Add(validity)
+	if notAfter.After(x509parent.NotAfter) {
+		notAfter = x509parent.NotAfter
+	}
+
+	cert := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Puma-dev Signed"},
+			CommonName:   name,
+		},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, cert, x509parent, privKey.Public(), parent.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create certificate: %v", err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(privKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,301 @@
+package dev
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestParseClientCertDomains(t *testing.T) {
+	domains, err := ParseClientCertDomains("api.test:Pay.test=require::admin.test=request")
+	require.NoError(t, err)
+
+	assert.Equal(t, []ClientCertDomain{
+		{Domain: "api.test", Mode: ClientCertRequest},
+		{Domain: "pay.test", Mode: ClientCertRequire},
+		{Domain: "admin.test", Mode: ClientCertRequest},
+	}, domains)
+
+	_, err = ParseClientCertDomains("api.test=always")
+	assert.EqualError(t, err, "unknown client cert mode 'always' for api.test, use request or require")
+}
+
+func TestHTTPServer_clientCertMode(t *testing.T) {
+	h := &HTTPServer{ClientCerts: []ClientCertDomain{
+		{Domain: "api.test", Mode: ClientCertRequest},
+		{Domain: "pay.api.test", Mode: ClientCertRequire},
+	}}
+
+	assert.Equal(t, ClientCertRequest, h.clientCertMode("api.test"))
+	assert.Equal(t, ClientCertRequest, h.clientCertMode("v1.api.test:443"))
+	assert.Equal(t, ClientCertRequire, h.clientCertMode("PAY.api.test."))
+	assert.Equal(t, "", h.clientCertMode("myapi.test"))
+	assert.Equal(t, "", h.clientCertMode("shop.test"))
+}
+
+func TestMakeClientCert(t *testing.T) {
+	ca, _ := newTestCA(t)
+
+	certPEM, keyPEM, err := MakeClientCert(ca, "alice", 24*time.Hour)
+	require.NoError(t, err)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	assert.Equal(t, "alice", leaf.Subject.CommonName)
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, leaf.ExtKeyUsage)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), leaf.NotAfter, time.Minute)
+}
+
+// newClientCertEchoBackend is an app echoing the client cert headers it gets.
+func newClientCertEchoBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ClientVerifyHeader, req.Header.Get(ClientVerifyHeader))
+		w.Header().Set(ClientSubjectHeader, req.Header.Get(ClientSubjectHeader))
+		w.Header().Set(ClientCertHeader, req.Header.Get(ClientCertHeader))
+	}))
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func clientCertTestClient(t *testing.T, certs ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+
+	ca, err := x509.ParseCertificate(CACert.Certificate[0])
+	require.NoError(t, err)
+	roots.AddCert(ca)
+
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "api.test",
+			Certificates: certs,
+		},
+	}}
+}
+
+func TestHTTPServer_clientCerts(t *testing.T) {
+	withTestCA(t)
+
+	h := newTestHTTPServer(t)
+	h.ClientCerts = []ClientCertDomain{{Domain: "api.test", Mode: ClientCertRequest}}
+
+	newProxyTestApp(t, h, "api", newClientCertEchoBackend(t))
+
+	serv := httptest.NewUnstartedServer(h)
+	serv.TLS = h.tlsConfig()
+	serv.StartTLS()
+	t.Cleanup(serv.Close)
+
+	req, err := http.NewRequest("GET", serv.URL, nil)
+	require.NoError(t, err)
+	req.Host = "api.test"
+	req.Header.Set(ClientVerifyHeader, "SUCCESS")
+
+	res, err := clientCertTestClient(t).Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, "NONE", res.Header.Get(ClientVerifyHeader), "forged headers are removed")
+
+	certPEM, keyPEM, err := MakeClientCert(CACert, "alice", time.Hour)
+	require.NoError(t, err)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	res, err = clientCertTestClient(t, cert).Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, "SUCCESS", res.Header.Get(ClientVerifyHeader))
+	assert.Equal(t, "CN=alice,O=Puma-dev Signed", res.Header.Get(ClientSubjectHeader))
+
+	pem, err := url.QueryUnescape(res.Header.Get(ClientCertHeader))
+	require.NoError(t, err)
+	assert.Equal(t, string(certPEM), pem)
+}
+
+func TestHTTPServer_clientCerts_require(t *testing.T) {
+	withTestCA(t)
+
+	h := newTestHTTPServer(t)
+	h.ClientCerts = []ClientCertDomain{{Domain: "api.test", Mode: ClientCertRequire}}
+
+	newProxyTestApp(t, h, "api", newClientCertEchoBackend(t))
+
+	serv := httptest.NewUnstartedServer(h)
+	serv.TLS = h.tlsConfig()
+	serv.StartTLS()
+	t.Cleanup(serv.Close)
+
+	_, err := clientCertTestClient(t).Get(serv.URL)
+	assert.Error(t, err)
+
+	// a cert from another CA isn't accepted
+	other, _ := newTestCA(t)
+	certPEM, keyPEM, err := MakeClientCert(other, "mallory", time.Hour)
+	require.NoError(t, err)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	_, err = clientCertTestClient(t, cert).Get(serv.URL)
+	assert.Error(t, err)
+
+	// nor is a server cert
+	server, err := makeCert(CACert, "api.test")
+	require.NoError(t, err)
+
+	_, err = clientCertTestClient(t, *server).Get(serv.URL)
+	assert.Error(t, err)
+
+	certPEM, keyPEM, err = MakeClientCert(CACert, "alice", time.Hour)
+	require.NoError(t, err)
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", serv.URL, nil)
+	require.NoError(t, err)
+	req.Host = "api.test"
+
+	res, err := clientCertTestClient(t, cert).Do(req)
+	require.NoError(t, err)
+
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode, string(body))
+	assert.Equal(t, "SUCCESS", res.Header.Get(ClientVerifyHeader))
+}
+
+func TestHttp_clientCertRequired_plainHTTP(t *testing.T) {
+	h := newTestHTTPServer(t)
+	h.ClientCerts = []ClientCertDomain{{Domain: "api.test", Mode: ClientCertRequire}}
+
+	newProxyTestApp(t, h, "api", newClientCertEchoBackend(t))
+
+	req := httptest.NewRequest("GET", "http://api.test/", nil)
+	req.Header.Set(ClientVerifyHeader, "SUCCESS")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get(ClientVerifyHeader), "the app wasn't reached")
+}
+
+func TestHttp_clientCertRequired_sniMismatch(t *testing.T) {
+	withTestCA(t)
+
+	h := newTestHTTPServer(t)
+	h.ClientCerts = []ClientCertDomain{{Domain: "api.test", Mode: ClientCertRequire}}
+
+	newProxyTestApp(t, h, "api", newClientCertEchoBackend(t))
+
+	serv := httptest.NewUnstartedServer(h)
+	serv.TLS = h.tlsConfig()
+	serv.StartTLS()
+	t.Cleanup(serv.Close)
+
+	// the handshake is for shop.test, which doesn't ask for a cert
+	client := clientCertTestClient(t)
+	client.Transport.(*http.Transport).TLSClientConfig.ServerName = "shop.test"
+
+	req, err := http.NewRequest("GET", serv.URL, nil)
+	require.NoError(t, err)
+	req.Host = "api.test"
+
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, http.StatusMisdirectedRequest, res.StatusCode)
+	assert.Empty(t, res.Header.Get(ClientVerifyHeader), "the app wasn't reached")
+}
+
+// h2ClientConn opens an http/2 connection to serv, with a handshake for
+// serverName
+func h2ClientConn(t *testing.T, serv *httptest.Server, serverName string, certs ...tls.Certificate) *http2.ClientConn {
+	roots := x509.NewCertPool()
+
+	ca, err := x509.ParseCertificate(CACert.Certificate[0])
+	require.NoError(t, err)
+	roots.AddCert(ca)
+
+	conn, err := tls.Dial("tcp", serv.Listener.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		ServerName:   serverName,
+		Certificates: certs,
+		NextProtos:   []string{"h2"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	require.NoError(t, err)
+
+	return cc
+}
+
+func TestHttp_clientCertRequired_coalescedH2(t *testing.T) {
+	withTestCA(t)
+
+	h := newTestHTTPServer(t)
+	h.ClientCerts = []ClientCertDomain{
+		{Domain: "api.test", Mode: ClientCertRequire},
+		{Domain: "www.api.test", Mode: ClientCertRequest},
+	}
+
+	newProxyTestApp(t, h, "api", newClientCertEchoBackend(t))
+
+	serv := httptest.NewUnstartedServer(h)
+	serv.TLS = h.tlsConfig()
+	serv.StartTLS()
+	t.Cleanup(serv.Close)
+
+	// the wildcard cert of www.api.test covers api.test too, so browsers
+	// reuse its connection for api.test
+	cc := h2ClientConn(t, serv, "www.api.test")
+
+	req, err := http.NewRequest("GET", "https://api.test/", nil)
+	require.NoError(t, err)
+
+	res, err := cc.RoundTrip(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, http.StatusMisdirectedRequest, res.StatusCode)
+	assert.Empty(t, res.Header.Get(ClientVerifyHeader), "the app wasn't reached")
+
+	// unless that connection was made with a cert from the CA
+	certPEM, keyPEM, err := MakeClientCert(CACert, "alice", time.Hour)
+	require.NoError(t, err)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	cc = h2ClientConn(t, serv, "www.api.test", cert)
+
+	res, err = cc.RoundTrip(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "SUCCESS", res.Header.Get(ClientVerifyHeader))
+}
@@ -0,0 +1,161 @@
+package dev
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	crashLoopMinBackoff = 2 * time.Second
+	crashLoopMaxBackoff = 2 * time.Minute
+
+	// failures further apart than this aren't considered part of the same
+	// crash loop
+	crashLoopResetAfter = 10 * time.Minute
+
+	// how many of an app's last log lines are kept for its failure page
+	crashLoopLogLines = 50
+)
+
+// CrashLoopError is returned instead of relaunching an app that recently
+// failed to boot, until its backoff window is over.
+type CrashLoopError struct {
+	App         string
+	Dir         string
+	Command     string
+	Failures    int
+	LastError   string
+	LastFailure time.Time
+	NextAttempt time.Time
+	Log         string
+}
+
+func (e *CrashLoopError) Error() string {
+	return fmt.Sprintf("app '%s' failed to boot %d time(s), not retrying for %s: %s",
+		e.App, e.Failures, e.RetryIn(), e.LastError)
+}
+
+// RetryIn is how long until the app may be launched again
+func (e *CrashLoopError) RetryIn() time.Duration {
+	d := time.Until(e.NextAttempt)
+	if d < 0 {
+		return 0
+	}
+
+	return d.Round(time.Second)
+}
+
+func crashLoopBackoff(failures int) time.Duration {
+	backoff := crashLoopMinBackoff
+
+	for i := 1; i < failures && backoff < crashLoopMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > crashLoopMaxBackoff {
+		backoff = crashLoopMaxBackoff
+	}
+
+	return backoff
+}
+
+// bootFailed records that app didn't manage to boot, starting or extending
+// its backoff window.
+func (a *AppPool) bootFailed(app *App, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.failures == nil {
+		a.failures = make(map[string]*CrashLoopError)
+	}
+
+	now := time.Now()
+
+	cl, ok := a.failures[app.Name]
+	if !ok || now.Sub(cl.LastFailure) > crashLoopResetAfter {
+		cl = &CrashLoopError{App: app.Name}
+		a.failures[app.Name] = cl
+	}
+
+	backoff := crashLoopBackoff(cl.Failures + 1)
+
+	cl.Failures++
+	cl.Dir = app.dir
+	cl.Command = app.bootCommand
+	cl.LastError = err.Error()
+	cl.LastFailure = now
+	cl.NextAttempt = now.Add(backoff)
+	cl.Log = app.tailLog(crashLoopLogLines)
+
+	appBootFailures.WithLabelValues(app.Name).Inc()
+
+	a.Events.Add("crash_loop",
+		"app", app.Name,
+		"failures", cl.Failures,
+		"next_attempt", cl.NextAttempt.Format(time.RFC3339),
+		"retry_in", backoff.String(),
+	)
+
+	fmt.Printf("! App '%s' failed to boot (%d time(s)), not retrying for %s\n", app.Name, cl.Failures, backoff)
+}
+
+// bootSucceeded forgets any boot failures of app.
+func (a *AppPool) bootSucceeded(app *App) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.failures, app.Name)
+}
+
+// ResetCrashLoop forgets the boot failures of the app with the given
+// canonical name, so it's launched on the next request.
+func (a *AppPool) ResetCrashLoop(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.failures, name)
+}
+
+// CrashLoop returns a copy of the boot failure record for the app with the
+// given canonical name, or nil if it hasn't failed to boot recently.
+func (a *AppPool) CrashLoop(name string) *CrashLoopError {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.crashLoop(name)
+}
+
+func (a *AppPool) crashLoop(name string) *CrashLoopError {
+	cl, ok := a.failures[name]
+	if !ok {
+		return nil
+	}
+
+	if time.Since(cl.LastFailure) > crashLoopResetAfter {
+		delete(a.failures, name)
+		return nil
+	}
+
+	c := *cl
+	return &c
+}
+
+// tailLog returns the last n lines the app logged, leaving out events.
+func (a *App) tailLog(n int) string {
+	var lines []string
+
+	a.lines.Do(func(line string) error {
+		if !strings.HasPrefix(line, "#event ") {
+			lines = append(lines, line)
+		}
+
+		return nil
+	})
+
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "")
+}
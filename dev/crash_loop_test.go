@@ -0,0 +1,94 @@
+package dev
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrashLoopBackoff(t *testing.T) {
+	assert.Equal(t, 2*time.Second, crashLoopBackoff(1))
+	assert.Equal(t, 4*time.Second, crashLoopBackoff(2))
+	assert.Equal(t, 16*time.Second, crashLoopBackoff(4))
+	assert.Equal(t, crashLoopMaxBackoff, crashLoopBackoff(50))
+}
+
+func TestAppPool_bootFailed(t *testing.T) {
+	pool := &AppPool{Events: &Events{}}
+	app := &App{Name: "broken", Events: pool.Events, pool: pool}
+
+	app.lines.Append("#event {}\n")
+	app.lines.Append("Could not find gem 'rails'\n")
+
+	assert.Nil(t, pool.CrashLoop("broken"))
+
+	pool.bootFailed(app, errors.New("unexpected exit"))
+	pool.bootFailed(app, errors.New("unexpected exit again"))
+
+	cl := pool.CrashLoop("broken")
+	if assert.NotNil(t, cl) {
+		assert.Equal(t, 2, cl.Failures)
+		assert.Equal(t, "unexpected exit again", cl.LastError)
+		assert.Equal(t, "Could not find gem 'rails'\n", cl.Log)
+		assert.WithinDuration(t, time.Now().Add(4*time.Second), cl.NextAttempt, time.Second)
+	}
+
+	pool.bootSucceeded(app)
+	assert.Nil(t, pool.CrashLoop("broken"))
+}
+
+func TestAppPool_crashLoopRefusesRelaunch(t *testing.T) {
+	dir := t.TempDir()
+	appDir := filepath.Join(dir, "broken")
+
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	procfile := "web: echo Could not find gem rails; exit 1\n"
+	if err := ioutil.WriteFile(filepath.Join(appDir, ProcfileName), []byte(procfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &AppPool{
+		Dir:       dir,
+		IdleTime:  time.Minute,
+		Events:    &Events{},
+		Readiness: Readiness{Timeout: 30 * time.Second},
+	}
+
+	app, err := pool.lookupApp("broken")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Error(t, app.WaitTilReady())
+	app.t.Wait()
+
+	_, err = pool.lookupApp("broken")
+
+	cl, ok := err.(*CrashLoopError)
+	if assert.True(t, ok, "expected a CrashLoopError, got %v", err) {
+		assert.Equal(t, 1, cl.Failures)
+		assert.Contains(t, cl.Log, "Could not find gem rails")
+	}
+
+	h := &HTTPServer{Pool: pool, Events: pool.Events, Domains: []string{"test"}}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://broken.test/", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "Could not find gem rails")
+
+	obj := cl.ToJson()
+	assert.Equal(t, 1, obj["failures"])
+}
@@ -1,63 +1,210 @@
 package dev
 
 import (
+	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 	"gopkg.in/tomb.v2"
 )
 
+// dnsNegativeTTL is how long resolvers may cache that a name or record
+// doesn't exist. It's short so new apps are found soon after they're
+// linked.
+const dnsNegativeTTL = 10
+
+// dnsNameServer is the label of the name server of each domain, as given in
+// its SOA and NS records
+const dnsNameServer = "ns"
+
+// DefaultDNSAnswers are the addresses names are answered with when their
+// domain has none set in Answers
+var DefaultDNSAnswers = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
 type DNSResponder struct {
 	Address string
 	Domains []string
 
+	// Answers are the addresses A and AAAA queries are answered with, by
+	// domain. Domains without any get DefaultDNSAnswers.
+	Answers map[string][]net.IP
+
+	// AppExists reports whether a name below a domain, without the domain,
+	// leads to an app. Names that don't get NXDOMAIN. Every name exists if
+	// it's nil.
+	AppExists func(name string) bool
+
+	// HasRoute reports whether a rule in the routing file matches a host,
+	// which exists then even without an app behind its name
+	HasRoute func(host string) bool
+
+	// ZoneDir is where zone files with extra records are read from, see
+	// ZoneFile
+	ZoneDir string
+
+	// Events gets a dns_query event for every answer when it's set
+	Events *Events
+
+	zones  dnsZones
+	mux    *dns.ServeMux
+	serial uint32
+
+	// upstreams are where queries outside Domains go, see Forward
+	upstreams []string
+	cache     *dnsCache
+
 	udpServer *dns.Server
 	tcpServer *dns.Server
 }
 
 func NewDNSResponder(address string, domains []string) *DNSResponder {
-	udp := &dns.Server{Addr: address, Net: "udp", TsigSecret: nil}
-	tcp := &dns.Server{Addr: address, Net: "tcp", TsigSecret: nil}
+	d := &DNSResponder{
+		Address: address,
+		Domains: domains,
+		mux:     dns.NewServeMux(),
+		serial:  uint32(time.Now().Unix()),
+	}
+
+	for _, domain := range domains {
+		zone := dns.Fqdn(strings.ToLower(domain))
 
-	d := &DNSResponder{Address: address, Domains: domains, udpServer: udp, tcpServer: tcp}
+		d.mux.HandleFunc(zone, func(w dns.ResponseWriter, r *dns.Msg) {
+			d.handleDNS(zone, w, r)
+		})
+	}
+
+	d.udpServer = &dns.Server{Addr: address, Net: "udp", Handler: d.mux}
+	d.tcpServer = &dns.Server{Addr: address, Net: "tcp", Handler: d.mux}
 
 	return d
 }
 
-func (d *DNSResponder) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
-	var (
-		v4 bool
-		rr dns.RR
-		a  net.IP
-	)
+// ParseDNSAnswers parses the addresses to answer with, as space separated
+// entries of comma separated addresses. An entry applies to all domains
+// unless it starts with a domain and "=", e.g.
+// "192.168.1.20 dev.local=10.0.0.2,fd00::2".
+func ParseDNSAnswers(spec string, domains []string) (map[string][]net.IP, error) {
+	answers := map[string][]net.IP{}
+
+	for _, entry := range strings.Fields(spec) {
+		targets := domains
+
+		if domain, addrs, ok := strings.Cut(entry, "="); ok {
+			entry = addrs
+			targets = []string{domain}
+
+			known := false
+			for _, d := range domains {
+				known = known || d == domain
+			}
+
+			if !known {
+				return nil, fmt.Errorf("'%s' isn't one of the domains handled", domain)
+			}
+		}
+
+		var ips []net.IP
+
+		for _, addr := range strings.Split(entry, ",") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", addr)
+			}
+
+			ips = append(ips, ip)
+		}
+
+		for _, domain := range targets {
+			answers[domain] = ips
+		}
+	}
+
+	return answers, nil
+}
+
+func (d *DNSResponder) addresses(zone string) []net.IP {
+	if ips, ok := d.Answers[strings.TrimSuffix(zone, ".")]; ok {
+		return ips
+	}
+
+	return DefaultDNSAnswers
+}
+
+func (d *DNSResponder) soa(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: dnsNegativeTTL},
+		Ns:      dnsNameServer + "." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  d.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  dnsNegativeTTL,
+	}
+}
+
+func (d *DNSResponder) ns(zone string) dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 0},
+		Ns:  dnsNameServer + "." + zone,
+	}
+}
+
+// addressRecords returns the A or AAAA records for name, both for ANY.
+func (d *DNSResponder) addressRecords(zone, name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
 
-	dom := r.Question[0].Name
+	for _, ip := range d.addresses(zone) {
+		v4 := ip.To4()
 
+		switch {
+		case v4 != nil && (qtype == dns.TypeA || qtype == dns.TypeANY):
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+				A:   v4,
+			})
+		case v4 == nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY):
+			rrs = append(rrs, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 0},
+				AAAA: ip,
+			})
+		}
+	}
+
+	return rrs
+}
+
+// handleDNS answers queries for names in zone, one of the domains. Names
+// that exist get the domain's addresses and their records from the zone
+// files; names that don't get NXDOMAIN, and both get the SOA record when
+// there's no answer, for resolvers to cache it by.
+func (d *DNSResponder) handleDNS(zone string, w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
-	if ip, ok := w.RemoteAddr().(*net.UDPAddr); ok {
-		a = ip.IP
-		v4 = a.To4() != nil
-	}
-	if ip, ok := w.RemoteAddr().(*net.TCPAddr); ok {
-		a = ip.IP
-		v4 = a.To4() != nil
+	m.Authoritative = true
+
+	if len(r.Question) == 0 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
 	}
 
-	if v4 {
-		rr = new(dns.A)
-		rr.(*dns.A).Hdr = dns.RR_Header{Name: dom, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0}
-		rr.(*dns.A).A = a.To4()
-	} else {
-		rr = new(dns.AAAA)
-		rr.(*dns.AAAA).Hdr = dns.RR_Header{Name: dom, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 0}
-		rr.(*dns.AAAA).AAAA = a
+	q := r.Question[0]
+
+	recordDNSQuery(q.Qtype)
+
+	answer, extra, exists := d.answer(zone, q.Name, q.Qtype, 0)
+	if !exists {
+		m.Rcode = dns.RcodeNameError
 	}
 
-	switch r.Question[0].Qtype {
-	case dns.TypeAAAA, dns.TypeA:
-		m.Answer = append(m.Answer, rr)
+	m.Answer = append(m.Answer, answer...)
+	m.Extra = append(m.Extra, extra...)
+
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, d.soa(zone))
 	}
 
 	if r.IsTsig() != nil {
@@ -66,14 +213,92 @@ func (d *DNSResponder) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
 		}
 	}
 
+	d.queryEvent(q, m)
+
 	w.WriteMsg(m)
 }
 
-func (d *DNSResponder) Serve() error {
-	for _, domain := range d.Domains {
-		dns.HandleFunc(domain+".", d.handleDNS)
+// answer returns the records answering a query for qname in zone, and
+// whether qname exists at all. A CNAME record in the zone files answers
+// every type but CNAME with its target's records, when they're ours too.
+func (d *DNSResponder) answer(zone, qname string, qtype uint16, depth int) (answer, extra []dns.RR, exists bool) {
+	name := strings.ToLower(qname)
+	records := d.zoneRecords(zone, name)
+
+	for _, rr := range records {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok || qtype == dns.TypeCNAME {
+			continue
+		}
+
+		answer = append(answer, cname)
+
+		target := strings.ToLower(cname.Target)
+		if tzone := d.zoneFor(target); tzone != "" && depth < dnsMaxCNAMEChain {
+			more, _, _ := d.answer(tzone, cname.Target, qtype, depth+1)
+			answer = append(answer, more...)
+		}
+
+		return answer, nil, true
+	}
+
+	// addresses in the zone files replace the domain's
+	hasAddresses := false
+
+	for _, rr := range records {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			hasAddresses = true
+		}
+
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			answer = append(answer, rr)
+		}
 	}
 
+	addresses := func(name string, qtype uint16) []dns.RR {
+		if hasAddresses && name == qname {
+			return nil
+		}
+
+		return d.addressRecords(zone, name, qtype)
+	}
+
+	switch {
+	case name == zone:
+		switch qtype {
+		case dns.TypeSOA:
+			answer = append(answer, d.soa(zone))
+		case dns.TypeNS:
+			answer = append(answer, d.ns(zone))
+			extra = append(extra, addresses(dnsNameServer+"."+zone, dns.TypeANY)...)
+		case dns.TypeANY:
+			answer = append(answer, d.soa(zone), d.ns(zone))
+			answer = append(answer, addresses(qname, qtype)...)
+		default:
+			answer = append(answer, addresses(qname, qtype)...)
+		}
+	case name == dnsNameServer+"."+zone:
+		answer = append(answer, addresses(qname, qtype)...)
+	case len(records) == 0 && !d.exists(zone, name):
+		return nil, nil, false
+	default:
+		answer = append(answer, addresses(qname, qtype)...)
+	}
+
+	return answer, extra, true
+}
+
+// exists reports whether name, in zone, leads to an app.
+func (d *DNSResponder) exists(zone, name string) bool {
+	if d.HasRoute != nil && d.HasRoute(strings.TrimSuffix(name, ".")) {
+		return true
+	}
+
+	return d.AppExists == nil || d.AppExists(strings.TrimSuffix(name, "."+zone))
+}
+
+func (d *DNSResponder) Serve() error {
 	var t tomb.Tomb
 
 	t.Go(func() error {
@@ -0,0 +1,343 @@
+package dev
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ResolvConf is where the system's name servers are read from when
+// forwarding to them.
+const ResolvConf = "/etc/resolv.conf"
+
+const (
+	// dnsForwardTimeout is how long an upstream has to answer before the
+	// next one is tried
+	dnsForwardTimeout = 2 * time.Second
+
+	// dnsCacheSize is how many answers from upstreams are kept
+	dnsCacheSize = 1024
+
+	// dnsCacheMaxTTL caps how long an answer is kept, whatever its TTL
+	dnsCacheMaxTTL = time.Hour
+)
+
+// ReadResolvConf returns the name servers in a resolv.conf file, as
+// addresses to forward queries to.
+func ReadResolvConf(path string) ([]string, error) {
+	cfg, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var upstreams []string
+
+	for _, server := range cfg.Servers {
+		upstreams = append(upstreams, net.JoinHostPort(server, cfg.Port))
+	}
+
+	return upstreams, nil
+}
+
+// ParseDNSUpstreams parses comma separated name servers, with or without a
+// port, or "system" for those in ResolvConf.
+func ParseDNSUpstreams(spec string) ([]string, error) {
+	if spec == "system" {
+		return ReadResolvConf(ResolvConf)
+	}
+
+	var upstreams []string
+
+	for _, server := range strings.Split(spec, ",") {
+		if server == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+
+		upstreams = append(upstreams, server)
+	}
+
+	return upstreams, nil
+}
+
+// Forward has queries for names outside d.Domains relayed to upstreams,
+// tried in order. Their answers are cached for as long as their TTLs allow.
+func (d *DNSResponder) Forward(upstreams []string) {
+	d.upstreams = nil
+
+	// forwarding to ourselves would loop
+	for _, upstream := range upstreams {
+		if !d.isSelf(upstream) {
+			d.upstreams = append(d.upstreams, upstream)
+		}
+	}
+
+	d.cache = newDNSCache(dnsCacheSize)
+	d.mux.HandleFunc(".", d.forward)
+}
+
+// resolveHostPort returns the IPs and the port of a host:port address.
+func resolveHostPort(addr string) ([]net.IP, int, error) {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	port, err := net.LookupPort("udp", sport)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, port, nil
+	}
+
+	ips, err := net.LookupIP(host)
+
+	return ips, port, err
+}
+
+// isLocalIP reports whether ip is one of this machine's addresses.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSelf reports whether upstream is where d answers queries, however it's
+// written: localhost, 127.0.0.1 and ::1 are all the same to it, and so is
+// any local address when d listens on all of them.
+func (d *DNSResponder) isSelf(upstream string) bool {
+	selfIPs, selfPort, err := resolveHostPort(d.Address)
+	if err != nil {
+		return upstream == d.Address
+	}
+
+	ips, port, err := resolveHostPort(upstream)
+	if err != nil {
+		return upstream == d.Address
+	}
+
+	if port != selfPort {
+		return false
+	}
+
+	for _, self := range selfIPs {
+		for _, ip := range ips {
+			switch {
+			case self.Equal(ip):
+				return true
+			case self.IsLoopback() && ip.IsLoopback():
+				return true
+			case self.IsUnspecified() && isLocalIP(ip):
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (d *DNSResponder) forward(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+
+	recordDNSQuery(q.Qtype)
+
+	if m := d.cache.get(q); m != nil {
+		dnsForwards.WithLabelValues("cache").Inc()
+
+		m.Id = r.Id
+		w.WriteMsg(m)
+		return
+	}
+
+	client := &dns.Client{Net: "udp", Timeout: dnsForwardTimeout}
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		client.Net = "tcp"
+	}
+
+	for _, upstream := range d.upstreams {
+		m, _, err := client.Exchange(r, upstream)
+		if err != nil {
+			continue
+		}
+
+		dnsForwards.WithLabelValues("upstream").Inc()
+
+		d.cache.put(q, m)
+
+		w.WriteMsg(m)
+		return
+	}
+
+	dnsForwards.WithLabelValues("failed").Inc()
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps answers from upstreams until their TTL runs out.
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+	size    int
+
+	now func() time.Time
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		entries: make(map[dnsCacheKey]*dnsCacheEntry),
+		size:    size,
+		now:     time.Now,
+	}
+}
+
+func cacheKey(q dns.Question) dnsCacheKey {
+	return dnsCacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+// cacheTTL is how long m may be cached: the lowest TTL of its records, or
+// for a negative answer the TTL of the SOA record that comes with it. It's
+// 0 for answers that mustn't be cached.
+func cacheTTL(m *dns.Msg) time.Duration {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0
+	}
+
+	var (
+		ttl   uint32
+		found bool
+	)
+
+	lower := func(t uint32) {
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				lower(soa.Hdr.Ttl)
+				lower(soa.Minttl)
+			}
+		}
+
+		if !found {
+			return 0
+		}
+	}
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				lower(rr.Header().Ttl)
+			}
+		}
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if d > dnsCacheMaxTTL {
+		d = dnsCacheMaxTTL
+	}
+
+	return d
+}
+
+func (c *dnsCache) put(q dns.Question, m *dns.Msg) {
+	ttl := cacheTTL(m)
+	if ttl <= 0 {
+		return
+	}
+
+	now := c.now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries) >= c.size {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+
+	// still full of live answers, make room for this one
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+
+		delete(c.entries, key)
+	}
+
+	c.entries[cacheKey(q)] = &dnsCacheEntry{msg: m.Copy(), stored: now, expires: now.Add(ttl)}
+}
+
+// get returns a copy of the cached answer to q, with its TTLs lowered by
+// the time it's been cached for.
+func (c *dnsCache) get(q dns.Question) *dns.Msg {
+	now := c.now()
+
+	c.lock.Lock()
+	entry, ok := c.entries[cacheKey(q)]
+	c.lock.Unlock()
+
+	if !ok || !now.Before(entry.expires) {
+		return nil
+	}
+
+	m := entry.msg.Copy()
+	age := uint32(now.Sub(entry.stored) / time.Second)
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl -= age
+			}
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,210 @@
+package dev
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUpstreamDNS is a stand-in for an upstream name server. It answers
+// example.com with an A record, nx.example.com with NXDOMAIN and anything
+// else with SERVFAIL, counting the queries it gets.
+func newUpstreamDNS(t *testing.T) (string, *int32) {
+	var queries int32
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		switch r.Question[0].Name {
+		case "example.com.":
+			rr, _ := dns.NewRR("example.com. 60 IN A 93.184.216.34")
+			m.Answer = append(m.Answer, rr)
+		case "nx.example.com.":
+			m.Rcode = dns.RcodeNameError
+			soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 7200 900 1209600 30")
+			m.Ns = append(m.Ns, soa)
+		default:
+			m.Rcode = dns.RcodeServerFailure
+		}
+
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return pc.LocalAddr().String(), &queries
+}
+
+// newForwardingTestResponder forwards to upstreams, with a clock that
+// tests move on by hand.
+func newForwardingTestResponder(t *testing.T, upstreams ...string) (*DNSResponder, *time.Time) {
+	d := newTestDNSResponder(t)
+	d.Forward(upstreams)
+
+	now := time.Now()
+	d.cache.now = func() time.Time { return now }
+
+	return d, &now
+}
+
+func TestDNSResponder_forward(t *testing.T) {
+	upstream, queries := newUpstreamDNS(t)
+	d, now := newForwardingTestResponder(t, upstream)
+
+	m := queryDNS(d, "example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, "93.184.216.34", m.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(queries))
+
+	// the cached answer counts its TTL down
+	*now = now.Add(20 * time.Second)
+
+	m = queryDNS(d, "Example.COM.", dns.TypeA)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, uint32(40), m.Answer[0].Header().Ttl)
+	assert.Equal(t, int32(1), atomic.LoadInt32(queries))
+
+	*now = now.Add(41 * time.Second)
+
+	queryDNS(d, "example.com.", dns.TypeA)
+	assert.Equal(t, int32(2), atomic.LoadInt32(queries))
+
+	// our own domains aren't forwarded
+	m = queryDNS(d, "blog.test.", dns.TypeA)
+	assert.Equal(t, "127.0.0.1", m.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(queries))
+}
+
+func TestDNSResponder_forward_negative(t *testing.T) {
+	upstream, queries := newUpstreamDNS(t)
+	d, now := newForwardingTestResponder(t, upstream)
+
+	for i := 0; i < 2; i++ {
+		m := queryDNS(d, "nx.example.com.", dns.TypeA)
+		assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(queries))
+
+	// kept for the SOA's minimum TTL, not its own
+	*now = now.Add(31 * time.Second)
+
+	queryDNS(d, "nx.example.com.", dns.TypeA)
+	assert.Equal(t, int32(2), atomic.LoadInt32(queries))
+
+	// failures aren't kept at all
+	for i := 0; i < 2; i++ {
+		m := queryDNS(d, "broken.example.com.", dns.TypeA)
+		assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+	}
+
+	assert.Equal(t, int32(4), atomic.LoadInt32(queries))
+}
+
+func TestDNSResponder_forward_fallback(t *testing.T) {
+	// nothing answers on a closed port
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := pc.LocalAddr().String()
+	pc.Close()
+
+	upstream, _ := newUpstreamDNS(t)
+
+	d, _ := newForwardingTestResponder(t, dead, upstream)
+
+	m := queryDNS(d, "example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 1)
+
+	d, _ = newForwardingTestResponder(t, dead)
+
+	m = queryDNS(d, "example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+}
+
+func TestDNSResponder_Forward_notToItself(t *testing.T) {
+	d := NewDNSResponder("127.0.0.1:53", []string{"test"})
+	d.Forward([]string{"127.0.0.1:53", "10.0.0.1:53"})
+
+	assert.Equal(t, []string{"10.0.0.1:53"}, d.upstreams)
+}
+
+func TestDNSResponder_Forward_notToItselfByAnotherName(t *testing.T) {
+	d := NewDNSResponder("127.0.0.1:9253", []string{"test"})
+	d.Forward([]string{"localhost:9253", "[::1]:9253", "127.0.0.1:53", "192.0.2.1:9253"})
+
+	assert.Equal(t, []string{"127.0.0.1:53", "192.0.2.1:9253"}, d.upstreams)
+
+	d = NewDNSResponder("0.0.0.0:9253", []string{"test"})
+	d.Forward([]string{"127.0.0.1:9253", "localhost:9253", "192.0.2.1:9253"})
+
+	assert.Equal(t, []string{"192.0.2.1:9253"}, d.upstreams)
+}
+
+func TestDNSCache_size(t *testing.T) {
+	c := newDNSCache(2)
+
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+
+		rr, _ := dns.NewRR(name + " 60 IN A 10.0.0.1")
+		m.Answer = append(m.Answer, rr)
+
+		c.put(m.Question[0], m)
+	}
+
+	assert.Len(t, c.entries, 2)
+}
+
+func TestParseDNSUpstreams(t *testing.T) {
+	upstreams, err := ParseDNSUpstreams("1.1.1.1,9.9.9.9:5353,[2606:4700::1111],,")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"1.1.1.1:53", "9.9.9.9:5353", "[2606:4700::1111]:53"}, upstreams)
+}
+
+func TestReadResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# generated\nnameserver 192.168.1.1\nnameserver fe80::1\nsearch lan\n"), 0644))
+
+	upstreams, err := ReadResolvConf(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"192.168.1.1:53", "[fe80::1]:53"}, upstreams)
+}
+
+func TestDNSResponder_forward_noQueryEvents(t *testing.T) {
+	upstream, _ := newUpstreamDNS(t)
+	d, _ := newForwardingTestResponder(t, upstream)
+	d.Events = &Events{}
+
+	queryDNS(d, "example.com.", dns.TypeA)
+	queryDNS(d, "example.com.", dns.TypeA)
+	queryDNS(d, "blog.test.", dns.TypeA)
+
+	var events strings.Builder
+	d.Events.WriteTo(&events)
+
+	// only the query for puma-dev's own domain is an event
+	assert.Equal(t, 1, strings.Count(events.String(), `"event":"dns_query"`))
+	assert.Contains(t, events.String(), `"name":"blog.test."`)
+}
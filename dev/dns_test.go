@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -61,3 +62,184 @@ func TestServeDNS(t *testing.T) {
 	}
 	assert.NoError(t, responderError)
 }
+
+// dnsRecorder is a dns.ResponseWriter keeping the message written.
+type dnsRecorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *dnsRecorder) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dnsRecorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 168, 1, 50), Port: 5353}
+}
+
+func queryDNS(d *DNSResponder, name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+
+	w := &dnsRecorder{}
+	d.mux.ServeDNS(w, r)
+
+	return w.msg
+}
+
+func newTestDNSResponder(t *testing.T) *DNSResponder {
+	pool := &AppPool{Dir: t.TempDir()}
+
+	for _, name := range []string{"blog", "shop/admin"} {
+		if err := os.MkdirAll(filepath.Join(pool.Dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDNSResponder("127.0.0.1:0", []string{"test", "dev.local"})
+	d.AppExists = pool.HasApp
+	d.ZoneDir = pool.Dir
+
+	return d
+}
+
+func TestDNSResponder_answers(t *testing.T) {
+	d := newTestDNSResponder(t)
+
+	m := queryDNS(d, "blog.test.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.True(t, m.Authoritative)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "127.0.0.1", m.Answer[0].(*dns.A).A.String(), "not the client's address")
+	}
+
+	m = queryDNS(d, "Tenant1.Blog.test.", dns.TypeAAAA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "::1", m.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	m = queryDNS(d, "shop-admin.dev.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 1)
+}
+
+func TestDNSResponder_configuredAnswers(t *testing.T) {
+	d := newTestDNSResponder(t)
+
+	var err error
+	d.Answers, err = ParseDNSAnswers("192.168.1.20 dev.local=10.0.0.2,fd00::2", d.Domains)
+	assert.NoError(t, err)
+
+	m := queryDNS(d, "blog.test.", dns.TypeA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "192.168.1.20", m.Answer[0].(*dns.A).A.String())
+	}
+
+	// no IPv6 address for test, so no data, but the name exists
+	m = queryDNS(d, "blog.test.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Empty(t, m.Answer)
+	assert.Len(t, m.Ns, 1)
+
+	m = queryDNS(d, "blog.dev.local.", dns.TypeAAAA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "fd00::2", m.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+}
+
+func TestParseDNSAnswers_errors(t *testing.T) {
+	_, err := ParseDNSAnswers("192.168.1", []string{"test"})
+	assert.EqualError(t, err, "invalid address '192.168.1'")
+
+	_, err = ParseDNSAnswers("local=10.0.0.2", []string{"test"})
+	assert.EqualError(t, err, "'local' isn't one of the domains handled")
+}
+
+func TestDNSResponder_nxdomain(t *testing.T) {
+	d := newTestDNSResponder(t)
+
+	m := queryDNS(d, "nope.test.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.Empty(t, m.Answer)
+
+	if assert.Len(t, m.Ns, 1) {
+		soa := m.Ns[0].(*dns.SOA)
+		assert.Equal(t, "test.", soa.Hdr.Name)
+		assert.Equal(t, "ns.test.", soa.Ns)
+		assert.Equal(t, uint32(dnsNegativeTTL), soa.Minttl)
+		assert.Equal(t, uint32(dnsNegativeTTL), soa.Hdr.Ttl)
+	}
+
+	// other record types of existing names are no data, not NXDOMAIN
+	m = queryDNS(d, "blog.test.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Empty(t, m.Answer)
+	assert.Len(t, m.Ns, 1)
+}
+
+func TestDNSResponder_defaultApp(t *testing.T) {
+	d := newTestDNSResponder(t)
+	pool := &AppPool{Dir: t.TempDir()}
+	d.AppExists = pool.HasApp
+	d.ZoneDir = pool.Dir
+
+	assert.Equal(t, dns.RcodeNameError, queryDNS(d, "anything.test.", dns.TypeA).Rcode)
+
+	if err := os.MkdirAll(filepath.Join(pool.Dir, "default"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, dns.RcodeSuccess, queryDNS(d, "anything.test.", dns.TypeA).Rcode)
+}
+
+func TestDNSResponder_soaAndNS(t *testing.T) {
+	d := newTestDNSResponder(t)
+
+	m := queryDNS(d, "dev.local.", dns.TypeSOA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "ns.dev.local.", m.Answer[0].(*dns.SOA).Ns)
+		assert.Equal(t, "hostmaster.dev.local.", m.Answer[0].(*dns.SOA).Mbox)
+	}
+
+	m = queryDNS(d, "test.", dns.TypeNS)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "ns.test.", m.Answer[0].(*dns.NS).Ns)
+	}
+	assert.Len(t, m.Extra, 2, "glue for the name server")
+
+	m = queryDNS(d, "ns.test.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 1)
+}
+
+func TestDNSResponder_ownMux(t *testing.T) {
+	d := newTestDNSResponder(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.udpServer.PacketConn = pc
+	go d.udpServer.ActivateAndServe()
+	defer d.udpServer.Shutdown()
+
+	c := new(dns.Client)
+
+	r := new(dns.Msg)
+	r.SetQuestion("blog.test.", dns.TypeA)
+
+	m, _, err := c.Exchange(r, pc.LocalAddr().String())
+	if assert.NoError(t, err) {
+		assert.Len(t, m.Answer, 1)
+	}
+
+	// nothing is registered on the global mux
+	r.SetQuestion("blog.example.", dns.TypeA)
+
+	m, _, err = c.Exchange(r, pc.LocalAddr().String())
+	if assert.NoError(t, err) {
+		assert.Equal(t, dns.RcodeRefused, m.Rcode)
+	}
+}
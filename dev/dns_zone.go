@@ -0,0 +1,198 @@
+package dev
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneFile is the name of the zone files with extra DNS records, like SRV,
+// TXT and CNAME records. One in the pool's directory applies to every
+// domain, with names relative to the domain. One in an app's directory
+// applies to the app, with names relative to the app's name.
+const ZoneFile = ".puma-dev.zone"
+
+// dnsMaxCNAMEChain is how many CNAME records in the zone files are followed
+// for an answer
+const dnsMaxCNAMEChain = 8
+
+type zoneKey struct {
+	path   string
+	origin string
+}
+
+type zoneRecords struct {
+	modTime time.Time
+	size    int64
+	records []dns.RR
+}
+
+// dnsZones keeps the records read from zone files. Files are stat'ed on
+// every lookup and read again when they change, so editing one takes effect
+// right away, including when an editor replaces it rather than writing to
+// it.
+type dnsZones struct {
+	lock  sync.Mutex
+	files map[zoneKey]*zoneRecords
+}
+
+// zoneRecords returns the records for name, in zone, from the zone file of
+// ZoneDir and of the app name belongs to.
+func (d *DNSResponder) zoneRecords(zone, name string) []dns.RR {
+	if d.ZoneDir == "" {
+		return nil
+	}
+
+	rrs := d.readZone(filepath.Join(d.ZoneDir, ZoneFile), zone, name)
+
+	if name == zone {
+		return rrs
+	}
+
+	for app := strings.TrimSuffix(name, "."+zone); app != ""; app = pruneSub(app) {
+		for _, candidate := range []string{app, strings.Replace(app, "-", "/", -1)} {
+			stat, err := os.Stat(filepath.Join(d.ZoneDir, candidate))
+			if err != nil {
+				continue
+			}
+
+			// the app that would serve name, it's the only one whose
+			// records apply
+			if stat.IsDir() {
+				rrs = append(rrs, d.readZone(filepath.Join(d.ZoneDir, candidate, ZoneFile), app+"."+zone, name)...)
+			}
+
+			return rrs
+		}
+	}
+
+	return rrs
+}
+
+func (d *DNSResponder) readZone(path, origin, name string) []dns.RR {
+	rrs, err := d.zones.read(path, origin, name)
+	if err != nil && d.Events != nil {
+		d.Events.Add("dns_zone_error", "path", path, "error", err.Error())
+	}
+
+	return rrs
+}
+
+// read returns the records for name in the zone file at path, read with
+// origin as the name relative names are relative to. The error is only
+// returned when the file is read, not for every lookup after.
+func (z *dnsZones) read(path, origin, name string) ([]dns.RR, error) {
+	stat, err := os.Stat(path)
+
+	key := zoneKey{path: path, origin: origin}
+
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	if err != nil {
+		delete(z.files, key)
+		return nil, nil
+	}
+
+	var perr error
+
+	zr, ok := z.files[key]
+	if !ok || !zr.modTime.Equal(stat.ModTime()) || zr.size != stat.Size() {
+		var records []dns.RR
+
+		records, perr = parseZoneFile(path, origin)
+
+		// keep the records from before the file was broken, it's likely
+		// being edited
+		if perr != nil && zr != nil {
+			records = zr.records
+		}
+
+		zr = &zoneRecords{modTime: stat.ModTime(), size: stat.Size(), records: records}
+
+		if z.files == nil {
+			z.files = make(map[zoneKey]*zoneRecords)
+		}
+
+		z.files[key] = zr
+	}
+
+	var rrs []dns.RR
+
+	for _, rr := range zr.records {
+		if strings.ToLower(rr.Header().Name) == name {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+
+	return rrs, perr
+}
+
+// parseZoneFile reads the records in the zone file at path. SOA records
+// are left out, puma-dev answers with its own.
+func parseZoneFile(path, origin string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	zp := dns.NewZoneParser(f, origin, path)
+	zp.SetDefaultTTL(0)
+
+	var records []dns.RR
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			records = append(records, rr)
+		}
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// zoneFor returns the zone of the domains name is in, or "" if it's in
+// none of them.
+func (d *DNSResponder) zoneFor(name string) string {
+	var zone string
+
+	for _, domain := range d.Domains {
+		z := dns.Fqdn(strings.ToLower(domain))
+
+		if (name == z || strings.HasSuffix(name, "."+z)) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+
+	return zone
+}
+
+// queryEvent adds a dns_query event for the answer m to the query q, for
+// puma-dev's own domains. Forwarded queries are only counted by the
+// dnsForwards metric, there can be far too many of them to keep.
+func (d *DNSResponder) queryEvent(q dns.Question, m *dns.Msg) {
+	if d.Events == nil {
+		return
+	}
+
+	var answer []string
+
+	for _, rr := range m.Answer {
+		answer = append(answer, strings.Replace(rr.String(), "\t", " ", -1))
+	}
+
+	d.Events.Add("dns_query",
+		"name", q.Name,
+		"type", dns.TypeToString[q.Qtype],
+		"rcode", dns.RcodeToString[m.Rcode],
+		"answer", strings.Join(answer, "; "))
+}
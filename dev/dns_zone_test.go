@@ -0,0 +1,179 @@
+package dev
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeZoneFile(t *testing.T, path, data string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+
+	// a later modification time, for writes that happen within the
+	// resolution of the file system's clock
+	later := time.Now().Add(time.Duration(len(data)) * time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+}
+
+func TestDNSResponder_zoneFiles(t *testing.T) {
+	d := newTestDNSResponder(t)
+
+	writeZoneFile(t, filepath.Join(d.ZoneDir, ZoneFile), `
+_verify      300 IN TXT "token=abc123"
+www              IN CNAME blog
+mail             IN A 10.0.0.25
+`)
+
+	writeZoneFile(t, filepath.Join(d.ZoneDir, "blog", ZoneFile), `
+@                IN TXT "blog"
+_http._tcp       IN SRV 0 5 3000 @
+api              IN CNAME shop-admin.test.
+`)
+
+	m := queryDNS(d, "_verify.test.", dns.TypeTXT)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, []string{"token=abc123"}, m.Answer[0].(*dns.TXT).Txt)
+		assert.Equal(t, uint32(300), m.Answer[0].Header().Ttl)
+	}
+
+	// the global file applies to every domain
+	m = queryDNS(d, "_verify.dev.local.", dns.TypeTXT)
+	assert.Len(t, m.Answer, 1)
+
+	m = queryDNS(d, "_http._tcp.blog.test.", dns.TypeSRV)
+	if assert.Len(t, m.Answer, 1) {
+		srv := m.Answer[0].(*dns.SRV)
+		assert.Equal(t, uint16(3000), srv.Port)
+		assert.Equal(t, "blog.test.", srv.Target)
+	}
+
+	// an app's records are added to its addresses
+	m = queryDNS(d, "blog.test.", dns.TypeTXT)
+	assert.Len(t, m.Answer, 1)
+
+	m = queryDNS(d, "blog.test.", dns.TypeA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "127.0.0.1", m.Answer[0].(*dns.A).A.String())
+	}
+
+	// addresses in a zone file replace the domain's
+	m = queryDNS(d, "mail.test.", dns.TypeA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "10.0.0.25", m.Answer[0].(*dns.A).A.String())
+	}
+
+	m = queryDNS(d, "mail.test.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Empty(t, m.Answer)
+
+	// an app's file only applies under the app
+	m = queryDNS(d, "_http._tcp.shop-admin.test.", dns.TypeSRV)
+	assert.Empty(t, m.Answer)
+}
+
+func TestDNSResponder_zoneFiles_cname(t *testing.T) {
+	d := newTestDNSResponder(t)
+
+	writeZoneFile(t, filepath.Join(d.ZoneDir, ZoneFile), `
+www     IN CNAME blog
+loop1   IN CNAME loop2
+loop2   IN CNAME loop1
+away    IN CNAME example.com.
+`)
+
+	// names in the zone files exist even when no app is behind them
+	m := queryDNS(d, "www.test.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	if assert.Len(t, m.Answer, 2) {
+		assert.Equal(t, "blog.test.", m.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "127.0.0.1", m.Answer[1].(*dns.A).A.String())
+		assert.Equal(t, "blog.test.", m.Answer[1].Header().Name)
+	}
+
+	m = queryDNS(d, "www.test.", dns.TypeCNAME)
+	assert.Len(t, m.Answer, 1)
+
+	// the target is left to the resolver when it isn't ours
+	m = queryDNS(d, "away.test.", dns.TypeA)
+	assert.Len(t, m.Answer, 1)
+
+	m = queryDNS(d, "loop1.test.", dns.TypeA)
+	assert.Len(t, m.Answer, dnsMaxCNAMEChain+1)
+}
+
+func TestDNSResponder_zoneFiles_reload(t *testing.T) {
+	d := newTestDNSResponder(t)
+	d.Events = &Events{}
+
+	path := filepath.Join(d.ZoneDir, "blog", ZoneFile)
+
+	m := queryDNS(d, "blog.test.", dns.TypeTXT)
+	assert.Empty(t, m.Answer)
+
+	writeZoneFile(t, path, `@ IN TXT "one"`)
+
+	m = queryDNS(d, "blog.test.", dns.TypeTXT)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, []string{"one"}, m.Answer[0].(*dns.TXT).Txt)
+	}
+
+	writeZoneFile(t, path, `@ IN TXT "two" "parts"`)
+
+	m = queryDNS(d, "blog.test.", dns.TypeTXT)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, []string{"two", "parts"}, m.Answer[0].(*dns.TXT).Txt)
+	}
+
+	// a broken file keeps the records from before it broke
+	writeZoneFile(t, path, `@ IN TXT "three`)
+
+	m = queryDNS(d, "blog.test.", dns.TypeTXT)
+	assert.Len(t, m.Answer, 1)
+
+	var events strings.Builder
+	d.Events.WriteTo(&events)
+	assert.Equal(t, 1, strings.Count(events.String(), `"event":"dns_zone_error"`))
+
+	queryDNS(d, "blog.test.", dns.TypeTXT)
+
+	events.Reset()
+	d.Events.WriteTo(&events)
+	assert.Equal(t, 1, strings.Count(events.String(), `"event":"dns_zone_error"`), "logged again without a change")
+
+	require.NoError(t, os.Remove(path))
+
+	m = queryDNS(d, "blog.test.", dns.TypeTXT)
+	assert.Empty(t, m.Answer)
+}
+
+func TestDNSResponder_queryEvents(t *testing.T) {
+	d := newTestDNSResponder(t)
+	d.Events = &Events{}
+
+	queryDNS(d, "blog.test.", dns.TypeA)
+	queryDNS(d, "nope.test.", dns.TypeAAAA)
+
+	var events strings.Builder
+	d.Events.WriteTo(&events)
+
+	lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+	require.Len(t, lines, 2)
+
+	assert.Contains(t, lines[0], `"event":"dns_query"`)
+	assert.Contains(t, lines[0], `"name":"blog.test."`)
+	assert.Contains(t, lines[0], `"type":"A"`)
+	assert.Contains(t, lines[0], `"rcode":"NOERROR"`)
+	assert.Contains(t, lines[0], `"answer":"blog.test. 0 IN A 127.0.0.1"`)
+
+	assert.Contains(t, lines[1], `"type":"AAAA"`)
+	assert.Contains(t, lines[1], `"rcode":"NXDOMAIN"`)
+	assert.Contains(t, lines[1], `"answer":""`)
+}
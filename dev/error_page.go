@@ -0,0 +1,288 @@
+package dev
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many of an app's last log lines are shown on its error page
+const errorPageLogLines = 50
+
+// errorPage describes a request puma-dev couldn't hand to an app. It's
+// rendered as HTML for browsers, as JSON for clients that ask for it and as
+// just the error message otherwise.
+type errorPage struct {
+	Status  int    `json:"status"`
+	Title   string `json:"title"`
+	Message string `json:"error"`
+	Host    string `json:"host"`
+
+	App     string   `json:"app,omitempty"`
+	Dir     string   `json:"directory,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Log     []string `json:"log,omitempty"`
+
+	Failures    int       `json:"failures,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+
+	Apps       []string `json:"apps,omitempty"`
+	Suggestion string   `json:"suggestion,omitempty"`
+
+	RetryURL string `json:"retryUrl,omitempty"`
+
+	// RetryToken has to be posted along to RetryURL, as the token form field
+	RetryToken string `json:"retryToken,omitempty"`
+
+	// the plain text body, used when neither HTML nor JSON was asked for
+	text string
+}
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}{{if .App}} - {{.App}}{{end}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #222; }
+h1 { color: #b00; }
+dt { font-weight: bold; }
+dd { margin: 0 0 0.5em 0; font-family: monospace; }
+pre { background: #222; color: #eee; padding: 1em; overflow-x: auto; }
+button { font-size: 1em; padding: 0.4em 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<dl>
+<dt>Host</dt><dd>{{.Host}}</dd>
+{{if .App}}<dt>App</dt><dd>{{.App}}</dd>{{end}}
+{{if .Dir}}<dt>Directory</dt><dd>{{.Dir}}</dd>{{end}}
+{{if .Command}}<dt>Boot command</dt><dd>{{.Command}}</dd>{{end}}
+{{if .Failures}}<dt>Failed boots</dt><dd>{{.Failures}}, next attempt at {{.NextAttempt.Format "15:04:05"}}</dd>{{end}}
+</dl>
+{{if .RetryURL}}
+<p><button id="retry">Restart app</button></p>
+<script>
+document.getElementById("retry").addEventListener("click", function () {
+  this.disabled = true;
+  fetch({{.RetryURL}}, { method: "POST", mode: "no-cors", body: new URLSearchParams({ token: {{.RetryToken}} }) }).finally(function () { location.reload(); });
+});
+</script>
+{{end}}
+{{if .Suggestion}}<p>Did you mean <strong>{{.Suggestion}}</strong>?</p>{{end}}
+{{if .Apps}}
+<h2>Available apps</h2>
+<ul>{{range .Apps}}<li>{{.}}</li>{{end}}</ul>
+{{end}}
+{{if .Log}}
+<h2>Last log lines</h2>
+<pre>{{range .Log}}{{.}}
+{{end}}</pre>
+{{end}}
+</body>
+</html>
+`))
+
+func wantsJSON(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+func wantsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+func (h *HTTPServer) serveErrorPage(w http.ResponseWriter, req *http.Request, page *errorPage) {
+	if page.Host == "" {
+		page.Host = req.Host
+	}
+
+	switch {
+	case wantsJSON(req):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(page.Status)
+		json.NewEncoder(w).Encode(page)
+	case wantsHTML(req):
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(page.Status)
+		errorPageTemplate.Execute(w, page)
+	default:
+		w.WriteHeader(page.Status)
+		w.Write([]byte(page.text))
+	}
+}
+
+// appErrorPage describes an app that failed to boot or run
+func (h *HTTPServer) appErrorPage(app *App, err error) *errorPage {
+	return &errorPage{
+		Status:     http.StatusInternalServerError,
+		Title:      "App failed to start",
+		Message:    err.Error(),
+		App:        app.Name,
+		Dir:        app.dir,
+		Command:    app.bootCommand,
+		Log:        logLines(app.tailLog(errorPageLogLines)),
+		RetryURL:   rpcRestartURL(app.Name),
+		RetryToken: rpcRestartToken(),
+		text:       err.Error(),
+	}
+}
+
+// crashLoopErrorPage describes an app that's being kept from relaunching
+// after failing to boot
+func (h *HTTPServer) crashLoopErrorPage(w http.ResponseWriter, cl *CrashLoopError) *errorPage {
+	w.Header().Set("Retry-After", strconv.Itoa(int(cl.RetryIn().Seconds())))
+
+	text := fmt.Sprintf("%s\n\nFailed to boot %d time(s), last at %s. The next attempt is allowed at %s.\n",
+		cl, cl.Failures, cl.LastFailure.Format(time.RFC1123), cl.NextAttempt.Format(time.RFC1123))
+
+	if cl.Log != "" {
+		text += fmt.Sprintf("\nLast log lines:\n\n%s", cl.Log)
+	}
+
+	return &errorPage{
+		Status:      http.StatusServiceUnavailable,
+		Title:       "App keeps failing to boot",
+		Message:     cl.Error(),
+		App:         cl.App,
+		Dir:         cl.Dir,
+		Command:     cl.Command,
+		Log:         logLines(cl.Log),
+		Failures:    cl.Failures,
+		NextAttempt: cl.NextAttempt,
+		RetryURL:    rpcRestartURL(cl.App),
+		RetryToken:  rpcRestartToken(),
+		text:        text,
+	}
+}
+
+// unknownAppErrorPage lists the apps puma-dev knows about, and which of them
+// the request was most likely meant for.
+func (h *HTTPServer) unknownAppErrorPage(name string) *errorPage {
+	page := &errorPage{
+		Status:  http.StatusInternalServerError,
+		Title:   "Unknown app",
+		Message: fmt.Sprintf("No app named '%s' was found in %s", name, h.Pool.Dir),
+		Dir:     h.Pool.Dir,
+		Apps:    h.Pool.appNames(),
+		text:    ErrUnknownApp.Error(),
+	}
+
+	page.Suggestion = closestName(name, page.Apps)
+
+	return page
+}
+
+// appNames lists the apps and proxies in the pool's directory
+func (a *AppPool) appNames() []string {
+	entries, err := os.ReadDir(a.Dir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		names = append(names, e.Name())
+	}
+
+	return names
+}
+
+// closestName returns the candidate most similar to name, as long as it's
+// similar enough to plausibly be a typo of it.
+func closestName(name string, candidates []string) string {
+	// Only the app part of a subdomain is looked up
+	if dot := strings.LastIndexByte(name, '.'); dot != -1 {
+		name = name[dot+1:]
+	}
+
+	best := ""
+	bestDist := len(name)/3 + 2
+
+	for _, c := range candidates {
+		d := levenshtein(name, c)
+		if d < bestDist {
+			best = c
+			bestDist = d
+		}
+	}
+
+	return best
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func logLines(log string) []string {
+	log = strings.TrimRight(log, "\n")
+	if log == "" {
+		return nil
+	}
+
+	return strings.Split(log, "\n")
+}
+
+// rpcRestartURL is where an error page's restart button posts to, or empty
+// when the RPC service isn't running.
+func rpcRestartURL(name string) string {
+	if !rpcService.initialized || rpcService.TcpPort == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("http://localhost:%d/apps/%s/restart", rpcService.TcpPort, url.PathEscape(name))
+}
+
+// rpcRestartToken is the token an error page's restart button posts along,
+// so other sites can't restart apps, or empty when the RPC service isn't
+// running.
+func rpcRestartToken() string {
+	if !rpcService.initialized || rpcService.TcpPort == 0 {
+		return ""
+	}
+
+	return rpcService.restartToken
+}
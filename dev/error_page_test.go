@@ -0,0 +1,95 @@
+package dev
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevenshtein(t *testing.T) {
+	assert.Equal(t, 0, levenshtein("blog", "blog"))
+	assert.Equal(t, 1, levenshtein("blg", "blog"))
+	assert.Equal(t, 3, levenshtein("kitten", "sitting"))
+	assert.Equal(t, 4, levenshtein("", "shop"))
+}
+
+func TestClosestName(t *testing.T) {
+	apps := []string{"blog", "shop", "storefront"}
+
+	assert.Equal(t, "blog", closestName("bolg", apps))
+	assert.Equal(t, "storefront", closestName("admin.storfront", apps))
+	assert.Equal(t, "", closestName("billing", apps))
+}
+
+func TestHttp_unknownApp_plain(t *testing.T) {
+	h := newTestHTTPServer(t, "blog", "shop", ".hidden")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://bolg.test/", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "unknown app", w.Body.String())
+}
+
+func TestHttp_unknownApp_html(t *testing.T) {
+	h := newTestHTTPServer(t, "blog", "shop", ".hidden")
+
+	req := httptest.NewRequest("GET", "http://bolg.test/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	body := w.Body.String()
+
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, body, "Did you mean <strong>blog</strong>?")
+	assert.Contains(t, body, "<li>shop</li>")
+	assert.NotContains(t, body, ".hidden")
+}
+
+func TestHttp_unknownApp_json(t *testing.T) {
+	h := newTestHTTPServer(t, "blog", "shop", ".hidden")
+
+	req := httptest.NewRequest("GET", "http://bolg.test/", nil)
+	req.Header.Set("Accept", "application/json")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var page map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page)) {
+		return
+	}
+
+	assert.Equal(t, "Unknown app", page["title"])
+	assert.Equal(t, "blog", page["suggestion"])
+	assert.Equal(t, []interface{}{"blog", "shop"}, page["apps"])
+}
+
+func TestHttp_appErrorPage(t *testing.T) {
+	h := newTestHTTPServer(t, "blog", "shop", ".hidden")
+
+	app := &App{Name: "blog", dir: "/srv/blog", bootCommand: "npm start"}
+	app.lines.Append("#event {}\n")
+	app.lines.Append("Error: Cannot find module 'express'\n")
+
+	page := h.appErrorPage(app, errors.New("unexpected exit"))
+
+	assert.Equal(t, "/srv/blog", page.Dir)
+	assert.Equal(t, "npm start", page.Command)
+	assert.Equal(t, []string{"Error: Cannot find module 'express'"}, page.Log)
+
+	req := httptest.NewRequest("GET", "http://blog.test/", nil)
+	req.Header.Set("Accept", "text/html")
+
+	w := httptest.NewRecorder()
+	h.serveErrorPage(w, req, page)
+
+	assert.Contains(t, w.Body.String(), "Cannot find module &#39;express&#39;")
+	assert.Contains(t, w.Body.String(), "npm start")
+}
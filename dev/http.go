@@ -2,6 +2,7 @@ package dev
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,6 +16,8 @@ import (
 	"time"
 
 	"github.com/bmizerany/pat"
+	"github.com/puma/puma-dev/homedir"
+	"golang.org/x/net/http2"
 )
 
 type HTTPServer struct {
@@ -26,11 +29,33 @@ type HTTPServer struct {
 	IgnoredStaticPaths []string
 	Domains            []string
 
+	// BootSplash shows browsers a page with the boot log of a booting app,
+	// instead of holding their request until the app is ready.
+	BootSplash bool
+
+	// MaxBootWait is the longest other requests wait for a booting app. 0
+	// waits until the app boots or hits its boot timeout.
+	MaxBootWait time.Duration
+
+	// AccessLog, if set, gets a line for every request to an app
+	AccessLog *AccessLog
+
+	// RequestEvents adds a request event for every request to an app
+	RequestEvents bool
+
+	// ClientCerts are the domains https requests ask for client certs on
+	ClientCerts []ClientCertDomain
+
 	mux           *pat.PatternServeMux
+	certCache     *certCache
 	unixTransport *http.Transport
 	unixProxy     *httputil.ReverseProxy
 	tcpTransport  *http.Transport
 	tcpProxy      *httputil.ReverseProxy
+	h2cTransport  *http2.Transport
+	h2cProxy      *httputil.ReverseProxy
+	h2Transport   *http2.Transport
+	h2Proxy       *httputil.ReverseProxy
 }
 
 const dialerTimeout = 5 * time.Second
@@ -57,33 +82,46 @@ func (h *HTTPServer) Setup() {
 		ExpectContinueTimeout: expectContinueTimeout,
 	}
 
-	h.unixProxy = &httputil.ReverseProxy{
-		Director:      func(_ *http.Request) {},
-		Transport:     h.unixTransport,
-		FlushInterval: proxyFlushInternal,
-	}
+	h.unixProxy = newReverseProxy(h.unixTransport)
+
+	h.tcpTransport = newTCPTransport(nil)
+	h.tcpProxy = newReverseProxy(h.tcpTransport)
+
+	h.setupHTTP2()
+
+	h.Pool.AppClosed = h.AppClosed
 
-	h.tcpTransport = &http.Transport{
+	h.certCache = NewCertCache()
+	h.certCache.Domains = h.Domains
+	h.certCache.Dir = filepath.Join(homedir.MustExpand(SupportDir), CertsDir)
+
+	h.mux = pat.New()
+
+	h.mux.Get("/status", http.HandlerFunc(h.status))
+	h.mux.Get("/events", http.HandlerFunc(h.events))
+	h.mux.Get(MetricsPath, http.HandlerFunc(h.metrics))
+}
+
+// newTCPTransport is a transport to apps over TCP, verifying https apps
+// with tlsConfig if it's set.
+func newTCPTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   dialerTimeout,
 			KeepAlive: keepAlive,
 		}).DialContext,
+		TLSClientConfig:       tlsConfig,
 		TLSHandshakeTimeout:   tlsHandshakeTimeout,
 		ExpectContinueTimeout: expectContinueTimeout,
 	}
+}
 
-	h.tcpProxy = &httputil.ReverseProxy{
+func newReverseProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
 		Director:      func(_ *http.Request) {},
-		Transport:     h.tcpTransport,
+		Transport:     transport,
 		FlushInterval: proxyFlushInternal,
 	}
-
-	h.Pool.AppClosed = h.AppClosed
-
-	h.mux = pat.New()
-
-	h.mux.Get("/status", http.HandlerFunc(h.status))
-	h.mux.Get("/events", http.HandlerFunc(h.events))
 }
 
 func (h *HTTPServer) AppClosed(app *App) {
@@ -92,9 +130,17 @@ func (h *HTTPServer) AppClosed(app *App) {
 	// but that's ok.
 	h.unixTransport.CloseIdleConnections()
 	h.tcpTransport.CloseIdleConnections()
+	h.h2cTransport.CloseIdleConnections()
+	h.h2Transport.CloseIdleConnections()
 }
 
 func (h *HTTPServer) removeTLD(host string) string {
+	return removeDomain(host, h.Domains)
+}
+
+// removeDomain returns host without its port and domain, the name apps are
+// looked up by. domains is sorted by decreasing complexity.
+func removeDomain(host string, domains []string) string {
 	colon := strings.LastIndexByte(host, ':')
 	if colon != -1 {
 		if h, _, err := net.SplitHostPort(host); err == nil {
@@ -113,8 +159,7 @@ func (h *HTTPServer) removeTLD(host string) string {
 		return name
 	}
 
-	// h.Domains is sorted by decreasing complexity
-	for _, tld := range h.Domains {
+	for _, tld := range domains {
 		if strings.HasSuffix(host, "."+tld) {
 			return strings.TrimSuffix(host, "."+tld)
 		}
@@ -141,28 +186,130 @@ func (h *HTTPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	aw := newAccessWriter(w, req)
+	defer h.logAccess(aw, req)
+
+	h.serveApp(aw, req)
+
+	recordRequest(aw)
+}
+
+// findApp returns the app for req and the name it was looked up by, from
+// the routing file if a rule matches it, or else by name. The rule is nil
+// when none matched.
+func (h *HTTPServer) findApp(req *http.Request) (string, *Route, *App, error) {
+	if route, target := h.Pool.MatchRoute(req.Host, req.URL.Path); route != nil {
+		app, err := h.Pool.routeApp(route, target)
+		return target, route, app, err
+	}
+
 	name := h.removeTLD(req.Host)
 
 	app, err := h.Pool.FindAppByDomainName(name)
+
+	return name, nil, app, err
+}
+
+// stripPrefix returns a copy of req without prefix at the start of its
+// path, for an app mounted at prefix, which gets it in X-Forwarded-Prefix.
+func stripPrefix(req *http.Request, prefix string) *http.Request {
+	r := req.Clone(req.Context())
+
+	r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+
+	if req.URL.RawPath != "" {
+		r.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.RawPath, prefix), "/")
+	}
+
+	r.Header.Set("X-Forwarded-Prefix", prefix)
+
+	return r
+}
+
+func (h *HTTPServer) serveApp(w *accessWriter, req *http.Request) {
+	if page := h.clientCertRequired(req); page != nil {
+		h.serveErrorPage(w, req, page)
+		return
+	}
+
+	name, route, app, err := h.findApp(req)
 	if err != nil {
+		if cl, ok := err.(*CrashLoopError); ok {
+			h.serveErrorPage(w, req, h.crashLoopErrorPage(w, cl))
+			return
+		}
+
 		if err == ErrUnknownApp {
 			h.Events.Add("unknown_app", "name", name, "host", req.Host)
-		} else {
-			h.Events.Add("lookup_error", "error", err.Error())
+			h.serveErrorPage(w, req, h.unknownAppErrorPage(name))
+			return
 		}
 
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		h.Events.Add("lookup_error", "error", err.Error())
+		h.serveErrorPage(w, req, &errorPage{
+			Status:  http.StatusInternalServerError,
+			Title:   "Error looking up app",
+			Message: err.Error(),
+			text:    err.Error(),
+		})
 		return
 	}
 
-	err = app.WaitTilReady()
+	w.app = app.Name
+
+	// matched before the prefix is stripped, as the splash page points its
+	// browser at the events under the prefix the app is mounted at
+	if h.BootSplash {
+		eventsPath := bootEventsPath(route)
+
+		if req.URL.Path == eventsPath {
+			h.serveBootEvents(w, req, app)
+			return
+		}
+
+		if app.isBooting() && isNavigation(req) {
+			h.serveBootSplash(w, req, app, eventsPath)
+			return
+		}
+	}
+
+	if route != nil && route.Strip {
+		req = stripPrefix(req, route.Path)
+	}
+
+	bootWaitStart := time.Now()
+	err = app.WaitTilReadyFor(h.MaxBootWait)
+	w.bootWait = time.Since(bootWaitStart)
+
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		if err == ErrStillBooting {
+			w.Header().Set("Retry-After", "5")
+			h.serveErrorPage(w, req, &errorPage{
+				Status:  http.StatusServiceUnavailable,
+				Title:   "App is still booting",
+				Message: fmt.Sprintf("%s after waiting %s", err, h.MaxBootWait),
+				App:     app.Name,
+				Dir:     app.dir,
+				Command: app.bootCommand,
+				Log:     logLines(app.tailLog(errorPageLogLines)),
+				text:    err.Error(),
+			})
+			return
+		}
+
+		if cl := h.Pool.CrashLoop(app.Name); cl != nil {
+			h.serveErrorPage(w, req, h.crashLoopErrorPage(w, cl))
+			return
+		}
+
+		h.serveErrorPage(w, req, h.appErrorPage(app, err))
 		return
 	}
 
+	// lets a restart that replaces the app's process wait for this request
+	app.beginRequest()
+	defer app.endRequest()
+
 	if h.shouldServePublicPathForApp(app, req) {
 		safeURLPath := path.Clean(req.URL.Path)
 		path := filepath.Join(app.dir, "public", safeURLPath)
@@ -170,6 +317,7 @@ func (h *HTTPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		fi, err := os.Stat(path)
 		if err == nil && !fi.IsDir() {
 			if ofile, err := os.Open(path); err == nil {
+				w.public = true
 				http.ServeContent(w, req, req.URL.Path, fi.ModTime(), io.ReadSeeker(ofile))
 				return
 			}
@@ -182,14 +330,53 @@ func (h *HTTPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		req.Header.Set("X-Forwarded-Proto", "https")
 	}
 
-	req.URL.Scheme, req.URL.Host = app.Scheme, app.Address()
-	if app.Scheme == "httpu" {
-		req.URL.Scheme, req.URL.Host = "http", app.Address()
-		h.unixProxy.ServeHTTP(w, req)
-	} else {
-		req.URL.Scheme, req.URL.Host = app.Scheme, app.Address()
-		h.tcpProxy.ServeHTTP(w, req)
+	h.setClientCertHeaders(req)
+
+	if app.Scheme == SchemeTCP {
+		h.serveErrorPage(w, req, &errorPage{
+			Status:  http.StatusMisdirectedRequest,
+			Title:   "App only accepts TLS connections",
+			Message: fmt.Sprintf("%s is a tcp proxy, connect to it with TLS on the https port", app.Name),
+			text:    "tcp proxy only accepts TLS connections",
+		})
+		return
+	}
+
+	if app.proxyRoutes != nil {
+		h.serveProxyRoutes(w, req, app.proxyRoutes)
+		return
 	}
+
+	h.forward(w, req, app.Scheme, app.Address(), nil)
+}
+
+// forward proxies req to the app at address, with proxy rather than the one
+// shared by apps with the same scheme if it's set.
+func (h *HTTPServer) forward(w *accessWriter, req *http.Request, scheme, address string, proxy *httputil.ReverseProxy) {
+	w.startUpstream(scheme + "://" + address)
+
+	req.URL.Host = address
+
+	switch scheme {
+	case "httpu":
+		req.URL.Scheme, proxy = "http", h.unixProxy
+	case SchemeH2C, SchemeGRPC:
+		req.URL.Scheme, proxy = "http", h.h2cProxy
+	case SchemeH2:
+		req.URL.Scheme = "https"
+
+		if proxy == nil {
+			proxy = h.h2Proxy
+		}
+	default:
+		req.URL.Scheme = scheme
+
+		if proxy == nil {
+			proxy = h.tcpProxy
+		}
+	}
+
+	proxy.ServeHTTP(w, req)
 }
 
 func (h *HTTPServer) shouldServePublicPathForApp(a *App, req *http.Request) bool {
@@ -203,7 +390,12 @@ func (h *HTTPServer) shouldServePublicPathForApp(a *App, req *http.Request) bool
 		return false
 	}
 
-	for _, ignoredPath := range h.IgnoredStaticPaths {
+	ignoredPaths := h.IgnoredStaticPaths
+	if a.config != nil {
+		ignoredPaths = append(ignoredPaths[:len(ignoredPaths):len(ignoredPaths)], a.config.NoServePublicPaths...)
+	}
+
+	for _, ignoredPath := range ignoredPaths {
 		if strings.HasPrefix(reqPath, ignoredPath) {
 			if h.Debug {
 				fmt.Fprintf(os.Stdout, "Not serving '%s' as it matches a path in no-serve-public-paths\n", reqPath)
@@ -216,11 +408,19 @@ func (h *HTTPServer) shouldServePublicPathForApp(a *App, req *http.Request) bool
 }
 
 func (h *HTTPServer) status(w http.ResponseWriter, req *http.Request) {
+	type sidecarStatus struct {
+		Command  string `json:"command"`
+		Status   string `json:"status"`
+		Restarts int    `json:"restarts"`
+		Log      string `json:"log"`
+	}
+
 	type appStatus struct {
-		Scheme  string `json:"scheme"`
-		Address string `json:"address"`
-		Status  string `json:"status"`
-		Log     string `json:"log"`
+		Scheme   string                   `json:"scheme"`
+		Address  string                   `json:"address"`
+		Status   string                   `json:"status"`
+		Log      string                   `json:"log"`
+		Sidecars map[string]sidecarStatus `json:"sidecars,omitempty"`
 	}
 
 	statuses := map[string]appStatus{}
@@ -239,11 +439,27 @@ func (h *HTTPServer) status(w http.ResponseWriter, req *http.Request) {
 			status = "unknown"
 		}
 
+		var sidecars map[string]sidecarStatus
+
+		for _, s := range a.sidecars {
+			if sidecars == nil {
+				sidecars = map[string]sidecarStatus{}
+			}
+
+			sidecars[s.Name] = sidecarStatus{
+				Command:  s.Command,
+				Status:   s.Status(),
+				Restarts: s.Restarts(),
+				Log:      s.Log(),
+			}
+		}
+
 		statuses[a.Name] = appStatus{
-			Scheme:  a.Scheme,
-			Address: a.Address(),
-			Status:  status,
-			Log:     a.Log(),
+			Scheme:   a.Scheme,
+			Address:  a.Address(),
+			Status:   status,
+			Log:      a.Log(),
+			Sidecars: sidecars,
 		}
 	})
 
@@ -0,0 +1,101 @@
+package dev
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Schemes of proxy targets that speak HTTP/2, used in proxy files like
+// h2c://127.0.0.1:50051
+const (
+	// SchemeH2C is HTTP/2 without TLS, with prior knowledge rather than an
+	// upgrade, as gRPC servers expect
+	SchemeH2C = "h2c"
+
+	// SchemeH2 is HTTP/2 over TLS
+	SchemeH2 = "h2"
+)
+
+// h2IdleTimeout is how long an HTTP/2 connection to an app goes without
+// frames before it's pinged to check it's still alive
+const h2IdleTimeout = 30 * time.Second
+
+func (h *HTTPServer) setupHTTP2() {
+	h.h2cTransport = &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			dialer := net.Dialer{
+				Timeout:   dialerTimeout,
+				KeepAlive: keepAlive,
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: h2IdleTimeout,
+	}
+
+	h.h2cProxy = newReverseProxy(h.h2cTransport)
+
+	h.h2Transport = newH2Transport(nil)
+	h.h2Proxy = newReverseProxy(h.h2Transport)
+}
+
+// newH2Transport is a transport to apps speaking HTTP/2 over TLS, verifying
+// them with tlsConfig if it's set. Unless tlsConfig has its own roots, apps
+// can use certs from the puma-dev CA as well as publicly trusted ones.
+func newH2Transport(tlsConfig *tls.Config) *http2.Transport {
+	return &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			if cfg.RootCAs == nil && !cfg.InsecureSkipVerify {
+				cfg = cfg.Clone()
+				cfg.RootCAs = upstreamRoots()
+			}
+
+			dialer := tls.Dialer{
+				NetDialer: &net.Dialer{
+					Timeout:   dialerTimeout,
+					KeepAlive: keepAlive,
+				},
+				Config: cfg,
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: tlsConfig,
+		ReadIdleTimeout: h2IdleTimeout,
+	}
+}
+
+// upstreamRoots are the CAs apps' certs are checked against: the system's
+// and the puma-dev CA.
+func upstreamRoots() *x509.CertPool {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	if CACert != nil {
+		if ca, err := x509.ParseCertificate(CACert.Certificate[0]); err == nil {
+			roots.AddCert(ca)
+		}
+	}
+
+	return roots
+}
+
+// plainHandler serves h on the http port, accepting h2c as well so gRPC
+// clients that don't use TLS can reach grpc proxies.
+func (h *HTTPServer) plainHandler() http.Handler {
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// configureHTTP2 has serv negotiate HTTP/2 with browsers over TLS, falling
+// back to HTTP/1.1 for clients that don't offer it.
+func configureHTTP2(serv *http.Server) error {
+	return http2.ConfigureServer(serv, &http2.Server{})
+}
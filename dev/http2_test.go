@@ -0,0 +1,236 @@
+package dev
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newH2CBackend is a stand-in for an app that only speaks h2c, such as a
+// gRPC server. Requests that aren't HTTP/2 are refused.
+func newH2CBackend(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			http.Error(w, "h2c only", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		handler(w, req)
+	}), &http2.Server{}))
+
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func TestHttp_h2cProxy(t *testing.T) {
+	backend := newH2CBackend(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s %s", req.Proto, req.Header.Get("X-Forwarded-Proto"))
+	})
+
+	h := newTestHTTPServer(t)
+
+	target := strings.Replace(backend.URL, "http://", SchemeH2C+"://", 1)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "grpc"), []byte(target+"\n"), 0644))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://grpc.test/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "HTTP/2.0 http", w.Body.String())
+
+	app, err := h.Pool.lookupApp("grpc")
+	require.NoError(t, err)
+	assert.Equal(t, SchemeH2C, app.Scheme)
+}
+
+func TestHttp_h2Proxy_pumaDevCA(t *testing.T) {
+	withTestCA(t)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s %s", req.Proto, req.TLS.ServerName)
+	}))
+	backend.EnableHTTP2 = true
+
+	cert, err := makeCert(CACert, "localhost")
+	require.NoError(t, err)
+
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+
+	h := newTestHTTPServer(t)
+
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	target := SchemeH2 + "://localhost:" + port
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "node"), []byte(target+"\n"), 0644))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://node.test/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "HTTP/2.0 localhost", w.Body.String())
+}
+
+func TestHttp_h2cProxy_streaming(t *testing.T) {
+	proceed := make(chan struct{})
+
+	backend := newH2CBackend(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+
+		fmt.Fprint(w, "first\n")
+		w.(http.Flusher).Flush()
+
+		<-proceed
+
+		fmt.Fprint(w, "second\n")
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	h := newTestHTTPServer(t)
+
+	target := strings.Replace(backend.URL, "http://", SchemeH2C+"://", 1)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "grpc"), []byte(target+"\n"), 0644))
+
+	front := httptest.NewServer(h)
+	defer front.Close()
+
+	req, err := http.NewRequest("GET", front.URL, nil)
+	require.NoError(t, err)
+	req.Host = "grpc.test"
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body := bufio.NewReader(res.Body)
+
+	// the first line arrives while the backend is still holding the stream
+	line, err := body.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", line)
+
+	close(proceed)
+
+	rest, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(rest))
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+}
+
+func TestHttp_h2cProxy_push(t *testing.T) {
+	pushErr := make(chan error, 1)
+
+	backend := newH2CBackend(t, func(w http.ResponseWriter, req *http.Request) {
+		pusher, ok := w.(http.Pusher)
+		if !ok {
+			pushErr <- fmt.Errorf("no pusher")
+			return
+		}
+
+		// the proxy disables push, so apps fall back to preload hints
+		pushErr <- pusher.Push("/app.css", nil)
+
+		w.Header().Set("Link", "</app.css>; rel=preload; as=style")
+		fmt.Fprint(w, "page")
+	})
+
+	h := newTestHTTPServer(t)
+
+	target := strings.Replace(backend.URL, "http://", SchemeH2C+"://", 1)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "grpc"), []byte(target+"\n"), 0644))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://grpc.test/", nil))
+
+	assert.Equal(t, http.ErrNotSupported, <-pushErr)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "page", w.Body.String())
+	assert.Equal(t, "</app.css>; rel=preload; as=style", w.Header().Get("Link"))
+}
+
+// serveTLSForTest serves h over TLS the way ServeTLS does, returning its
+// address and a pool trusting the CA.
+func serveTLSForTest(t *testing.T, h *HTTPServer) (string, *x509.CertPool) {
+	tlsConfig := h.tlsConfig()
+
+	serv := &http.Server{Handler: h, TLSConfig: tlsConfig}
+	require.NoError(t, configureHTTP2(serv))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go serv.Serve(h.listenTLS(l, tlsConfig))
+	t.Cleanup(func() { serv.Close() })
+
+	roots := x509.NewCertPool()
+	ca, err := x509.ParseCertificate(CACert.Certificate[0])
+	require.NoError(t, err)
+	roots.AddCert(ca)
+
+	return l.Addr().String(), roots
+}
+
+func TestHttp_http2ToBrowsers(t *testing.T) {
+	withTestCA(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, req.Proto)
+	}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+
+	h := newTestHTTPServer(t)
+	h.AccessLog = &AccessLog{Format: AccessLogJSON, Out: &buf}
+
+	newProxyTestApp(t, h, "blog", backend)
+
+	addr, roots := serveTLSForTest(t, h)
+
+	for proto, h2 := range map[string]bool{"HTTP/2.0": true, "HTTP/1.1": false} {
+		buf.Reset()
+
+		client := &http.Client{Transport: &http.Transport{
+			ForceAttemptHTTP2: h2,
+			TLSClientConfig: &tls.Config{
+				RootCAs:    roots,
+				ServerName: "blog.test",
+			},
+		}}
+
+		req, err := http.NewRequest("GET", "https://"+addr, nil)
+		require.NoError(t, err)
+		req.Host = "blog.test"
+
+		res, err := client.Do(req)
+		require.NoError(t, err)
+
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		assert.Equal(t, proto, res.Proto)
+
+		// the app is still spoken to with HTTP/1.1
+		assert.Equal(t, "HTTP/1.1", string(body))
+
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		assert.Equal(t, proto, entry["proto"])
+	}
+}
@@ -1,7 +1,7 @@
 package dev
 
 import (
-	"crypto/tls"
+	"net"
 	"net/http"
 
 	"github.com/puma/puma-dev/dev/launch"
@@ -10,11 +10,7 @@ import (
 )
 
 func (h *HTTPServer) ServeTLS(launchdSocket string) error {
-	certCache := NewCertCache()
-
-	tlsConfig := &tls.Config{
-		GetCertificate: certCache.GetCertificate,
-	}
+	tlsConfig := h.tlsConfig()
 
 	serv := http.Server{
 		Addr:      h.TLSAddress,
@@ -22,23 +18,36 @@ func (h *HTTPServer) ServeTLS(launchdSocket string) error {
 		TLSConfig: tlsConfig,
 	}
 
-	if launchdSocket == "" {
-		return serv.ListenAndServeTLS("", "")
-	}
-
-	listeners, err := launch.SocketListeners(launchdSocket)
+	err := configureHTTP2(&serv)
 	if err != nil {
 		return err
 	}
 
+	var listeners []net.Listener
+
+	if launchdSocket == "" {
+		l, err := net.Listen("tcp", h.TLSAddress)
+		if err != nil {
+			return err
+		}
+
+		listeners = append(listeners, l)
+	} else {
+		listeners, err = launch.SocketListeners(launchdSocket)
+		if err != nil {
+			return err
+		}
+	}
+
 	var t tomb.Tomb
 
 	for i, l := range listeners {
-		tl := tls.NewListener(l, tlsConfig)
-		listeners[i] = tl
+		listeners[i] = h.listenTLS(l, tlsConfig)
 	}
 
 	for _, l := range listeners {
+		l := l
+
 		t.Go(func() error {
 			return serv.Serve(l)
 		})
@@ -51,7 +60,7 @@ func (h *HTTPServer) ServeTLS(launchdSocket string) error {
 func (h *HTTPServer) Serve(launchdSocket string) error {
 	serv := http.Server{
 		Addr:    h.Address,
-		Handler: h,
+		Handler: h.plainHandler(),
 	}
 
 	if launchdSocket == "" {
@@ -1,16 +1,18 @@
 package dev
 
 import (
-	"crypto/tls"
+	"net"
 	"net/http"
-)
 
-func (h *HTTPServer) ServeTLS() error {
-	certCache := NewCertCache()
+	"github.com/puma/puma-dev/dev/launch"
 
-	tlsConfig := &tls.Config{
-		GetCertificate: certCache.GetCertificate,
-	}
+	"gopkg.in/tomb.v2"
+)
+
+// ServeTLS serves https and the tcp proxies on h.TLSAddress, or on the
+// sockets systemd passed with the name systemdSocket if it's set.
+func (h *HTTPServer) ServeTLS(systemdSocket string) error {
+	tlsConfig := h.tlsConfig()
 
 	serv := http.Server{
 		Addr:      h.TLSAddress,
@@ -18,14 +20,66 @@ func (h *HTTPServer) ServeTLS() error {
 		TLSConfig: tlsConfig,
 	}
 
-	return serv.ListenAndServeTLS("", "")
+	err := configureHTTP2(&serv)
+	if err != nil {
+		return err
+	}
+
+	var listeners []net.Listener
+
+	if systemdSocket == "" {
+		l, err := net.Listen("tcp", h.TLSAddress)
+		if err != nil {
+			return err
+		}
+
+		listeners = append(listeners, l)
+	} else {
+		listeners, err = launch.SocketListeners(systemdSocket)
+		if err != nil {
+			return err
+		}
+	}
+
+	var t tomb.Tomb
+
+	for _, l := range listeners {
+		tl := h.listenTLS(l, tlsConfig)
+
+		t.Go(func() error {
+			return serv.Serve(tl)
+		})
+	}
+
+	return t.Wait()
 }
 
-func (h *HTTPServer) Serve() error {
+// Serve serves http on h.Address, or on the sockets systemd passed with the
+// name systemdSocket if it's set.
+func (h *HTTPServer) Serve(systemdSocket string) error {
 	serv := http.Server{
 		Addr:    h.Address,
-		Handler: h,
+		Handler: h.plainHandler(),
+	}
+
+	if systemdSocket == "" {
+		return serv.ListenAndServe()
+	}
+
+	listeners, err := launch.SocketListeners(systemdSocket)
+	if err != nil {
+		return err
+	}
+
+	var t tomb.Tomb
+
+	for _, l := range listeners {
+		l := l
+
+		t.Go(func() error {
+			return serv.Serve(l)
+		})
 	}
 
-	return serv.ListenAndServe()
+	return t.Wait()
 }
@@ -1,6 +1,8 @@
 package dev
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -8,6 +10,33 @@ import (
 
 var testHttp HTTPServer
 
+// newTestHTTPServer returns a server for the test domain, set up as for
+// serving, with a pool in a temp dir holding a directory for each of apps.
+// Its certs are kept in memory, and its apps are purged when the test ends.
+func newTestHTTPServer(t *testing.T, apps ...string) *HTTPServer {
+	dir := t.TempDir()
+
+	for _, name := range apps {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := &Events{}
+
+	h := &HTTPServer{
+		Pool:    &AppPool{Dir: dir, Events: events},
+		Events:  events,
+		Domains: []string{"test"},
+	}
+
+	h.Setup()
+	h.certCache.Dir = ""
+	t.Cleanup(h.Pool.Purge)
+
+	return h
+}
+
 func TestHttp_removeTLD_test(t *testing.T) {
 	str := testHttp.removeTLD("psychic-octo-guide.test")
 
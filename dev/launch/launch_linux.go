@@ -0,0 +1,130 @@
+package launch
+
+/* Sockets passed by systemd socket activation, see sd_listen_fds(3) */
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// the first file descriptor systemd passes
+const listenFdsStart = 3
+
+var (
+	activateOnce sync.Once
+	activated    map[string][]int
+	activateErr  error
+)
+
+// parseListenFds works out which file descriptors systemd passed, by name,
+// from the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES variables. Sockets
+// without a name are called "unknown", like systemd does.
+func parseListenFds(pid int, getenv func(string) string) (map[string][]int, error) {
+	fds := map[string][]int{}
+
+	if getenv("LISTEN_PID") == "" {
+		return fds, nil
+	}
+
+	listenPid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil {
+		return nil, fmt.Errorf("bad LISTEN_PID: %s", err)
+	}
+
+	// the sockets were meant for another process
+	if listenPid != pid {
+		return fds, nil
+	}
+
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("bad LISTEN_FDS '%s'", getenv("LISTEN_FDS"))
+	}
+
+	var names []string
+	if n := getenv("LISTEN_FDNAMES"); n != "" {
+		names = strings.Split(n, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		fds[name] = append(fds[name], listenFdsStart+i)
+	}
+
+	return fds, nil
+}
+
+// activate reads the sockets passed by systemd, once. The variables passing
+// them are removed so that apps, which get puma-dev's environment, don't
+// think the sockets are theirs.
+func activate() (map[string][]int, error) {
+	activateOnce.Do(func() {
+		activated, activateErr = parseListenFds(os.Getpid(), os.Getenv)
+
+		for _, fds := range activated {
+			for _, fd := range fds {
+				syscall.CloseOnExec(fd)
+			}
+		}
+
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+
+	return activated, activateErr
+}
+
+// SocketFiles returns the sockets systemd passed with the FileDescriptorName
+// name.
+func SocketFiles(name string) ([]*os.File, error) {
+	sockets, err := activate()
+	if err != nil {
+		return nil, err
+	}
+
+	fds, ok := sockets[name]
+	if !ok {
+		return nil, errors.New("no systemd socket named " + name)
+	}
+
+	files := make([]*os.File, 0)
+	for _, fd := range fds {
+		file := os.NewFile(uintptr(fd), name)
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+func SocketListeners(name string) ([]net.Listener, error) {
+	files, err := SocketFiles(name)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make([]net.Listener, 0)
+	for _, file := range files {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// FileListener dups the descriptor
+		file.Close()
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,63 @@
+package launch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(k string) string { return vars[k] }
+}
+
+func TestParseListenFds(t *testing.T) {
+	fds, err := parseListenFds(42, env(map[string]string{
+		"LISTEN_PID":     "42",
+		"LISTEN_FDS":     "3",
+		"LISTEN_FDNAMES": "http:https:http",
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int{"http": {3, 5}, "https": {4}}, fds)
+}
+
+func TestParseListenFds_unnamed(t *testing.T) {
+	fds, err := parseListenFds(42, env(map[string]string{
+		"LISTEN_PID": "42",
+		"LISTEN_FDS": "2",
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int{"unknown": {3, 4}}, fds)
+}
+
+func TestParseListenFds_otherProcess(t *testing.T) {
+	fds, err := parseListenFds(42, env(map[string]string{
+		"LISTEN_PID": "7",
+		"LISTEN_FDS": "2",
+	}))
+
+	assert.NoError(t, err)
+	assert.Empty(t, fds)
+}
+
+func TestParseListenFds_none(t *testing.T) {
+	fds, err := parseListenFds(42, env(nil))
+
+	assert.NoError(t, err)
+	assert.Empty(t, fds)
+}
+
+func TestParseListenFds_bad(t *testing.T) {
+	_, err := parseListenFds(42, env(map[string]string{"LISTEN_PID": "x"}))
+	assert.Error(t, err)
+
+	_, err = parseListenFds(42, env(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "-1"}))
+	assert.Error(t, err)
+}
+
+func TestSocketFiles_missing(t *testing.T) {
+	_, err := SocketFiles("no-such-socket")
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,162 @@
+package dev
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricsPath is where the metrics are served, on the puma-dev host and the
+// RPC service.
+const MetricsPath = "/metrics"
+
+// Metrics holds everything puma-dev measures about itself and its apps.
+var Metrics = prometheus.NewRegistry()
+
+// boot times range from an instant proxy to a big app taking minutes
+var bootBuckets = []float64{.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "puma_dev_requests_total",
+		Help: "Requests handled, by app and status code.",
+	}, []string{"app", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "puma_dev_request_duration_seconds",
+		Help: "Time taken to handle requests, including waiting for the app to boot.",
+	}, []string{"app"})
+
+	appLaunches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "puma_dev_app_launches_total",
+		Help: "App processes started.",
+	}, []string{"app"})
+
+	appBootDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "puma_dev_app_boot_duration_seconds",
+		Help:    "Time from starting an app process until it was ready.",
+		Buckets: bootBuckets,
+	}, []string{"app"})
+
+	appBootFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "puma_dev_app_boot_failures_total",
+		Help: "Apps that died or timed out before they were ready.",
+	}, []string{"app"})
+
+	appIdleKills = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "puma_dev_app_idle_kills_total",
+		Help: "Apps stopped for being idle.",
+	}, []string{"app"})
+
+	appsRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "puma_dev_apps_running",
+		Help: "Apps currently running.",
+	})
+
+	certCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "puma_dev_cert_cache_hits_total",
+		Help: "TLS certificates served from the cache.",
+	})
+
+	certCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "puma_dev_cert_cache_misses_total",
+		Help: "TLS certificates generated because they weren't cached.",
+	})
+
+	certCacheHitRatio = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "puma_dev_cert_cache_hit_ratio",
+		Help: "Share of TLS certificate lookups served from the cache.",
+	}, cacheHitRatio)
+
+	dnsQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "puma_dev_dns_queries_total",
+		Help: "DNS queries answered, by query type.",
+	}, []string{"type"})
+
+	dnsForwards = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "puma_dev_dns_forwards_total",
+		Help: "DNS queries outside puma-dev's domains, by whether they were answered from the cache, by an upstream, or failed.",
+	}, []string{"result"})
+)
+
+func init() {
+	Metrics.MustRegister(
+		requestsTotal, requestDuration,
+		appLaunches, appBootDuration, appBootFailures, appIdleKills, appsRunning,
+		certCacheHits, certCacheMisses, certCacheHitRatio,
+		dnsQueries, dnsForwards,
+	)
+}
+
+// metricValue returns the current value of a counter or gauge.
+func metricValue(m prometheus.Metric) float64 {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return 0
+	}
+
+	switch {
+	case pb.Counter != nil:
+		return pb.Counter.GetValue()
+	case pb.Gauge != nil:
+		return pb.Gauge.GetValue()
+	}
+
+	return 0
+}
+
+func cacheHitRatio() float64 {
+	hits := metricValue(certCacheHits)
+	total := hits + metricValue(certCacheMisses)
+
+	if total == 0 {
+		return 0
+	}
+
+	return hits / total
+}
+
+// recordRequest counts a finished request to an app
+func recordRequest(w *accessWriter) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	requestsTotal.WithLabelValues(w.app, strconv.Itoa(status)).Inc()
+	requestDuration.WithLabelValues(w.app).Observe(time.Since(w.start).Seconds())
+}
+
+func recordDNSQuery(qtype uint16) {
+	name, ok := dns.TypeToString[qtype]
+	if !ok {
+		name = strconv.Itoa(int(qtype))
+	}
+
+	dnsQueries.WithLabelValues(name).Inc()
+}
+
+// runningApps counts the apps in the pool, once each however many names
+// they go by.
+func (a *AppPool) runningApps() int {
+	seen := map[*App]struct{}{}
+
+	a.ForApps(func(app *App) {
+		seen[app] = struct{}{}
+	})
+
+	return len(seen)
+}
+
+var metricsHandler = promhttp.HandlerFor(Metrics, promhttp.HandlerOpts{})
+
+func (h *HTTPServer) metrics(w http.ResponseWriter, req *http.Request) {
+	appsRunning.Set(float64(h.Pool.runningApps()))
+
+	metricsHandler.ServeHTTP(w, req)
+}
@@ -0,0 +1,81 @@
+package dev
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func histogramCount(o prometheus.Observer) uint64 {
+	var pb dto.Metric
+	o.(prometheus.Metric).Write(&pb)
+
+	return pb.Histogram.GetSampleCount()
+}
+
+func TestHttp_metrics_requests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+
+	h := newTestHTTPServer(t)
+
+	newProxyTestApp(t, h, "blog", backend)
+
+	count := metricValue(requestsTotal.WithLabelValues("blog", "418"))
+	observed := histogramCount(requestDuration.WithLabelValues("blog"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://blog.test/", nil))
+
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, count+1, metricValue(requestsTotal.WithLabelValues("blog", "418")))
+	assert.Equal(t, observed+1, histogramCount(requestDuration.WithLabelValues("blog")))
+}
+
+func TestHttp_metrics_endpoint(t *testing.T) {
+	h := newTestHTTPServer(t)
+
+	newBootingTestApp(t, h, "blog")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://puma-dev/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE puma_dev_cert_cache_hits_total counter\n")
+	assert.Contains(t, body, "# TYPE puma_dev_apps_running gauge\n")
+	assert.Contains(t, body, "\npuma_dev_apps_running 1\n")
+	assert.Contains(t, body, "\npuma_dev_cert_cache_hit_ratio ")
+}
+
+func TestAppPool_maybeIdle_metrics(t *testing.T) {
+	pool := &AppPool{IdleTime: time.Minute, Events: &Events{}}
+	app := &App{Name: "idler", Events: pool.Events, pool: pool, lastUse: time.Now().Add(-2 * time.Minute)}
+
+	kills := metricValue(appIdleKills.WithLabelValues("idler"))
+
+	assert.True(t, pool.maybeIdle(app))
+	assert.Equal(t, kills+1, metricValue(appIdleKills.WithLabelValues("idler")))
+}
+
+func TestRecordDNSQuery(t *testing.T) {
+	a := metricValue(dnsQueries.WithLabelValues("A"))
+	unknown := metricValue(dnsQueries.WithLabelValues(fmt.Sprint(65000)))
+
+	recordDNSQuery(dns.TypeA)
+	recordDNSQuery(65000)
+
+	assert.Equal(t, a+1, metricValue(dnsQueries.WithLabelValues("A")))
+	assert.Equal(t, unknown+1, metricValue(dnsQueries.WithLabelValues("65000")))
+}
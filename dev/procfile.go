@@ -0,0 +1,140 @@
+package dev
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ProcfileName is the Procfile puma-dev reads a web command from when an app
+// has no command in its config.
+const ProcfileName = "Procfile.dev"
+
+// rackupName marks a Rack app, which is booted with puma even if it has a
+// Procfile, unless its config sets procfile = true.
+const rackupName = "config.ru"
+
+const (
+	BindUnix = "unix"
+	BindTCP  = "tcp"
+)
+
+// parseProcfile reads the "name: command" entries of a Procfile.
+func parseProcfile(r io.Reader) (map[string]string, error) {
+	entries := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return nil, fmt.Errorf("line %d: expected 'name: command'", lineNo)
+		}
+
+		name := strings.TrimSpace(line[:colon])
+		command := strings.TrimSpace(line[colon+1:])
+
+		if command == "" {
+			return nil, fmt.Errorf("line %d: no command given for '%s'", lineNo, name)
+		}
+
+		entries[name] = command
+	}
+
+	return entries, scanner.Err()
+}
+
+// hardcodedPortRe matches a port given to a command as a literal, like the
+// "-p 3000" in the Procfile.dev Rails generates
+var hardcodedPortRe = regexp.MustCompile(`(?:^|\s)(?:-p|--port)(?:=|\s+)(\d+)\b|(?:^|\s)PORT=(\d+)\b`)
+
+// appCommand returns the command an app should be booted with instead of
+// puma, or an empty string to boot puma. The Procfile of a Rack app is only
+// read when the app's config asks for it, as Rails apps often have one for
+// foreman rather than for puma-dev.
+func appCommand(dir string, config *AppConfig) (string, error) {
+	command := config.Command
+
+	if command == "" && usesProcfile(dir, config) {
+		path := filepath.Join(dir, ProcfileName)
+
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) && !config.Procfile {
+				return "", nil
+			}
+
+			return "", err
+		}
+
+		defer f.Close()
+
+		entries, err := parseProcfile(f)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %s", path, err)
+		}
+
+		command = entries["web"]
+		if command == "" {
+			return "", fmt.Errorf("%s has no web entry", path)
+		}
+	}
+
+	// it would never listen where puma-dev looks, leaving it to time out
+	if command != "" && commandBindsTCP(command, config) {
+		if m := hardcodedPortRe.FindStringSubmatch(command); m != nil {
+			return "", fmt.Errorf("'%s' listens on port %s%s, use $PORT instead so puma-dev can pick one", command, m[1], m[2])
+		}
+	}
+
+	return command, nil
+}
+
+// usesProcfile reports whether an app without a command is booted from its
+// Procfile rather than with puma.
+func usesProcfile(dir string, config *AppConfig) bool {
+	if config.Procfile {
+		return true
+	}
+
+	_, err := os.Stat(filepath.Join(dir, rackupName))
+	return os.IsNotExist(err)
+}
+
+// commandBindsTCP reports whether a custom command should be given a TCP
+// port to listen on rather than a unix socket. Commands that don't mention
+// $PUMA_DEV_SOCKET are assumed to only know how to bind a port.
+func commandBindsTCP(command string, config *AppConfig) bool {
+	switch config.Bind {
+	case BindTCP:
+		return true
+	case BindUnix:
+		return false
+	}
+
+	return !strings.Contains(command, "PUMA_DEV_SOCKET")
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
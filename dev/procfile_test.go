@@ -0,0 +1,183 @@
+package dev
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProcfile(t *testing.T) {
+	entries, err := parseProcfile(strings.NewReader(`
+# comment
+web: node server.js --port $PORT
+worker:bundle exec sidekiq
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"web":    "node server.js --port $PORT",
+		"worker": "bundle exec sidekiq",
+	}, entries)
+}
+
+func TestParseProcfile_invalid(t *testing.T) {
+	_, err := parseProcfile(strings.NewReader("web: ok\nnonsense\n"))
+	assert.EqualError(t, err, "line 2: expected 'name: command'")
+
+	_, err = parseProcfile(strings.NewReader("web:\n"))
+	assert.EqualError(t, err, "line 1: no command given for 'web'")
+}
+
+func TestAppCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	command, err := appCommand(dir, &AppConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", command)
+
+	ioutil.WriteFile(filepath.Join(dir, ProcfileName), []byte("web: ./server\n"), 0644)
+
+	command, err = appCommand(dir, &AppConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "./server", command)
+
+	command, err = appCommand(dir, &AppConfig{Procfile: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "./server", command)
+
+	command, err = appCommand(dir, &AppConfig{Procfile: true, Command: "./other"})
+	assert.NoError(t, err)
+	assert.Equal(t, "./other", command)
+
+	ioutil.WriteFile(filepath.Join(dir, ProcfileName), []byte("css: bin/rails tailwindcss:watch\n"), 0644)
+
+	_, err = appCommand(dir, &AppConfig{Procfile: true})
+	assert.EqualError(t, err, filepath.Join(dir, ProcfileName)+" has no web entry")
+}
+
+func TestAppCommand_rackApp(t *testing.T) {
+	dir := t.TempDir()
+
+	ioutil.WriteFile(filepath.Join(dir, rackupName), []byte("run Rails.application\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ProcfileName), []byte("web: bin/rails server -p 3000\n"), 0644)
+
+	// a Rails app's Procfile.dev is for foreman, so it's booted with puma
+	command, err := appCommand(dir, &AppConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", command)
+
+	_, err = appCommand(dir, &AppConfig{Procfile: true})
+	assert.Error(t, err)
+}
+
+func TestAppCommand_noProcfile(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := appCommand(dir, &AppConfig{Procfile: true})
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAppCommand_hardcodedPort(t *testing.T) {
+	dir := t.TempDir()
+
+	ioutil.WriteFile(filepath.Join(dir, ProcfileName), []byte("web: bin/rails server -p 3000\n"), 0644)
+
+	_, err := appCommand(dir, &AppConfig{})
+	assert.EqualError(t, err, "'bin/rails server -p 3000' listens on port 3000, use $PORT instead so puma-dev can pick one")
+
+	for _, command := range []string{"node server.js --port=8080", "PORT=5000 npm start", "rails s --port 3000"} {
+		_, err := appCommand(dir, &AppConfig{Command: command})
+		assert.Error(t, err, command)
+	}
+
+	for _, command := range []string{"bin/rails server -p $PORT", "npm run dev -- --port $PORT", "rails s -b unix:$PUMA_DEV_SOCKET -p 3000"} {
+		_, err := appCommand(dir, &AppConfig{Command: command})
+		assert.NoError(t, err, command)
+	}
+}
+
+func TestCommandBindsTCP(t *testing.T) {
+	assert.True(t, commandBindsTCP("node server.js", &AppConfig{}))
+	assert.False(t, commandBindsTCP("gunicorn -b unix:$PUMA_DEV_SOCKET", &AppConfig{}))
+	assert.False(t, commandBindsTCP("node server.js", &AppConfig{Bind: BindUnix}))
+	assert.True(t, commandBindsTCP("gunicorn -b unix:$PUMA_DEV_SOCKET", &AppConfig{Bind: BindTCP}))
+}
+
+// TestHelperWebProcess is not a real test, it is the web process booted by
+// TestAppPool_LaunchApp_procfile and TestApp_restart_replace.
+func TestHelperWebProcess(t *testing.T) {
+	if os.Getenv("GO_TEST_SUBPROCESS") != "1" {
+		return
+	}
+
+	http.ListenAndServe("127.0.0.1:"+os.Getenv("PORT"), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+
+		fmt.Fprint(w, "Hi Procfile!")
+	}))
+}
+
+func TestAppPool_LaunchApp_procfile(t *testing.T) {
+	dir := t.TempDir()
+
+	procfile := fmt.Sprintf("web: GO_TEST_SUBPROCESS=1 %s -test.run=TestHelperWebProcess\n", os.Args[0])
+	if err := ioutil.WriteFile(filepath.Join(dir, ProcfileName), []byte(procfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, ".puma-dev.toml"), []byte("procfile = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &AppPool{
+		Dir:       dir,
+		IdleTime:  time.Minute,
+		Events:    &Events{},
+		Readiness: Readiness{Timeout: 30 * time.Second},
+	}
+
+	app, err := pool.LaunchApp("procfile-app", dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer func() {
+		app.t.Kill(nil)
+		app.t.Wait()
+	}()
+
+	assert.Equal(t, "http", app.Scheme)
+	assert.NotZero(t, app.Port)
+
+	if !assert.NoError(t, app.WaitTilReady()) {
+		return
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("tcp", app.Address())
+			},
+		},
+	}
+
+	resp, err := client.Get("http://procfile-app.test/")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "Hi Procfile!", string(body))
+}
@@ -0,0 +1,445 @@
+package dev
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/puma/puma-dev/homedir"
+	"github.com/vektra/errors"
+)
+
+// ProxyConfig is a proxy file in the structured format, TOML or JSON, as
+// opposed to a single line with the target.
+type ProxyConfig struct {
+	// Target is where requests not matching a route go
+	Target string `toml:"target" json:"target"`
+
+	// Host replaces the Host header sent to the target
+	Host string `toml:"host" json:"host"`
+
+	Headers   ProxyHeaders    `toml:"headers" json:"headers"`
+	TLS       ProxyTLSConfig  `toml:"tls" json:"tls"`
+	BasicAuth *ProxyBasicAuth `toml:"basic_auth" json:"basic_auth"`
+	Routes    []ProxyRoute    `toml:"routes" json:"routes"`
+
+	// Path is the file the config was read from
+	Path string `toml:"-" json:"-"`
+}
+
+// ProxyHeaders changes the headers of requests sent to a target. Headers
+// are removed before any are set.
+type ProxyHeaders struct {
+	Set    map[string]string `toml:"set" json:"set"`
+	Remove []string          `toml:"remove" json:"remove"`
+}
+
+// ProxyTLSConfig is how https and h2 targets are verified.
+type ProxyTLSConfig struct {
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	CAFile             string `toml:"ca_file" json:"ca_file"`
+	ServerName         string `toml:"server_name" json:"server_name"`
+}
+
+// ProxyBasicAuth has puma-dev ask browsers for a username and password
+// before proxying their requests.
+type ProxyBasicAuth struct {
+	Username string `toml:"username" json:"username"`
+	Password string `toml:"password" json:"password"`
+	Realm    string `toml:"realm" json:"realm"`
+}
+
+// ProxyRoute sends requests for Path and the paths below it to Target.
+type ProxyRoute struct {
+	Path    string       `toml:"path" json:"path"`
+	Target  string       `toml:"target" json:"target"`
+	Host    string       `toml:"host" json:"host"`
+	Headers ProxyHeaders `toml:"headers" json:"headers"`
+}
+
+// ProxyConfigError is returned when a proxy file can't be used. Line is 0
+// when the problem can't be pinned to a line.
+type ProxyConfigError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (e *ProxyConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("invalid proxy config %s, line %d: %s", e.Path, e.Line, e.Err)
+	}
+
+	return fmt.Sprintf("invalid proxy config %s: %s", e.Path, e.Err)
+}
+
+// tomlProxyRe matches the first line of a proxy file in TOML, a key or a
+// table. The one line format never has a key before a "://".
+var tomlProxyRe = regexp.MustCompile(`^(\[|[A-Za-z_][A-Za-z0-9_-]*\s*=)`)
+
+// proxyFormat returns "json" or "toml" for a structured proxy file, "" for
+// one in the one line format.
+func proxyFormat(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "{"):
+			return "json"
+		case tomlProxyRe.MatchString(line):
+			return "toml"
+		default:
+			return ""
+		}
+	}
+
+	return ""
+}
+
+// ParseProxyConfig parses a structured proxy file.
+func ParseProxyConfig(path string, data []byte) (*ProxyConfig, error) {
+	cfg := &ProxyConfig{Path: path}
+
+	switch proxyFormat(data) {
+	case "toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			cerr := newAppConfigError(path, err, tomlErrorRe)
+			return nil, &ProxyConfigError{Path: path, Line: cerr.Line, Err: cerr.Err}
+		}
+
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, &ProxyConfigError{Path: path, Err: fmt.Errorf("unknown key '%s'", undecoded[0])}
+		}
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(cfg)
+		if err != nil {
+			cerr := &ProxyConfigError{Path: path, Err: err}
+
+			if serr, ok := err.(*json.SyntaxError); ok {
+				cerr.Line = bytes.Count(data[:serr.Offset], []byte("\n")) + 1
+			}
+
+			return nil, cerr
+		}
+	default:
+		return nil, &ProxyConfigError{Path: path, Err: errors.New("not a structured proxy file")}
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (c *ProxyConfig) validate() error {
+	fail := func(format string, args ...interface{}) error {
+		return &ProxyConfigError{Path: c.Path, Err: fmt.Errorf(format, args...)}
+	}
+
+	if c.Target == "" && len(c.Routes) == 0 {
+		return fail("a target or routes are needed")
+	}
+
+	targets := []string{c.Target}
+
+	for i, r := range c.Routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fail("route %d: path must start with /", i+1)
+		}
+
+		if r.Target == "" {
+			return fail("route %d: no target", i+1)
+		}
+
+		targets = append(targets, r.Target)
+	}
+
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+
+		t, err := parseProxyTarget(target)
+		if err != nil {
+			return fail("%s", err)
+		}
+
+		switch t.Scheme {
+		case "http", "https", SchemeH2C, SchemeH2, SchemeGRPC:
+		default:
+			return fail("target '%s' can't be used in a structured proxy file", target)
+		}
+	}
+
+	if c.BasicAuth != nil && c.BasicAuth.Username == "" {
+		return fail("basic_auth needs a username")
+	}
+
+	if _, err := c.TLS.config(); err != nil {
+		return fail("%s", err)
+	}
+
+	return nil
+}
+
+// proxyTarget is where a proxy sends requests.
+type proxyTarget struct {
+	Scheme string
+	Host   string
+	Port   int
+	Query  url.Values
+}
+
+// parseProxyTarget parses a port, which is on localhost, or a URL. A URL
+// without a scheme is http.
+func parseProxyTarget(s string) (*proxyTarget, error) {
+	if port, err := strconv.Atoi(s); err == nil {
+		return &proxyTarget{Scheme: "http", Host: "127.0.0.1", Port: port}, nil
+	}
+
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &proxyTarget{Scheme: u.Scheme, Host: u.Host, Query: u.Query()}
+
+	host, sport, err := net.SplitHostPort(u.Host)
+	if err == nil {
+		t.Host = host
+
+		t.Port, err = strconv.Atoi(sport)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *proxyTarget) Address() string {
+	if t.Port == 0 {
+		return t.Host
+	}
+
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+func (c *ProxyTLSConfig) config() (*tls.Config, error) {
+	if !c.InsecureSkipVerify && c.CAFile == "" && c.ServerName == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+	}
+
+	if c.CAFile != "" {
+		path, err := homedir.Expand(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Context(err, "reading ca_file")
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+
+	return config, nil
+}
+
+// proxyRoute is a target of a structured proxy file, with what's done to
+// requests sent to it.
+type proxyRoute struct {
+	prefix  string
+	target  *proxyTarget
+	host    string
+	headers ProxyHeaders
+
+	// proxy is set for https and h2 targets with their own TLS settings
+	proxy *httputil.ReverseProxy
+}
+
+// proxyRoutes is a structured proxy file ready to serve requests.
+type proxyRoutes struct {
+	// routes are ordered by decreasing prefix length, ending with the
+	// default target if there is one
+	routes []*proxyRoute
+	auth   *ProxyBasicAuth
+}
+
+// routes builds what's needed to serve the config's requests.
+func (c *ProxyConfig) routes() (*proxyRoutes, error) {
+	tlsConfig, err := c.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &proxyRoutes{auth: c.BasicAuth}
+
+	add := func(prefix, target, host string, headers ProxyHeaders) error {
+		t, err := parseProxyTarget(target)
+		if err != nil {
+			return err
+		}
+
+		if host == "" {
+			host = c.Host
+		}
+
+		route := &proxyRoute{
+			prefix:  strings.TrimSuffix(prefix, "/"),
+			target:  t,
+			host:    host,
+			headers: mergeProxyHeaders(c.Headers, headers),
+		}
+
+		if tlsConfig != nil {
+			switch t.Scheme {
+			case "https":
+				route.proxy = newReverseProxy(newTCPTransport(tlsConfig))
+			case SchemeH2:
+				route.proxy = newReverseProxy(newH2Transport(tlsConfig))
+			}
+		}
+
+		pr.routes = append(pr.routes, route)
+
+		return nil
+	}
+
+	for _, r := range c.Routes {
+		if err := add(r.Path, r.Target, r.Host, r.Headers); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(pr.routes, func(i, j int) bool {
+		return len(pr.routes[i].prefix) > len(pr.routes[j].prefix)
+	})
+
+	if c.Target != "" {
+		if err := add("", c.Target, "", ProxyHeaders{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return pr, nil
+}
+
+func mergeProxyHeaders(base, over ProxyHeaders) ProxyHeaders {
+	merged := ProxyHeaders{
+		Set:    map[string]string{},
+		Remove: append(append([]string{}, base.Remove...), over.Remove...),
+	}
+
+	for k, v := range base.Set {
+		merged.Set[k] = v
+	}
+
+	for k, v := range over.Set {
+		merged.Set[k] = v
+	}
+
+	return merged
+}
+
+// match returns the route for path, nil if there's none.
+func (pr *proxyRoutes) match(path string) *proxyRoute {
+	for _, r := range pr.routes {
+		if r.prefix == "" || path == r.prefix || strings.HasPrefix(path, r.prefix+"/") {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// defaultTarget is the target shown for the app, the one for / if there is
+// one.
+func (pr *proxyRoutes) defaultTarget() *proxyTarget {
+	if r := pr.match("/"); r != nil {
+		return r.target
+	}
+
+	return pr.routes[len(pr.routes)-1].target
+}
+
+func (pr *proxyRoutes) authorized(req *http.Request) bool {
+	if pr.auth == nil {
+		return true
+	}
+
+	user, pass, ok := req.BasicAuth()
+
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(pr.auth.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(pr.auth.Password)) == 1
+}
+
+// serveProxyRoutes sends req to the route of a structured proxy file it
+// matches.
+func (h *HTTPServer) serveProxyRoutes(w *accessWriter, req *http.Request, pr *proxyRoutes) {
+	if !pr.authorized(req) {
+		realm := pr.auth.Realm
+		if realm == "" {
+			realm = "puma-dev"
+		}
+
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+		http.Error(w, "authorization required", http.StatusUnauthorized)
+		return
+	}
+
+	route := pr.match(req.URL.Path)
+	if route == nil {
+		http.Error(w, "no route for "+req.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	if pr.auth != nil {
+		// the credentials are puma-dev's, not the app's
+		req.Header.Del("Authorization")
+	}
+
+	for _, name := range route.headers.Remove {
+		req.Header.Del(name)
+	}
+
+	for name, value := range route.headers.Set {
+		req.Header.Set(name, value)
+	}
+
+	if route.host != "" {
+		req.Host = route.host
+	}
+
+	h.forward(w, req, route.target.Scheme, route.target.Address(), route.proxy)
+}
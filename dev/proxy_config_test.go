@@ -0,0 +1,332 @@
+package dev
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyFormat(t *testing.T) {
+	for data, expected := range map[string]string{
+		"3000":                                 "",
+		"http://127.0.0.1:3000\n":              "",
+		"tcp://127.0.0.1:5432?tls=passthrough": "",
+		"10.3.1.2:9292":                        "",
+		"target = \"3000\"":                    "toml",
+		"# api\n\n[[routes]]\npath = \"/api\"": "toml",
+		"  {\"target\": \"3000\"}":             "json",
+	} {
+		assert.Equal(t, expected, proxyFormat([]byte(data)), data)
+	}
+}
+
+func TestParseProxyConfig_toml(t *testing.T) {
+	cfg, err := ParseProxyConfig("api", []byte(`
+target = "3000"
+host = "api.example.com"
+
+[headers]
+set = { X-Env = "dev" }
+remove = ["Cookie"]
+
+[tls]
+insecure_skip_verify = true
+
+[basic_auth]
+username = "dev"
+password = "secret"
+
+[[routes]]
+path = "/api"
+target = "http://127.0.0.1:4000"
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, &ProxyConfig{
+		Target:    "3000",
+		Host:      "api.example.com",
+		Headers:   ProxyHeaders{Set: map[string]string{"X-Env": "dev"}, Remove: []string{"Cookie"}},
+		TLS:       ProxyTLSConfig{InsecureSkipVerify: true},
+		BasicAuth: &ProxyBasicAuth{Username: "dev", Password: "secret"},
+		Routes:    []ProxyRoute{{Path: "/api", Target: "http://127.0.0.1:4000"}},
+		Path:      "api",
+	}, cfg)
+}
+
+func TestParseProxyConfig_json(t *testing.T) {
+	cfg, err := ParseProxyConfig("api", []byte(`{
+  "routes": [
+    {"path": "/api", "target": "4000", "headers": {"set": {"X-Api": "1"}}},
+    {"path": "/", "target": "3000"}
+  ]
+}`))
+	require.NoError(t, err)
+
+	assert.Len(t, cfg.Routes, 2)
+	assert.Equal(t, "1", cfg.Routes[0].Headers.Set["X-Api"])
+}
+
+func TestParseProxyConfig_errors(t *testing.T) {
+	for data, expected := range map[string]string{
+		"target = 3000\ntarget = 4000":                                "invalid proxy config api, line 2: Key 'target' has already been defined.",
+		"target = \"3000\"\ncolour = \"red\"":                         "invalid proxy config api: unknown key 'colour'",
+		"{\n\"target\": \"3000\",\n}":                                 "invalid proxy config api, line 3: invalid character '}' looking for beginning of object key string",
+		"{\"colour\": \"red\"}":                                       "invalid proxy config api: json: unknown field \"colour\"",
+		"host = \"api.test\"":                                         "invalid proxy config api: a target or routes are needed",
+		"[[routes]]\npath = \"api\"\ntarget = \"4000\"":               "invalid proxy config api: route 1: path must start with /",
+		"[[routes]]\npath = \"/api\"":                                 "invalid proxy config api: route 1: no target",
+		"target = \"tcp://127.0.0.1:5432\"":                           "invalid proxy config api: target 'tcp://127.0.0.1:5432' can't be used in a structured proxy file",
+		"target = \"3000\"\n[basic_auth]\npassword = \"x\"":           "invalid proxy config api: basic_auth needs a username",
+		"target = \"3000\"\n[tls]\nca_file = \"/nonexistent/ca.pem\"": "invalid proxy config api: reading ca_file: open /nonexistent/ca.pem: no such file or directory",
+	} {
+		_, err := ParseProxyConfig("api", []byte(data))
+		assert.EqualError(t, err, expected, data)
+	}
+}
+
+// newEchoHTTPBackend responds with its name, and the host and headers of the
+// request as JSON.
+func newEchoHTTPBackend(t *testing.T, name string) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":    name,
+			"host":    req.Host,
+			"path":    req.URL.Path,
+			"headers": req.Header,
+		})
+	}))
+
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+type echoed struct {
+	Name    string
+	Host    string
+	Path    string
+	Headers http.Header
+}
+
+func getEchoed(t *testing.T, h *HTTPServer, req *http.Request) (*httptest.ResponseRecorder, *echoed) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var e echoed
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &e), w.Body.String())
+	}
+
+	return w, &e
+}
+
+func TestHttp_proxyConfig_routes(t *testing.T) {
+	web := newEchoHTTPBackend(t, "web")
+	api := newEchoHTTPBackend(t, "api")
+	admin := newEchoHTTPBackend(t, "admin")
+
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte(fmt.Sprintf(`
+target = %q
+
+[[routes]]
+path = "/api"
+target = %q
+
+[[routes]]
+path = "/api/admin/"
+target = %q
+`, web.URL, api.URL, admin.URL)), 0644))
+
+	for path, expected := range map[string]string{
+		"/":               "web",
+		"/apiary":         "web",
+		"/api":            "api",
+		"/api/posts":      "api",
+		"/api/admin":      "admin",
+		"/api/admin/keys": "admin",
+	} {
+		w, e := getEchoed(t, h, httptest.NewRequest("GET", "http://api.test"+path, nil))
+
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, expected, e.Name, path)
+		assert.Equal(t, path, e.Path, path)
+	}
+
+	app, err := h.Pool.lookupApp("api")
+	require.NoError(t, err)
+	assert.Equal(t, "http://"+app.Address(), web.URL)
+}
+
+func TestHttp_proxyConfig_noRoute(t *testing.T) {
+	api := newEchoHTTPBackend(t, "api")
+
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte(fmt.Sprintf("[[routes]]\npath = \"/api\"\ntarget = %q\n", api.URL)), 0644))
+
+	w, _ := getEchoed(t, h, httptest.NewRequest("GET", "http://api.test/posts", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHttp_proxyConfig_headers(t *testing.T) {
+	web := newEchoHTTPBackend(t, "web")
+	api := newEchoHTTPBackend(t, "api")
+
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte(fmt.Sprintf(`
+target = %q
+host = "www.example.com"
+
+[headers]
+set = { X-Env = "dev", X-Team = "core" }
+remove = ["Cookie"]
+
+[[routes]]
+path = "/api"
+target = %q
+host = "api.example.com"
+headers = { set = { X-Team = "api" }, remove = ["X-Debug"] }
+`, web.URL, api.URL)), 0644))
+
+	req := httptest.NewRequest("GET", "http://api.test/", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Debug", "1")
+
+	_, e := getEchoed(t, h, req)
+	assert.Equal(t, "www.example.com", e.Host)
+	assert.Equal(t, "dev", e.Headers.Get("X-Env"))
+	assert.Equal(t, "core", e.Headers.Get("X-Team"))
+	assert.Equal(t, "", e.Headers.Get("Cookie"))
+	assert.Equal(t, "1", e.Headers.Get("X-Debug"))
+
+	req = httptest.NewRequest("GET", "http://api.test/api", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Debug", "1")
+
+	_, e = getEchoed(t, h, req)
+	assert.Equal(t, "api.example.com", e.Host)
+	assert.Equal(t, "dev", e.Headers.Get("X-Env"))
+	assert.Equal(t, "api", e.Headers.Get("X-Team"))
+	assert.Equal(t, "", e.Headers.Get("Cookie"))
+	assert.Equal(t, "", e.Headers.Get("X-Debug"))
+}
+
+func TestHttp_proxyConfig_basicAuth(t *testing.T) {
+	web := newEchoHTTPBackend(t, "web")
+
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte(fmt.Sprintf(`{
+  "target": %q,
+  "basic_auth": {"username": "dev", "password": "secret", "realm": "staging"}
+}`, web.URL)), 0644))
+
+	w, _ := getEchoed(t, h, httptest.NewRequest("GET", "http://api.test/", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="staging"`, w.Header().Get("WWW-Authenticate"))
+
+	req := httptest.NewRequest("GET", "http://api.test/", nil)
+	req.SetBasicAuth("dev", "wrong")
+
+	w, _ = getEchoed(t, h, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req = httptest.NewRequest("GET", "http://api.test/", nil)
+	req.SetBasicAuth("dev", "secret")
+
+	w, e := getEchoed(t, h, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", e.Headers.Get("Authorization"))
+}
+
+func TestHttp_proxyConfig_tls(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "secure")
+	}))
+	defer backend.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0644))
+
+	for tlsConfig, status := range map[string]int{
+		"":                                  http.StatusBadGateway,
+		"insecure_skip_verify = true":       http.StatusOK,
+		fmt.Sprintf("ca_file = %q", caFile): http.StatusOK,
+	} {
+		h := newTestHTTPServer(t)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte(fmt.Sprintf("target = %q\n[tls]\n%s\n", backend.URL, tlsConfig)), 0644))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://api.test/", nil))
+
+		assert.Equal(t, status, w.Code, tlsConfig)
+	}
+}
+
+func TestHttp_proxyConfig_errorEvent(t *testing.T) {
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte("target = \"3000\"\n[[routes]]\npath = api\n"), 0644))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://api.test/", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid proxy config")
+
+	var events bytes.Buffer
+	h.Events.WriteTo(&events)
+	assert.Contains(t, events.String(), `"event":"proxy_config_error","app":"api"`)
+	assert.Contains(t, events.String(), `"line":3`)
+}
+
+func TestHttp_proxyConfig_errorCached(t *testing.T) {
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte("target = \"3000\"\n[[routes]]\npath = api\n"), 0644))
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://api.test/", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid proxy config")
+	}
+
+	var events bytes.Buffer
+	h.Events.WriteTo(&events)
+	assert.Equal(t, 1, strings.Count(events.String(), `"event":"proxy_config_error"`), "reported once")
+	assert.NotContains(t, events.String(), `"event":"error_starting_app"`)
+
+	// fixing the file takes effect right away
+	backend := newEchoHTTPBackend(t, "fixed")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte("target = \""+backend.URL+"\"\n"), 0644))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://api.test/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"name":"fixed"`)
+}
+
+func TestAppPool_readProxy_hostPort(t *testing.T) {
+	pool := &AppPool{Dir: t.TempDir(), Events: &Events{}}
+	defer pool.Purge()
+
+	path := filepath.Join(pool.Dir, "elsewhere")
+	require.NoError(t, ioutil.WriteFile(path, []byte("10.3.1.2:9292\n"), 0644))
+
+	app, err := pool.readProxy("elsewhere", path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "http", app.Scheme)
+	assert.Equal(t, "10.3.1.2:9292", app.Address())
+}
@@ -0,0 +1,300 @@
+package dev
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vektra/errors"
+)
+
+// Readiness strategies decide when a booting app can start taking requests.
+const (
+	// ReadySocket considers the app ready as soon as its socket accepts
+	// connections.
+	ReadySocket = "socket"
+
+	// ReadyHTTP considers the app ready once a GET of HealthPath returns 2xx.
+	ReadyHTTP = "http"
+
+	// ReadyLog considers the app ready once a line of its output matches
+	// LogPattern.
+	ReadyLog = "log"
+
+	// ReadyNotify considers the app ready once it sends READY=1 to the
+	// datagram socket passed to it in NOTIFY_SOCKET, as with sd_notify(3).
+	ReadyNotify = "notify"
+)
+
+const DefaultBootTimeout = 5 * time.Minute
+
+const readyPollInterval = 250 * time.Millisecond
+
+var ErrBootTimeout = errors.New("boot timeout")
+
+type Readiness struct {
+	Strategy   string
+	HealthPath string
+	LogPattern *regexp.Regexp
+	Timeout    time.Duration
+}
+
+type readyCheck interface {
+	// setup is called before the app process starts, so the check can hand
+	// anything it needs down to the child.
+	setup(a *App, cmd *exec.Cmd) error
+
+	// ready reports whether the app can take requests. It is polled until it
+	// returns true or the app dies.
+	ready(a *App) bool
+
+	cleanup()
+}
+
+func newReadyCheck(r Readiness) (readyCheck, error) {
+	switch r.Strategy {
+	case "", ReadySocket:
+		return &socketCheck{}, nil
+	case ReadyHTTP:
+		path := r.HealthPath
+		if path == "" {
+			path = "/"
+		}
+
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+
+		return &httpCheck{path: path}, nil
+	case ReadyLog:
+		if r.LogPattern == nil {
+			return nil, fmt.Errorf("readiness strategy '%s' requires a log pattern", r.Strategy)
+		}
+
+		return &logCheck{pattern: r.LogPattern}, nil
+	case ReadyNotify:
+		return &notifyCheck{}, nil
+	default:
+		return nil, fmt.Errorf("unknown readiness strategy '%s'", r.Strategy)
+	}
+}
+
+type socketCheck struct{}
+
+func (c *socketCheck) setup(a *App, cmd *exec.Cmd) error {
+	return nil
+}
+
+func (c *socketCheck) ready(a *App) bool {
+	conn, err := a.dial(context.Background())
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+func (c *socketCheck) cleanup() {}
+
+type httpCheck struct {
+	path   string
+	client *http.Client
+}
+
+func (c *httpCheck) setup(a *App, cmd *exec.Cmd) error {
+	c.client = &http.Client{
+		Timeout: dialerTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return a.dial(ctx)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	return nil
+}
+
+func (c *httpCheck) ready(a *App) bool {
+	req, err := http.NewRequest("GET", "http://localhost"+c.path, nil)
+	if err != nil {
+		return false
+	}
+
+	req.Header.Set("User-Agent", "puma-dev")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false
+	}
+
+	resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func (c *httpCheck) cleanup() {}
+
+type logCheck struct {
+	pattern *regexp.Regexp
+
+	once    sync.Once
+	matched chan struct{}
+}
+
+func (c *logCheck) setup(a *App, cmd *exec.Cmd) error {
+	c.matched = make(chan struct{})
+	return nil
+}
+
+// observe is fed every line the app writes, see App.watch
+func (c *logCheck) observe(line string) {
+	if c.pattern.MatchString(line) {
+		c.once.Do(func() { close(c.matched) })
+	}
+}
+
+func (c *logCheck) ready(a *App) bool {
+	select {
+	case <-c.matched:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *logCheck) cleanup() {}
+
+type notifyCheck struct {
+	path string
+	conn *net.UnixConn
+
+	once     sync.Once
+	notified chan struct{}
+}
+
+func (c *notifyCheck) setup(a *App, cmd *exec.Cmd) error {
+	c.notified = make(chan struct{})
+	c.path = runtimePath(a.dir, a.generation, "notify")
+
+	os.Remove(c.path)
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: c.path, Net: "unixgram"})
+	if err != nil {
+		return errors.Context(err, "opening notify socket")
+	}
+
+	c.conn = conn
+
+	cmd.Env = append(cmd.Env, "NOTIFY_SOCKET="+c.path)
+
+	go c.read()
+
+	return nil
+}
+
+func (c *notifyCheck) read() {
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for _, field := range strings.Split(string(buf[:n]), "\n") {
+			if strings.TrimSpace(field) == "READY=1" {
+				c.once.Do(func() { close(c.notified) })
+			}
+		}
+	}
+}
+
+func (c *notifyCheck) ready(a *App) bool {
+	select {
+	case <-c.notified:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *notifyCheck) cleanup() {
+	if c.conn != nil {
+		c.conn.Close()
+		os.Remove(c.path)
+	}
+}
+
+func (a *App) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout: dialerTimeout,
+	}
+
+	if a.Scheme == "httpu" {
+		return dialer.DialContext(ctx, "unix", a.Address())
+	}
+
+	return dialer.DialContext(ctx, "tcp", a.Address())
+}
+
+// waitForBoot polls the app's readiness check until it passes, the app dies
+// or the boot timeout is reached. A timed out boot kills the app.
+func (a *App) waitForBoot() error {
+	a.eventAdd("waiting_on_app", "strategy", a.readyStrategy())
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	var timeout <-chan time.Time
+
+	if a.readiness.Timeout > 0 {
+		timer := time.NewTimer(a.readiness.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-a.t.Dying():
+			a.eventAdd("dying_on_start")
+			fmt.Printf("! Detecting app '%s' dying on start\n", a.Name)
+			return fmt.Errorf("app died before booting")
+		case <-timeout:
+			a.eventAdd("boot_timeout", "timeout", a.readiness.Timeout.String())
+			fmt.Printf("! App '%s' did not boot within %s\n", a.Name, a.readiness.Timeout)
+			if !a.isReplacement() {
+				a.pool.bootFailed(a, ErrBootTimeout)
+			}
+			return ErrBootTimeout
+		case <-ticker.C:
+			if a.check.ready(a) {
+				a.eventAdd("app_ready")
+				fmt.Printf("! App '%s' booted\n", a.Name)
+				close(a.readyChan)
+				appBootDuration.WithLabelValues(a.Name).Observe(time.Since(a.launched).Seconds())
+				if !a.isReplacement() {
+					a.pool.bootSucceeded(a)
+					a.startSidecars()
+				}
+				return nil
+			}
+		}
+	}
+}
+
+func (a *App) readyStrategy() string {
+	if a.readiness.Strategy == "" {
+		return ReadySocket
+	}
+
+	return a.readiness.Strategy
+}
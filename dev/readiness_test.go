@@ -0,0 +1,185 @@
+package dev
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newReadinessTestApp(t *testing.T) *App {
+	dir, err := os.MkdirTemp("", "puma-dev-ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	events := &Events{}
+
+	app := &App{
+		Name:      "ready-test",
+		Events:    events,
+		dir:       dir,
+		pool:      &AppPool{Dir: dir, Events: events},
+		readyChan: make(chan struct{}),
+	}
+
+	app.SetAddress("httpu", filepath.Join(dir, "tmp", "app.sock"), 0)
+
+	return app
+}
+
+func TestNewReadyCheck_strategies(t *testing.T) {
+	check, err := newReadyCheck(Readiness{})
+	assert.NoError(t, err)
+	assert.IsType(t, &socketCheck{}, check)
+
+	check, err = newReadyCheck(Readiness{Strategy: ReadyHTTP, HealthPath: "up"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/up", check.(*httpCheck).path)
+
+	_, err = newReadyCheck(Readiness{Strategy: ReadyLog})
+	assert.Error(t, err)
+
+	_, err = newReadyCheck(Readiness{Strategy: "carrier-pigeon"})
+	assert.EqualError(t, err, "unknown readiness strategy 'carrier-pigeon'")
+}
+
+func TestReadiness_socketCheck(t *testing.T) {
+	app := newReadinessTestApp(t)
+	check := &socketCheck{}
+
+	assert.False(t, check.ready(app))
+
+	l, err := net.Listen("unix", app.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	assert.True(t, check.ready(app))
+}
+
+func TestReadiness_httpCheck(t *testing.T) {
+	app := newReadinessTestApp(t)
+	check := &httpCheck{path: "/up"}
+	assert.NoError(t, check.setup(app, exec.Command("true")))
+
+	l, err := net.Listen("unix", app.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var healthy int32
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/up" && atomic.LoadInt32(&healthy) == 1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	assert.False(t, check.ready(app))
+
+	atomic.StoreInt32(&healthy, 1)
+	assert.True(t, check.ready(app))
+}
+
+func TestReadiness_logCheck(t *testing.T) {
+	app := newReadinessTestApp(t)
+	check := &logCheck{pattern: regexp.MustCompile(`Use Ctrl-C to stop`)}
+	assert.NoError(t, check.setup(app, exec.Command("true")))
+
+	check.observe("* Listening on unix:///tmp/app.sock\n")
+	assert.False(t, check.ready(app))
+
+	check.observe("Use Ctrl-C to stop\n")
+	assert.True(t, check.ready(app))
+
+	// further matches must not panic on the already closed channel
+	check.observe("Use Ctrl-C to stop\n")
+	assert.True(t, check.ready(app))
+}
+
+func TestReadiness_notifyCheck(t *testing.T) {
+	app := newReadinessTestApp(t)
+	cmd := exec.Command("true")
+	check := &notifyCheck{}
+	assert.NoError(t, check.setup(app, cmd))
+	defer check.cleanup()
+
+	var socket string
+	for _, env := range cmd.Env {
+		if strings.HasPrefix(env, "NOTIFY_SOCKET=") {
+			socket = strings.TrimPrefix(env, "NOTIFY_SOCKET=")
+		}
+	}
+	assert.Equal(t, check.path, socket)
+
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("STATUS=booting"))
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, check.ready(app))
+
+	conn.Write([]byte("STATUS=running\nREADY=1\n"))
+	assert.Eventually(t, func() bool { return check.ready(app) }, time.Second, 10*time.Millisecond)
+}
+
+func TestApp_waitForBoot_timeout(t *testing.T) {
+	app := newReadinessTestApp(t)
+	app.readiness = Readiness{Strategy: ReadySocket, Timeout: 300 * time.Millisecond}
+	app.check = &socketCheck{}
+
+	app.t.Go(app.waitForBoot)
+
+	assert.Equal(t, ErrBootTimeout, app.WaitTilReady())
+
+	var buf bytes.Buffer
+	app.Events.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `"event":"boot_timeout"`)
+}
+
+func TestApp_waitForBoot_ready(t *testing.T) {
+	app := newReadinessTestApp(t)
+	app.readiness = Readiness{Strategy: ReadySocket, Timeout: time.Minute}
+	app.check = &socketCheck{}
+
+	l, err := net.Listen("unix", app.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// stands in for App.watch, which keeps the tomb alive in a real app
+	app.t.Go(func() error {
+		<-app.t.Dying()
+		return nil
+	})
+	app.t.Go(app.waitForBoot)
+
+	assert.NoError(t, app.WaitTilReady())
+	assert.Equal(t, Running, app.Status())
+
+	app.t.Kill(nil)
+	app.t.Wait()
+}
@@ -0,0 +1,192 @@
+package dev
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/puma/puma-dev/watch"
+)
+
+const (
+	// RestartKill stops the app, it's booted again by the next request
+	RestartKill = "kill"
+
+	// RestartReplace boots a new process next to the running one, switches
+	// requests over to it once it's ready and then stops the old one
+	RestartReplace = "replace"
+
+	// RestartSignal asks puma to restart itself: a phased restart (USR1)
+	// when running workers, a hot restart (USR2) otherwise
+	RestartSignal = "signal"
+)
+
+// DefaultRestartIgnore are the paths restart triggers never match, on top of
+// an app's restart_ignore globs. They match at any depth, so e.g. an
+// engine's node_modules is ignored too.
+var DefaultRestartIgnore = []string{"**/.git", "**/node_modules", "**/log", "**/tmp"}
+
+// how long a replaced process gets to finish the requests it's serving
+const drainTimeout = 30 * time.Second
+
+const drainPollInterval = 100 * time.Millisecond
+
+func (a *App) restartMode() string {
+	if a.config == nil || a.config.RestartMode == "" {
+		return RestartKill
+	}
+
+	return a.config.RestartMode
+}
+
+// restart restarts the app the way its config asks for.
+func (a *App) restart(reason string) {
+	switch a.restartMode() {
+	case RestartReplace:
+		if atomic.CompareAndSwapInt32(&a.restarting, 0, 1) {
+			go a.replace(reason)
+		}
+	case RestartSignal:
+		a.signalRestart(reason)
+	default:
+		a.Kill(reason)
+	}
+}
+
+// triggerMonitor restarts the app when one of the files matching its
+// restart_triggers globs changes.
+func (a *App) triggerMonitor() error {
+	opts := watch.TreeOptions{
+		Include: a.config.RestartTriggers,
+		Exclude: append(append([]string{}, DefaultRestartIgnore...), a.config.RestartIgnore...),
+	}
+
+	err := watch.WatchTree(a.dir, opts, a.t.Dying(), func(changed []string) {
+		a.eventAdd("restart_triggered", "file", changed[0], "files", len(changed))
+		a.restart(changed[0] + " changed")
+	})
+
+	// not being able to watch shouldn't take the app down
+	if err != nil {
+		a.eventAdd("watch_error", "error", err.Error())
+		fmt.Printf("! Unable to watch '%s' for restart triggers: %s\n", a.Name, err)
+	}
+
+	return nil
+}
+
+func (a *App) signalRestart(reason string) {
+	sig := syscall.SIGUSR2
+	if a.config.Workers > 0 {
+		sig = syscall.SIGUSR1
+	}
+
+	a.eventAdd("signal_restart", "signal", sig.String(), "reason", reason)
+	fmt.Printf("! Restarting '%s' (%d) with %s - '%s'\n", a.Name, a.Command.Process.Pid, sig, reason)
+
+	err := a.Command.Process.Signal(sig)
+	if err != nil {
+		a.eventAdd("restart_failed", "error", err.Error())
+		fmt.Printf("! Error trying to restart %s: %s\n", a.Name, err)
+	}
+}
+
+// replace boots a new process for the app while this one keeps serving, then
+// swaps it in and stops this one once its in-flight requests are done. If
+// the new process doesn't boot, this one is left running.
+func (a *App) replace(reason string) {
+	a.eventAdd("replacing_app", "reason", reason)
+	fmt.Printf("! Replacing '%s' (%d) - '%s'\n", a.Name, a.Command.Process.Pid, reason)
+
+	next, err := a.pool.launchApp(a.Name, a.dir, a.generation+1)
+	if err == nil {
+		err = next.WaitTilReady()
+		if err != nil {
+			next.t.Kill(nil)
+		}
+	}
+
+	if err != nil {
+		a.eventAdd("restart_failed", "error", err.Error())
+		fmt.Printf("! Replacement for '%s' failed to boot, keeping the running one: %s\n", a.Name, err)
+
+		// allow another restart.txt touch to try again
+		atomic.StoreInt32(&a.restarting, 0)
+		return
+	}
+
+	if !a.pool.replace(a, next) {
+		next.eventAdd("replacement_unused")
+		next.t.Kill(nil)
+		return
+	}
+
+	a.eventAdd("app_replaced", "pid", a.Command.Process.Pid, "new_pid", next.Command.Process.Pid)
+
+	// job runners and asset watchers mustn't run twice, so this process's
+	// sidecars are stopped before the new one's start, not once it's drained
+	a.stopSidecars()
+	next.startSidecars()
+
+	a.drain()
+	a.Kill("replaced by new process")
+}
+
+// isReplacement reports whether the app was launched by replace to take the
+// place of a running process. Its sidecars are started once it has, and it
+// failing to boot leaves that process serving, so it isn't a crash loop.
+func (a *App) isReplacement() bool {
+	return a.generation > 0
+}
+
+// drain waits for the requests the app is serving to finish.
+func (a *App) drain() {
+	deadline := time.Now().Add(drainTimeout)
+
+	for atomic.LoadInt32(&a.inflight) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-a.t.Dying():
+			return
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+func (a *App) beginRequest() {
+	atomic.AddInt32(&a.inflight, 1)
+}
+
+func (a *App) endRequest() {
+	atomic.AddInt32(&a.inflight, -1)
+}
+
+// replace points everything that refers to old at next. If old is no longer
+// in the pool, next is only added if nothing else took its place.
+func (a *AppPool) replace(old, next *App) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.apps == nil {
+		a.apps = make(map[string]*App)
+	}
+
+	replaced := false
+
+	for name, candidate := range a.apps {
+		if candidate == old {
+			a.apps[name] = next
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		if _, ok := a.apps[next.Name]; ok {
+			return false
+		}
+
+		a.apps[next.Name] = next
+	}
+
+	return true
+}
@@ -0,0 +1,255 @@
+package dev
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppPool_replace(t *testing.T) {
+	pool := &AppPool{}
+	old := &App{Name: "blog-1a2b"}
+	next := &App{Name: "blog-1a2b"}
+
+	pool.apps = map[string]*App{"blog-1a2b": old, "blog": old}
+
+	assert.True(t, pool.replace(old, next))
+	assert.Equal(t, next, pool.apps["blog-1a2b"])
+	assert.Equal(t, next, pool.apps["blog"])
+
+	other := &App{Name: "blog-1a2b"}
+	assert.False(t, pool.replace(old, other))
+}
+
+func TestLoadAppConfig_badRestartMode(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.toml", "restart_mode = \"reboot\"\n")
+
+	_, err := LoadAppConfig(dir)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "restart_mode must be 'kill', 'replace' or 'signal'")
+}
+
+func TestLoadAppConfig_signalRestartCustomCommand(t *testing.T) {
+	for _, config := range []string{
+		"restart_mode = \"signal\"\ncommand = \"rackup -p $PORT\"\n",
+		"restart_mode = \"signal\"\nprocfile = true\n",
+	} {
+		dir := writeAppConfig(t, ".puma-dev.toml", config)
+
+		_, err := LoadAppConfig(dir)
+
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "restart_mode 'signal' only works with puma")
+		}
+	}
+}
+
+func TestAppPool_LaunchApp_signalRestartProcfile(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.toml", "restart_mode = \"signal\"\n")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, ProcfileName), []byte("web: node server.js\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &AppPool{Dir: filepath.Dir(dir), Events: &Events{}}
+
+	_, err := pool.LaunchApp("node-app", dir)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "restart_mode 'signal' only works with puma")
+	}
+}
+
+func TestRuntimePath(t *testing.T) {
+	assert.Equal(t, fmt.Sprintf("/app/tmp/puma-dev-%d.sock", os.Getpid()), runtimePath("/app", 0, "sock"))
+	assert.Equal(t, fmt.Sprintf("/app/tmp/puma-dev-%d-2.sock", os.Getpid()), runtimePath("/app", 2, "sock"))
+}
+
+// newHelperAppPool returns a pool with one app, whose web process is
+// TestHelperWebProcess and whose .puma-dev.toml is config.
+func newHelperAppPool(t *testing.T, name, config string) *AppPool {
+	dir := t.TempDir()
+	appDir := filepath.Join(dir, name)
+
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	procfile := fmt.Sprintf("web: GO_TEST_SUBPROCESS=1 %s -test.run=TestHelperWebProcess\n", os.Args[0])
+	if err := ioutil.WriteFile(filepath.Join(appDir, ProcfileName), []byte(procfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(appDir, ".puma-dev.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &AppPool{
+		Dir:       dir,
+		IdleTime:  time.Minute,
+		Events:    &Events{},
+		Readiness: Readiness{Timeout: 30 * time.Second},
+	}
+}
+
+func TestApp_restart_replace(t *testing.T) {
+	pool := newHelperAppPool(t, "replace-app", "restart_mode = \"replace\"\n[sidecars.worker]\ncommand = \"exec sleep 30\"\n")
+
+	h := &HTTPServer{Pool: pool, Events: pool.Events, Domains: []string{"test"}}
+	h.Setup()
+
+	old, err := pool.lookupApp("replace-app")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer pool.Purge()
+
+	if !assert.NoError(t, old.WaitTilReady()) {
+		return
+	}
+
+	slow := make(chan *httptest.ResponseRecorder)
+
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://replace-app.test/slow", nil))
+		slow <- w
+	}()
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&old.inflight) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	old.restart("test")
+
+	var next *App
+
+	assert.Eventually(t, func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+
+		next = pool.apps["replace-app"]
+		return next != old
+	}, 30*time.Second, 50*time.Millisecond)
+
+	// the old sidecars stop before the new ones start, even though the old
+	// process is still serving
+	waitFor(t, "new sidecar", func() bool {
+		return next.sidecars[0].Status() == SidecarRunning
+	})
+	assert.Equal(t, SidecarStopped, old.sidecars[0].Status())
+
+	// the old process finishes the request it was serving
+	w := <-slow
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hi Procfile!", w.Body.String())
+
+	old.t.Wait()
+
+	assert.Equal(t, 1, next.generation)
+	assert.NotEqual(t, old.Port, next.Port)
+	assert.Equal(t, Running, next.Status())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://replace-app.test/", nil))
+	assert.Equal(t, "Hi Procfile!", w.Body.String())
+}
+
+func TestApp_restart_replaceFails(t *testing.T) {
+	pool := newHelperAppPool(t, "replace-app", "restart_mode = \"replace\"\n")
+
+	old, err := pool.lookupApp("replace-app")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer pool.Purge()
+
+	if !assert.NoError(t, old.WaitTilReady()) {
+		return
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(old.dir, ProcfileName), []byte("web: echo broken; exit 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old.restart("test")
+
+	waitFor(t, "failed replacement", func() bool {
+		return atomic.LoadInt32(&old.restarting) == 0
+	})
+
+	// the running process is left serving, not treated as crash looping
+	assert.Nil(t, pool.CrashLoop("replace-app"))
+	assert.Equal(t, Running, old.Status())
+
+	app, err := pool.lookupApp("replace-app")
+	assert.NoError(t, err)
+	assert.Equal(t, old, app)
+
+	var buf bytes.Buffer
+	pool.Events.WriteTo(&buf)
+
+	assert.Contains(t, buf.String(), `"event":"restart_failed"`)
+}
+
+func TestLoadAppConfig_restartTriggers(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.yml", "restart_triggers: [Gemfile.lock, \"config/**/*.rb\"]\nrestart_ignore: [vendor]\n")
+
+	cfg, err := LoadAppConfig(dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"Gemfile.lock", "config/**/*.rb"}, cfg.RestartTriggers)
+		assert.Equal(t, []string{"vendor"}, cfg.RestartIgnore)
+	}
+
+	dir = writeAppConfig(t, ".puma-dev.toml", "restart_triggers = [\"config/[a-\"]\n")
+
+	_, err = LoadAppConfig(dir)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bad glob 'config/[a-'")
+}
+
+func TestApp_triggerMonitor(t *testing.T) {
+	pool := newHelperAppPool(t, "trigger-app", "restart_triggers = [\"Gemfile.lock\"]\n")
+
+	app, err := pool.lookupApp("trigger-app")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer pool.Purge()
+
+	if !assert.NoError(t, app.WaitTilReady()) {
+		return
+	}
+
+	// let the watcher set up
+	time.Sleep(500 * time.Millisecond)
+
+	if err := ioutil.WriteFile(filepath.Join(app.dir, "Gemfile.lock"), []byte("GEM\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-app.t.Dead():
+	case <-time.After(10 * time.Second):
+		t.Fatal("app wasn't restarted")
+	}
+
+	var buf bytes.Buffer
+	pool.Events.WriteTo(&buf)
+
+	assert.Contains(t, buf.String(), `"event":"restart_triggered","app":"trigger-app","file":"Gemfile.lock"`)
+	assert.Contains(t, buf.String(), `"reason":"Gemfile.lock changed"`)
+}
@@ -0,0 +1,427 @@
+package dev
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RoutesFile is the name of the routing file in the pool's directory. Each
+// line maps a host to an app or a proxy target:
+//
+//	api.test          shop
+//	*.admin.test      admin
+//	~^pr-(\d+)\.test$ http://localhost:4${1}
+//
+// A host can be followed by a path, to mount the target on the paths below
+// it, and the target by "strip" to remove the path from requests:
+//
+//	shop.test/api     api     strip
+//
+// Hosts that match no rule are looked up by name, as usual.
+const RoutesFile = ".puma-dev.routes"
+
+// The kinds of routing rules, in the order they're tried
+const (
+	// RouteExact matches the host exactly
+	RouteExact = "exact"
+
+	// RouteWildcard matches hosts below a domain, e.g. *.admin.test. The
+	// one with the longest domain wins.
+	RouteWildcard = "wildcard"
+
+	// RouteRegexp matches hosts with a regexp, starting with ~. Its target
+	// can use the regexp's groups, e.g. ${1}. The first in the file wins.
+	RouteRegexp = "regexp"
+)
+
+var routeKinds = map[string]int{RouteExact: 0, RouteWildcard: 1, RouteRegexp: 2}
+
+// RouteStrip is the option that has a rule's path removed from requests
+const RouteStrip = "strip"
+
+// Route is a rule in the routing file
+type Route struct {
+	Kind    string
+	Pattern string
+	Target  string
+	Line    int
+
+	// Path is the prefix of the paths the rule applies to, without a
+	// trailing slash. It's "" for all of them.
+	Path string
+
+	// Strip has Path removed from requests, which get it in
+	// X-Forwarded-Prefix instead
+	Strip bool
+
+	re *regexp.Regexp
+}
+
+// Name identifies the rule, by its host pattern and path. The proxies of
+// rules go by it, rather than by the hosts they're used for, which a
+// regexp rule can match any number of.
+func (r *Route) Name() string {
+	return r.Pattern + r.Path
+}
+
+func (r *Route) String() string {
+	s := r.Pattern + r.Path + " " + r.Target
+	if r.Strip {
+		s += " " + RouteStrip
+	}
+
+	return s
+}
+
+// matchPath reports whether the rule applies to path. The empty path, for
+// connections that have none, only matches rules without one.
+func (r *Route) matchPath(path string) bool {
+	return r.Path == "" || path == r.Path || strings.HasPrefix(path, r.Path+"/")
+}
+
+// match returns the target for host, which is lower case without a port,
+// and whether r matches it at all.
+func (r *Route) match(host string) (string, bool) {
+	switch r.Kind {
+	case RouteExact:
+		return r.Target, host == r.Pattern
+	case RouteWildcard:
+		suffix := strings.TrimPrefix(r.Pattern, "*")
+		return r.Target, strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	default:
+		m := r.re.FindStringSubmatchIndex(host)
+		if m == nil {
+			return "", false
+		}
+
+		return string(r.re.ExpandString(nil, r.Target, host, m)), true
+	}
+}
+
+// isProxyTarget reports whether the target of a rule is a proxy target,
+// which has a scheme or a port, rather than the name of an app.
+func isProxyTarget(target string) bool {
+	if _, err := strconv.Atoi(target); err == nil {
+		return true
+	}
+
+	return strings.Contains(target, ":")
+}
+
+// RoutesError is returned when a routing file can't be used.
+type RoutesError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (e *RoutesError) Error() string {
+	return fmt.Sprintf("invalid routes %s, line %d: %s", e.Path, e.Line, e.Err)
+}
+
+// ParseRoutes parses the rules in a routing file, returning them in the
+// order they're tried: exact rules, wildcards by decreasing length, then
+// regexps in the order they're in the file. Rules with longer paths go
+// before others of their kind.
+func ParseRoutes(path string, data []byte) ([]*Route, error) {
+	var (
+		routes []*Route
+		seen   = map[string]int{}
+	)
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if hash := strings.Index(line, "#"); hash != -1 && (hash == 0 || line[hash-1] == ' ' || line[hash-1] == '\t') {
+			line = line[:hash]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		fail := func(format string, args ...interface{}) error {
+			return &RoutesError{Path: path, Line: i + 1, Err: fmt.Errorf(format, args...)}
+		}
+
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fail("expected a host and a target")
+		}
+
+		r := &Route{Pattern: fields[0], Target: fields[1], Line: i + 1}
+
+		if pattern, path, ok := strings.Cut(r.Pattern, "/"); ok {
+			r.Pattern = pattern
+			r.Path = strings.TrimSuffix("/"+path, "/")
+		}
+
+		if len(fields) == 3 {
+			if fields[2] != RouteStrip {
+				return nil, fail("unknown option '%s'", fields[2])
+			}
+
+			if r.Path == "" {
+				return nil, fail("only a rule with a path can strip it")
+			}
+
+			r.Strip = true
+		}
+
+		switch {
+		case strings.HasPrefix(r.Pattern, "~"):
+			re, err := regexp.Compile(r.Pattern[1:])
+			if err != nil {
+				return nil, fail("%s", err)
+			}
+
+			r.Kind = RouteRegexp
+			r.re = re
+		case r.Pattern == "*" || strings.HasPrefix(r.Pattern, "*."):
+			r.Kind = RouteWildcard
+		default:
+			r.Kind = RouteExact
+		}
+
+		if r.Kind != RouteRegexp {
+			r.Pattern = strings.ToLower(strings.TrimSuffix(r.Pattern, "."))
+
+			if strings.Contains(strings.TrimPrefix(r.Pattern, "*"), "*") {
+				return nil, fail("'*' can only be the first label of a host")
+			}
+
+			if line, ok := seen[r.Pattern+r.Path]; ok {
+				return nil, fail("'%s' is already routed on line %d", r.Pattern+r.Path, line)
+			}
+
+			seen[r.Pattern+r.Path] = r.Line
+		}
+
+		// a regexp's target is only known once its groups are filled in
+		if _, err := parseProxyTarget(r.Target); r.Kind != RouteRegexp && isProxyTarget(r.Target) && err != nil {
+			return nil, fail("invalid target '%s': %s", r.Target, err)
+		}
+
+		routes = append(routes, r)
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+
+		if a.Kind != b.Kind {
+			return routeKinds[a.Kind] < routeKinds[b.Kind]
+		}
+
+		if a.Kind == RouteWildcard && len(a.Pattern) != len(b.Pattern) {
+			return len(a.Pattern) > len(b.Pattern)
+		}
+
+		return len(a.Path) > len(b.Path)
+	})
+
+	return routes, nil
+}
+
+type routeTable struct {
+	modTime time.Time
+	size    int64
+	routes  []*Route
+}
+
+func (a *AppPool) routesPath() string {
+	return filepath.Join(a.Dir, RoutesFile)
+}
+
+// Routes returns the rules in the routing file. The file is stat'ed on
+// every call and read again when it changes. While it's broken, the rules
+// from before are kept.
+func (a *AppPool) Routes() []*Route {
+	path := a.routesPath()
+	stat, err := os.Stat(path)
+
+	a.routesLock.Lock()
+	defer a.routesLock.Unlock()
+
+	if err != nil {
+		a.routes = nil
+		return nil
+	}
+
+	rt := a.routes
+	if rt != nil && rt.modTime.Equal(stat.ModTime()) && rt.size == stat.Size() {
+		return rt.routes
+	}
+
+	next := &routeTable{modTime: stat.ModTime(), size: stat.Size()}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		next.routes, err = ParseRoutes(path, data)
+	}
+
+	if err != nil {
+		a.Events.Add("routes_error", "path", path, "error", err.Error())
+
+		if rt != nil {
+			next.routes = rt.routes
+		}
+	}
+
+	a.routes = next
+
+	return next.routes
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// MatchRoute returns the first rule in the routing file that matches host
+// and path, and the target it gives for it, or nil if none do.
+func (a *AppPool) MatchRoute(host, path string) (*Route, string) {
+	host = normalizeHost(host)
+
+	for _, r := range a.Routes() {
+		if !r.matchPath(path) {
+			continue
+		}
+
+		if target, ok := r.match(host); ok {
+			return r, target
+		}
+	}
+
+	return nil, ""
+}
+
+// HasRoute reports whether a rule in the routing file matches host, on any
+// path.
+func (a *AppPool) HasRoute(host string) bool {
+	host = normalizeHost(host)
+
+	for _, r := range a.Routes() {
+		if _, ok := r.match(host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routeApp returns the app for the target a rule gave, either a proxy to it
+// or the app it names. Proxies are kept in the pool by rule and target until
+// they're idle.
+func (a *AppPool) routeApp(route *Route, target string) (*App, error) {
+	if !isProxyTarget(target) {
+		return a.lookupApp(target)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.apps == nil {
+		a.apps = make(map[string]*App)
+	}
+
+	key := route.Name() + " " + target
+
+	if app, ok := a.apps[key]; ok {
+		return app, nil
+	}
+
+	app, err := a.newProxy(route.Name(), a.routesPath(), []byte(target))
+	if err != nil {
+		return nil, err
+	}
+
+	app.t.Go(app.proxyIdleMonitor)
+
+	a.apps[key] = app
+
+	return app, nil
+}
+
+// proxyIdleMonitor drops a proxy from the pool once it's idle, like
+// idleMonitor stops an idle app.
+func (a *App) proxyIdleMonitor() error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if a.pool.maybeIdle(a) {
+				a.t.Kill(nil)
+				return nil
+			}
+		case <-a.t.Dying():
+			return nil
+		}
+	}
+}
+
+// HostRoute is how a host is served, see ExplainHost
+type HostRoute struct {
+	Host string
+
+	// RequestPath is the path asked about, "/" if none was
+	RequestPath string
+
+	// Route is the rule that matched the host, nil if none did
+	Route *Route
+
+	// Name is what the app was looked up by, the target of Route or the
+	// host without its domain
+	Name string
+
+	// App is the app found, "" if there's none. For a rule with a proxy
+	// target, it's the target.
+	App string
+
+	// Path is the app's directory or proxy file in the pool's directory
+	Path string
+
+	// Default is set when the default app serves the host
+	Default bool
+}
+
+// ExplainHost returns how host would be served, without launching any app.
+// host can be followed by a path, e.g. shop.test/api/orders. domains is
+// sorted by decreasing complexity.
+func (a *AppPool) ExplainHost(host string, domains []string) *HostRoute {
+	hr := &HostRoute{Host: host, RequestPath: "/"}
+
+	if h, path, ok := strings.Cut(host, "/"); ok {
+		hr.Host, hr.RequestPath = h, "/"+path
+	}
+
+	host = hr.Host
+
+	hr.Route, hr.Name = a.MatchRoute(host, hr.RequestPath)
+
+	if hr.Route != nil {
+		if isProxyTarget(hr.Name) {
+			hr.App = hr.Name
+		} else if path, ok := a.appPath(hr.Name); ok {
+			hr.App, hr.Path = hr.Name, path
+		}
+
+		return hr
+	}
+
+	hr.Name = removeDomain(host, domains)
+
+	hr.App, hr.Path, hr.Default = a.resolveName(hr.Name)
+
+	return hr
+}
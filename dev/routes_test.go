@@ -0,0 +1,372 @@
+package dev
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes("routes", []byte(`
+# apps by pattern
+~^pr-(\d+)\.test$   http://127.0.0.1:4${1}
+*.test              blog
+*.Admin.Test.       admin   # the longer wildcard wins
+API.test            shop
+~.*                 default
+`))
+	require.NoError(t, err)
+
+	var order []string
+	for _, r := range routes {
+		order = append(order, r.Kind+" "+r.String())
+	}
+
+	assert.Equal(t, []string{
+		`exact api.test shop`,
+		`wildcard *.admin.test admin`,
+		`wildcard *.test blog`,
+		`regexp ~^pr-(\d+)\.test$ http://127.0.0.1:4${1}`,
+		`regexp ~.* default`,
+	}, order)
+
+	assert.Equal(t, 6, routes[0].Line)
+}
+
+func TestParseRoutes_errors(t *testing.T) {
+	cases := map[string]string{
+		"shop.test":                 "line 1: expected a host and a target",
+		"a.test x\nA.test y":        "line 2: 'a.test' is already routed on line 1",
+		"~(unclosed x":              "line 1: error parsing regexp",
+		"a.*.test x":                "line 1: '*' can only be the first label of a host",
+		"a.test http://[::1:80":     "line 1: invalid target",
+		"\n\n# fine\nb.test x y z ": "line 4: expected a host and a target",
+	}
+
+	for data, msg := range cases {
+		_, err := ParseRoutes("routes", []byte(data))
+		if assert.Error(t, err, data) {
+			assert.Contains(t, err.Error(), "invalid routes routes, "+msg, data)
+		}
+	}
+}
+
+func newRoutesTestPool(t *testing.T, data string) *AppPool {
+	pool := &AppPool{Dir: t.TempDir(), Events: &Events{}}
+
+	for _, name := range []string{"blog", "shop/admin"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(pool.Dir, name), 0755))
+	}
+
+	writeRoutes(t, pool, data)
+
+	return pool
+}
+
+func writeRoutes(t *testing.T, pool *AppPool, data string) {
+	// reuses the zone file helper, which makes sure the change is noticed
+	writeZoneFile(t, filepath.Join(pool.Dir, RoutesFile), data)
+}
+
+func TestAppPool_MatchRoute(t *testing.T) {
+	pool := newRoutesTestPool(t, `
+www.test            blog
+*.admin.test        shop-admin
+*.test              blog
+~^pr-(\d+)\.test$   http://127.0.0.1:4${1}
+`)
+
+	cases := []struct {
+		host, pattern, target string
+	}{
+		{"www.test", "www.test", "blog"},
+		{"WWW.test:8443", "www.test", "blog"},
+		{"www.test.", "www.test", "blog"},
+		{"a.b.admin.test", "*.admin.test", "shop-admin"},
+		{"admin.test", "*.test", "blog"},
+		// wildcards go before regexps
+		{"pr-12.test", "*.test", "blog"},
+		{"pr-12.dev.local", "", ""},
+	}
+
+	for _, c := range cases {
+		r, target := pool.MatchRoute(c.host, "/")
+		if c.pattern == "" {
+			assert.Nil(t, r, c.host)
+			continue
+		}
+
+		if assert.NotNil(t, r, c.host) {
+			assert.Equal(t, c.pattern, r.Pattern, c.host)
+			assert.Equal(t, c.target, target, c.host)
+		}
+	}
+
+	writeRoutes(t, pool, `~^pr-(\d+)\.test$   http://127.0.0.1:4${1}`)
+
+	r, target := pool.MatchRoute("pr-12.test", "/")
+	require.NotNil(t, r)
+	assert.Equal(t, "http://127.0.0.1:412", target)
+}
+
+func TestAppPool_Routes_reload(t *testing.T) {
+	pool := newRoutesTestPool(t, "www.test blog")
+
+	assert.True(t, pool.HasRoute("www.test"))
+
+	// a broken file keeps the rules from before
+	writeRoutes(t, pool, "www.test")
+
+	assert.True(t, pool.HasRoute("www.test"))
+
+	var events strings.Builder
+	pool.Events.WriteTo(&events)
+	assert.Contains(t, events.String(), `"event":"routes_error"`)
+
+	writeRoutes(t, pool, "other.test blog")
+
+	assert.False(t, pool.HasRoute("www.test"))
+	assert.True(t, pool.HasRoute("other.test"))
+
+	require.NoError(t, os.Remove(filepath.Join(pool.Dir, RoutesFile)))
+
+	assert.False(t, pool.HasRoute("other.test"))
+}
+
+func TestAppPool_ExplainHost(t *testing.T) {
+	pool := newRoutesTestPool(t, `
+www.test            blog
+gone.test           missing
+api.test            3000
+`)
+
+	domains := []string{"test"}
+
+	hr := pool.ExplainHost("www.test", domains)
+	require.NotNil(t, hr.Route)
+	assert.Equal(t, "blog", hr.App)
+	assert.Equal(t, filepath.Join(pool.Dir, "blog"), hr.Path)
+
+	hr = pool.ExplainHost("gone.test", domains)
+	assert.NotNil(t, hr.Route)
+	assert.Equal(t, "", hr.App)
+
+	hr = pool.ExplainHost("api.test", domains)
+	assert.Equal(t, "3000", hr.App)
+	assert.Equal(t, "", hr.Path)
+
+	// by name, as without a routing file
+	hr = pool.ExplainHost("tenant.shop-admin.test", domains)
+	assert.Nil(t, hr.Route)
+	assert.Equal(t, "tenant.shop-admin", hr.Name)
+	assert.Equal(t, "shop-admin", hr.App)
+	assert.Equal(t, filepath.Join(pool.Dir, "shop/admin"), hr.Path)
+
+	hr = pool.ExplainHost("nope.test", domains)
+	assert.Equal(t, "", hr.App)
+
+	require.NoError(t, os.Mkdir(filepath.Join(pool.Dir, "default"), 0755))
+
+	hr = pool.ExplainHost("nope.test", domains)
+	assert.Equal(t, "default", hr.App)
+	assert.True(t, hr.Default)
+}
+
+func TestHttp_routes(t *testing.T) {
+	web := newEchoHTTPBackend(t, "web")
+	pr := newEchoHTTPBackend(t, "pr")
+
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte(web.URL), 0644))
+	h.Pool.Events = &Events{}
+
+	_, port, _ := strings.Cut(strings.TrimPrefix(pr.URL, "http://"), ":")
+
+	writeRoutes(t, h.Pool, `
+www.test            api
+*.admin.test        api
+~^pr-(\d+)\.test$   127.0.0.1:${1}
+`)
+
+	for _, host := range []string{"www.test", "x.admin.test"} {
+		w, e := getEchoed(t, h, httptest.NewRequest("GET", "http://"+host+"/", nil))
+		assert.Equal(t, 200, w.Code, host)
+		assert.Equal(t, "web", e.Name, host)
+	}
+
+	requests := metricValue(requestsTotal.WithLabelValues(`~^pr-(\d+)\.test$`, "200"))
+
+	w, e := getEchoed(t, h, httptest.NewRequest("GET", "http://pr-"+port+".test/", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "pr", e.Name)
+
+	// counted for the rule, not the host it was expanded for
+	assert.Equal(t, requests+1, metricValue(requestsTotal.WithLabelValues(`~^pr-(\d+)\.test$`, "200")))
+
+	// a rule for an app that isn't there doesn't fall back to the name
+	writeRoutes(t, h.Pool, "api.test missing")
+
+	w, _ = getEchoed(t, h, httptest.NewRequest("GET", "http://api.test/", nil))
+	assert.Equal(t, 500, w.Code)
+
+	var events strings.Builder
+	h.Events.WriteTo(&events)
+	assert.Contains(t, events.String(), `"event":"unknown_app","name":"missing"`)
+}
+
+func TestAppPool_routeApp(t *testing.T) {
+	pool := newRoutesTestPool(t, `~^pr-(\d+)\.test$ 127.0.0.1:4${1}`)
+	pool.IdleTime = time.Minute
+	defer pool.Purge()
+
+	route, target := pool.MatchRoute("pr-12.test", "/")
+	require.NotNil(t, route)
+
+	app, err := pool.routeApp(route, target)
+	require.NoError(t, err)
+
+	// named after the rule rather than the host, for metrics
+	assert.Equal(t, `~^pr-(\d+)\.test$`, app.Name)
+	assert.Equal(t, "127.0.0.1:412", app.Address())
+
+	again, err := pool.routeApp(route, target)
+	require.NoError(t, err)
+	assert.Equal(t, app, again)
+
+	route, target = pool.MatchRoute("pr-13.test", "/")
+	other, err := pool.routeApp(route, target)
+	require.NoError(t, err)
+	assert.NotEqual(t, app, other)
+	assert.Equal(t, "127.0.0.1:413", other.Address())
+
+	assert.Len(t, pool.apps, 2)
+
+	// idle proxies are dropped, so hosts asked for once don't add up
+	app.lastUse = time.Now().Add(-2 * time.Minute)
+	assert.True(t, pool.maybeIdle(app))
+
+	assert.Len(t, pool.apps, 1)
+	assert.Equal(t, other, pool.apps[`~^pr-(\d+)\.test$ 127.0.0.1:413`])
+}
+
+func TestDNSResponder_routes(t *testing.T) {
+	d := newTestDNSResponder(t)
+
+	pool := &AppPool{Dir: d.ZoneDir, Events: &Events{}}
+	d.HasRoute = pool.HasRoute
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(pool.Dir, RoutesFile), []byte(`~^pr-\d+\.test$ 4000`), 0644))
+
+	assert.Len(t, queryDNS(d, "pr-1.test.", dns.TypeA).Answer, 1)
+	assert.Equal(t, dns.RcodeNameError, queryDNS(d, "pr-x.test.", dns.TypeA).Rcode)
+}
+
+func TestParseRoutes_paths(t *testing.T) {
+	routes, err := ParseRoutes("routes", []byte(`
+shop.test           web
+shop.test/api       api       strip
+shop.test/api/v2/   api-v2
+*.shop.test/api     api
+`))
+	require.NoError(t, err)
+
+	var order []string
+	for _, r := range routes {
+		order = append(order, r.String())
+	}
+
+	assert.Equal(t, []string{
+		"shop.test/api/v2 api-v2",
+		"shop.test/api api strip",
+		"shop.test web",
+		"*.shop.test/api api",
+	}, order)
+
+	cases := map[string]string{
+		"shop.test web strip":                 "line 1: only a rule with a path can strip it",
+		"shop.test/api api rewrite":           "line 1: unknown option 'rewrite'",
+		"shop.test/api a\nshop.test/api/ b":   "line 2: 'shop.test/api' is already routed on line 1",
+		"shop.test/api a\nshop.test/api b c ": "line 2: unknown option 'c'",
+	}
+
+	for data, msg := range cases {
+		_, err := ParseRoutes("routes", []byte(data))
+		if assert.Error(t, err, data) {
+			assert.Contains(t, err.Error(), msg, data)
+		}
+	}
+}
+
+func TestAppPool_MatchRoute_paths(t *testing.T) {
+	pool := newRoutesTestPool(t, `
+shop.test/api       api       strip
+shop.test           web
+`)
+
+	cases := map[string]string{
+		"/api":        "api",
+		"/api/":       "api",
+		"/api/orders": "api",
+		"/apis":       "web",
+		"/":           "web",
+	}
+
+	for path, target := range cases {
+		_, actual := pool.MatchRoute("shop.test", path)
+		assert.Equal(t, target, actual, path)
+	}
+
+	// connections without a path only get rules without one
+	_, target := pool.MatchRoute("shop.test", "")
+	assert.Equal(t, "web", target)
+
+	assert.True(t, pool.HasRoute("shop.test"))
+}
+
+func TestHttp_routes_paths(t *testing.T) {
+	web := newEchoHTTPBackend(t, "web")
+	api := newEchoHTTPBackend(t, "api")
+	admin := newEchoHTTPBackend(t, "admin")
+
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "api"), []byte(api.URL), 0644))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "store"), []byte(web.URL), 0644))
+
+	writeRoutes(t, h.Pool, fmt.Sprintf(`
+store.test/api       api       strip
+store.test/admin     %s
+`, admin.URL))
+
+	cases := []struct {
+		path, name, upstreamPath, prefix string
+	}{
+		{"/api/orders", "api", "/orders", "/api"},
+		{"/api", "api", "/", "/api"},
+		{"/admin/users", "admin", "/admin/users", ""},
+		// the rest of the host is served by name
+		{"/apis", "web", "/apis", ""},
+		{"/", "web", "/", ""},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://store.test"+c.path+"?page=2", nil)
+
+		w, e := getEchoed(t, h, req)
+		require.Equal(t, 200, w.Code, c.path)
+
+		assert.Equal(t, c.name, e.Name, c.path)
+		assert.Equal(t, c.upstreamPath, e.Path, c.path)
+		assert.Equal(t, c.prefix, e.Headers.Get("X-Forwarded-Prefix"), c.path)
+		assert.Equal(t, c.path, req.URL.Path, "the access log gets the path asked for")
+	}
+}
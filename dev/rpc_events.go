@@ -25,6 +25,9 @@ func (svc *RpcService) rpcEventsConnectWS(w http.ResponseWriter, r *http.Request
 }
 
 func (svc *RpcService) handleEvent(event string, tags ...string) {
+	if svc.wsChannel == nil {
+		return
+	}
 	var obj map[string]any
 	err := json.Unmarshal([]byte(event), &obj)
 	if err != nil {
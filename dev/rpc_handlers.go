@@ -1,7 +1,9 @@
 package dev
 
 import (
+	"crypto/subtle"
 	_ "fmt"
+	"github.com/gorilla/mux"
 	"github.com/vektra/errors"
 	"log"
 	"net/http"
@@ -16,6 +18,7 @@ type SimpleHandler func(*http.Request) (int, any, error)
 
 var NotImplementedErr = errors.New("Not Yet Implemented")
 var NotFoundErr = errors.New("Path does not exist")
+var ForbiddenErr = errors.New("Invalid or missing token")
 var removeSuffixRe = regexp.MustCompile(`-[a-f0-9]{4,}$`)
 
 func (svc *RpcService) ConfigureRoutes() {
@@ -36,10 +39,13 @@ func (svc *RpcService) ConfigureRoutes() {
 	mux.HandleFunc("/apps/{id}", svc.wrapHandler(svc.rpcGetApp)).Methods("GET")
 	mux.HandleFunc("/apps/{id}", svc.wrapHandler(svc.rpcUpdateApp)).Methods("PATCH")
 	mux.HandleFunc("/apps/{id}", svc.wrapHandler(svc.rpcKillApp)).Methods("DELETE")
+	mux.HandleFunc("/apps/{id}/restart", svc.wrapHandler(svc.rpcRestartApp)).Methods("POST")
 	mux.HandleFunc("/apps/{id}/console", svc.wrapHandler(svc.rpcStartAppConsole)).Methods("POST")
 	mux.HandleFunc("/apps/{id}/console", svc.wrapHandler(svc.rpcStopAppConsole)).Methods("DELETE")
 
+	mux.HandleFunc("/certs", svc.wrapHandler(svc.rpcCertsIndex)).Methods("GET")
 	mux.HandleFunc("/events", svc.rpcEventsConnectWS)
+	mux.HandleFunc(MetricsPath, svc.PumaDev.metrics).Methods("GET")
 	mux.PathPrefix("/").Handler(svc.PublicServer)
 
 }
@@ -69,6 +75,14 @@ type rpcUpdateAppPoolRequest struct {
 	IdleTimeout *string `json:"idleTimeout,omitIfEmpty"`
 }
 
+func (svc *RpcService) rpcCertsIndex(r *http.Request) (int, any, error) {
+	certs := []JsonObj{}
+	for _, c := range svc.PumaDev.certCache.Certificates() {
+		certs = append(certs, c.ToJson())
+	}
+	return http.StatusOK, certs, nil
+}
+
 func (svc *RpcService) rpcUpdateAppPool(r *http.Request) (int, any, error) {
 	pool := svc.Pool
 	reqBody := rpcUpdateAppPoolRequest{}
@@ -99,6 +113,10 @@ func (svc *RpcService) rpcPurgeAppPool(r *http.Request) (int, any, error) {
 func (svc *RpcService) rpcGetApp(r *http.Request) (int, any, error) {
 	app := svc.findAppByRequest(r)
 	if app == nil {
+		if cl := svc.findCrashLoopByRequest(r); cl != nil {
+			jsonApp := JsonObj{"id": cl.App, "name": cl.App, "crashLoop": cl.ToJson()}
+			return http.StatusServiceUnavailable, jsonApp, nil
+		}
 		return http.StatusNotFound, nil, NotFoundErr
 	}
 	jsonApp := app.ToJson(true)
@@ -114,6 +132,42 @@ func (svc *RpcService) rpcUpdateApp(r *http.Request) (int, any, error) {
 	return http.StatusNotImplemented, nil, NotImplementedErr
 }
 
+// rpcRestartApp stops an app, if it's running, and lifts any crash loop
+// backoff so the next request boots it again. It takes the token from
+// the error pages, as the token form field or X-Puma-Dev-Token header, so
+// that other sites open in the browser can't post to it.
+func (svc *RpcService) rpcRestartApp(r *http.Request) (int, any, error) {
+	token := r.Header.Get("X-Puma-Dev-Token")
+	if token == "" {
+		token = r.PostFormValue("token")
+	}
+
+	if svc.restartToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(svc.restartToken)) != 1 {
+		return http.StatusForbidden, nil, ForbiddenErr
+	}
+
+	found := false
+
+	if cl := svc.findCrashLoopByRequest(r); cl != nil {
+		svc.Pool.ResetCrashLoop(cl.App)
+		found = true
+	}
+
+	app := svc.findAppByKey(svc.PumaDev.removeTLD(mux.Vars(r)["id"]), false)
+	if app != nil {
+		found = true
+		if app.Command != nil {
+			app.eventAdd("restart_requested")
+			app.t.Kill(nil)
+		}
+	}
+
+	if !found {
+		return http.StatusNotFound, nil, NotFoundErr
+	}
+	return http.StatusAccepted, nil, nil
+}
+
 var spAppConsole *RpcConsoleProg
 
 func (svc *RpcService) rpcStartAppConsole(r *http.Request) (int, any, error) {
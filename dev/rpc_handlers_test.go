@@ -0,0 +1,68 @@
+package dev
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func postRestart(svc *RpcService, app string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "http://localhost/apps/"+app+"/restart", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	svc.mux.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestRpcRestartApp(t *testing.T) {
+	h := newTestHTTPServer(t, "blog")
+
+	crashLoop := &CrashLoopError{App: "blog", Failures: 3, LastFailure: time.Now(), NextAttempt: time.Now().Add(time.Minute)}
+	h.Pool.failures = map[string]*CrashLoopError{"blog": crashLoop}
+
+	svc := &RpcService{
+		Pool:         h.Pool,
+		PumaDev:      h,
+		mux:          mux.NewRouter(),
+		restartToken: "s3cret",
+	}
+	svc.ConfigureRoutes()
+
+	w := postRestart(svc, "blog", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NotNil(t, svc.Pool.CrashLoop("blog"), "restarted without the token")
+
+	w = postRestart(svc, "blog", url.Values{"token": {"guess"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NotNil(t, svc.Pool.CrashLoop("blog"), "restarted with the wrong token")
+
+	w = postRestart(svc, "nope", url.Values{"token": {"s3cret"}})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = postRestart(svc, "nope.test", url.Values{"token": {"s3cret"}})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = postRestart(svc, "blog", url.Values{"token": {"s3cret"}})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Nil(t, svc.Pool.CrashLoop("blog"))
+
+	// the token can be sent as a header too
+	h.Pool.failures = map[string]*CrashLoopError{"blog": crashLoop}
+
+	req := httptest.NewRequest("POST", "http://localhost/apps/blog/restart", nil)
+	req.Header.Set("X-Puma-Dev-Token", "s3cret")
+
+	w = httptest.NewRecorder()
+	svc.mux.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Nil(t, svc.Pool.CrashLoop("blog"))
+}
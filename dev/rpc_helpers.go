@@ -24,6 +24,32 @@ func (svc *RpcService) findAppByRequest(r *http.Request) *App {
 	return svc.findAppByKey(id, tryCreateIfMissing)
 }
 
+// findCrashLoopByRequest finds the boot failure record of an app that can't
+// be found because it is being kept from relaunching.
+func (svc *RpcService) findCrashLoopByRequest(r *http.Request) *CrashLoopError {
+	pool := svc.Pool
+	id := svc.PumaDev.removeTLD(mux.Vars(r)["id"])
+
+	if cl := pool.CrashLoop(id); cl != nil {
+		return cl
+	}
+
+	pool.lock.Lock()
+	var names []string
+	for name := range pool.failures {
+		names = append(names, name)
+	}
+	pool.lock.Unlock()
+
+	for _, name := range names {
+		if removeSuffixRe.ReplaceAllString(name, "") == id {
+			return pool.CrashLoop(name)
+		}
+	}
+
+	return nil
+}
+
 func (svc *RpcService) findAppByKey(id string, tryCreateIfMissing bool) *App {
 	pool := svc.Pool
 	apps := pool.apps
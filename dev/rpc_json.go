@@ -83,5 +83,56 @@ func (app *App) ToJson(fullData bool) JsonObj {
 		result["userTime"] = state.UserTime()
 		jsonApp["result"] = result
 	}
+
+	if app.pool != nil {
+		if cl := app.pool.CrashLoop(app.Name); cl != nil {
+			jsonApp["crashLoop"] = cl.ToJson()
+		}
+	}
+
+	if len(app.sidecars) > 0 {
+		sidecars := []JsonObj{}
+		for _, s := range app.sidecars {
+			sidecars = append(sidecars, s.ToJson())
+		}
+		jsonApp["sidecars"] = sidecars
+	}
 	return jsonApp
 }
+
+func (s *Sidecar) ToJson() JsonObj {
+	jsonSidecar := JsonObj{}
+	jsonSidecar["name"] = s.Name
+	jsonSidecar["command"] = s.Command
+	jsonSidecar["status"] = s.Status()
+	jsonSidecar["restarts"] = s.Restarts()
+	if pid := s.Pid(); pid > 0 {
+		jsonSidecar["pid"] = pid
+	}
+	if lastExit := s.LastExit(); truthy.ValueAny(lastExit) {
+		jsonSidecar["lastExit"] = lastExit
+	}
+	jsonSidecar["log"] = s.Log()
+	return jsonSidecar
+}
+
+func (cl *CrashLoopError) ToJson() JsonObj {
+	jsonCrashLoop := JsonObj{}
+	jsonCrashLoop["failures"] = cl.Failures
+	jsonCrashLoop["lastError"] = cl.LastError
+	jsonCrashLoop["lastFailure"] = cl.LastFailure
+	jsonCrashLoop["nextAttempt"] = cl.NextAttempt
+	jsonCrashLoop["log"] = cl.Log
+	return jsonCrashLoop
+}
+
+func (c *CertInfo) ToJson() JsonObj {
+	jsonCert := JsonObj{}
+	jsonCert["subject"] = c.Subject
+	jsonCert["dnsNames"] = c.DNSNames
+	jsonCert["serial"] = c.Serial
+	jsonCert["fingerprint"] = c.Fingerprint
+	jsonCert["notBefore"] = c.NotBefore
+	jsonCert["notAfter"] = c.NotAfter
+	return jsonCert
+}
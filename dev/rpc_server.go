@@ -1,6 +1,8 @@
 package dev
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
@@ -40,6 +42,10 @@ type RpcService struct {
 	listeners    []net.Listener
 	ctrlServer   *http.Server
 	initialized  bool
+
+	// restartToken has to be posted to restart an app, it's only known to
+	// the error pages puma-dev serves
+	restartToken string
 }
 
 func (svc *RpcService) init(h *HTTPServer) {
@@ -56,9 +62,19 @@ func (svc *RpcService) init(h *HTTPServer) {
 	svc.PublicDir = homedir.MustExpand(RpcPublicDir)
 	svc.PublicServer = http.FileServer(http.Dir(svc.PublicDir))
 	svc.TcpPort = RpcTcpPort
+	svc.restartToken = newRestartToken()
 	svc.initialized = true
 }
 
+func newRestartToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Error generating the RPC restart token: %s", err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
 func (svc *RpcService) listen() {
 	addListener := func(network string, addr string) {
 		listener, err := net.Listen(network, addr)
@@ -0,0 +1,450 @@
+package dev
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kardianos/osext"
+	"github.com/puma/puma-dev/homedir"
+	"github.com/vektra/errors"
+)
+
+const (
+	SystemdServiceName    = "puma-dev.service"
+	SystemdHTTPSocket     = "puma-dev-http.socket"
+	SystemdHTTPSSocket    = "puma-dev-https.socket"
+	SystemdUnitDirPath    = "~/.config/systemd/user"
+	SystemdHTTPFdName     = "http"
+	SystemdHTTPSFdName    = "https"
+	resolvedDropInPath    = "/etc/systemd/resolved.conf.d/puma-dev.conf"
+	nmConfDropInPath      = "/etc/NetworkManager/conf.d/puma-dev.conf"
+	nmDnsmasqDropInPath   = "/etc/NetworkManager/dnsmasq.d/puma-dev.conf"
+	sysctlDropInPath      = "/etc/sysctl.d/50-puma-dev.conf"
+	unprivilegedPortsPath = "/proc/sys/net/ipv4/ip_unprivileged_port_start"
+)
+
+// runCommand runs the system commands setup needs, such as systemctl. Tests
+// replace it so nothing on the real system is touched.
+var runCommand = func(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// rootPath returns path inside root, the directory standing in for / when
+// the generated files are tested.
+func rootPath(root, path string) string {
+	if root == "" {
+		return path
+	}
+
+	return filepath.Join(root, path)
+}
+
+// systemdQuote quotes an argument of an ExecStart line if it needs it.
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%;") {
+		return arg
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$", "%", "%%")
+	return `"` + r.Replace(arg) + `"`
+}
+
+type InstallIntoSystemArgs struct {
+	ListenPort         int
+	TlsPort            int
+	DNSPort            int
+	ApplinkDirPath     string
+	UnitDirPath        string
+	Domains            string
+	Timeout            string
+	NoServePublicPaths string
+
+	// BinPath is the puma-dev binary the service runs, the running one if
+	// empty
+	BinPath string
+
+	// Root is prefixed to every path written, for testing
+	Root string
+}
+
+func (config *InstallIntoSystemArgs) unitDir() string {
+	dir := config.UnitDirPath
+	if dir == "" {
+		dir = SystemdUnitDirPath
+	}
+
+	return rootPath(config.Root, homedir.MustExpand(dir))
+}
+
+// SystemdServiceArgs returns the command line the service unit runs
+// puma-dev with.
+func SystemdServiceArgs(config *InstallIntoSystemArgs) []string {
+	args := []string{
+		config.BinPath,
+		"-systemd",
+		"-dir", config.ApplinkDirPath,
+		"-d", config.Domains,
+		"-dns-port", fmt.Sprint(config.DNSPort),
+		"-timeout", config.Timeout,
+	}
+
+	if config.NoServePublicPaths != "" {
+		args = append(args, "-no-serve-public-paths", config.NoServePublicPaths)
+	}
+
+	return args
+}
+
+func systemdServiceUnit(config *InstallIntoSystemArgs) string {
+	args := SystemdServiceArgs(config)
+
+	for i, arg := range args {
+		args[i] = systemdQuote(arg)
+	}
+
+	return fmt.Sprintf(`[Unit]
+Description=puma-dev, a development server for rack apps
+Requires=%s %s
+After=%s %s
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`, SystemdHTTPSocket, SystemdHTTPSSocket, SystemdHTTPSocket, SystemdHTTPSSocket, strings.Join(args, " "))
+}
+
+// unprivilegedPortStart returns the lowest port users may listen on, if the
+// kernel says.
+func unprivilegedPortStart(root string) (int, bool) {
+	data, err := ioutil.ReadFile(rootPath(root, unprivilegedPortsPath))
+	if err != nil {
+		return 0, false
+	}
+
+	start, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+
+	return start, true
+}
+
+func systemdSocketUnit(description string, port int, fdName string) string {
+	return fmt.Sprintf(`[Unit]
+Description=%s
+
+[Socket]
+ListenStream=%d
+FileDescriptorName=%s
+Service=%s
+
+[Install]
+WantedBy=sockets.target
+`, description, port, fdName, SystemdServiceName)
+}
+
+// systemdUnits returns the contents of the units InstallIntoSystem writes,
+// by file name.
+func systemdUnits(config *InstallIntoSystemArgs) map[string]string {
+	return map[string]string{
+		SystemdServiceName: systemdServiceUnit(config),
+		SystemdHTTPSocket:  systemdSocketUnit("puma-dev http socket", config.ListenPort, SystemdHTTPFdName),
+		SystemdHTTPSSocket: systemdSocketUnit("puma-dev https socket", config.TlsPort, SystemdHTTPSFdName),
+	}
+}
+
+// InstallIntoSystem sets puma-dev up as a systemd user service, listening on
+// config.ListenPort and config.TlsPort through socket units.
+func InstallIntoSystem(config *InstallIntoSystemArgs) error {
+	if sudo := os.Getenv("SUDO_USER"); sudo != "" {
+		return fmt.Errorf("cannot run as superuser")
+	}
+
+	if config.Root == "" {
+		err := SetupOurCert()
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.BinPath == "" {
+		binPath, err := osext.Executable()
+		if err != nil {
+			return errors.Context(err, "calculating executable path")
+		}
+
+		config.BinPath = binPath
+	}
+
+	fmt.Printf("* Use '%s' as the location of puma-dev\n", config.BinPath)
+
+	// the socket units belong to the user's systemd, which can only open
+	// the ports unprivileged users may
+	if start, ok := unprivilegedPortStart(config.Root); ok {
+		for _, port := range []int{config.ListenPort, config.TlsPort} {
+			if port < start {
+				return fmt.Errorf("port %d needs root, run 'sudo puma-dev -setup -unprivileged-ports' first or pick ports from %d up with -install-port and -install-https-port", port, start)
+			}
+		}
+	}
+
+	unitDir := config.unitDir()
+
+	err := os.MkdirAll(unitDir, 0755)
+	if err != nil {
+		return errors.Context(err, "creating systemd unit directory")
+	}
+
+	for name, unit := range systemdUnits(config) {
+		err = ioutil.WriteFile(filepath.Join(unitDir, name), []byte(unit), 0644)
+		if err != nil {
+			return errors.Context(err, "writing systemd unit")
+		}
+	}
+
+	if err = runCommand("systemctl", "--user", "daemon-reload"); err != nil {
+		return errors.Context(err, "reloading systemd units")
+	}
+
+	// Restart a previous install so it picks up the new units.
+	// nolint:errcheck
+	runCommand("systemctl", "--user", "stop", SystemdServiceName, SystemdHTTPSocket, SystemdHTTPSSocket)
+
+	err = runCommand("systemctl", "--user", "enable", "--now", SystemdHTTPSocket, SystemdHTTPSSocket, SystemdServiceName)
+	if err != nil {
+		return errors.Context(err, "enabling systemd units")
+	}
+
+	fmt.Printf("* Installed puma-dev on ports: http %d, https %d\n", config.ListenPort, config.TlsPort)
+
+	return nil
+}
+
+// Uninstall stops the systemd user service and removes its units, along with
+// the trusted CA and the resolver configuration of Setup.
+func Uninstall(root, unitDirPath string, domains []string) error {
+	config := &InstallIntoSystemArgs{Root: root, UnitDirPath: unitDirPath}
+	unitDir := config.unitDir()
+
+	// nolint:errcheck
+	runCommand("systemctl", "--user", "disable", "--now", SystemdServiceName, SystemdHTTPSocket, SystemdHTTPSSocket)
+
+	for _, name := range []string{SystemdServiceName, SystemdHTTPSocket, SystemdHTTPSSocket} {
+		err := os.Remove(filepath.Join(unitDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Context(err, "removing systemd unit")
+		}
+	}
+
+	// nolint:errcheck
+	runCommand("systemctl", "--user", "daemon-reload")
+
+	fmt.Printf("* Removed puma-dev from automatically running\n")
+
+	cert := rootPath(root, filepath.Join(homedir.MustExpand(SupportDir), "cert.pem"))
+
+	if err := untrustCert(root, cert); err != nil {
+		fmt.Printf("! Unable to remove the Puma-dev CA from the trusted certificates: %s\n", err)
+	} else {
+		fmt.Printf("* Removed the Puma-dev CA from the trusted certificates\n")
+	}
+
+	err := UninstallResolver(root)
+	if err != nil {
+		fmt.Printf("! Unable to remove the resolver configuration, rerun with sudo: %s\n", err)
+		return nil
+	}
+
+	for _, d := range domains {
+		fmt.Printf("* Removed domain '%s'\n", d)
+	}
+
+	return nil
+}
+
+const (
+	ResolverSystemd         = "systemd-resolved"
+	ResolverNetworkManager  = "networkmanager"
+	DefaultUnprivilegedPort = 80
+)
+
+type SetupArgs struct {
+	Domains []string
+	DNSPort int
+
+	// Resolver is ResolverSystemd or ResolverNetworkManager, detected if
+	// empty
+	Resolver string
+
+	// UnprivilegedPorts also lets every user listen on ports from
+	// DefaultUnprivilegedPort up, which the socket units of -install need
+	// for ports 80 and 443
+	UnprivilegedPorts bool
+
+	// Root is prefixed to every path written, for testing
+	Root string
+}
+
+// DetectResolver works out how the system resolves names: through
+// systemd-resolved, or NetworkManager. It returns "" if it's neither.
+func DetectResolver(root string) string {
+	if _, err := os.Stat(rootPath(root, "/run/systemd/resolve")); err == nil {
+		return ResolverSystemd
+	}
+
+	if _, err := os.Stat(rootPath(root, "/etc/NetworkManager")); err == nil {
+		return ResolverNetworkManager
+	}
+
+	return ""
+}
+
+func resolvedDropIn(domains []string, dnsPort int) string {
+	var routes []string
+	for _, d := range domains {
+		routes = append(routes, "~"+d)
+	}
+
+	return fmt.Sprintf(`# Generated by puma-dev, remove with puma-dev -uninstall
+[Resolve]
+DNS=127.0.0.1:%d
+Domains=%s
+`, dnsPort, strings.Join(routes, " "))
+}
+
+func networkManagerDropIn() string {
+	return `# Generated by puma-dev, remove with puma-dev -uninstall
+[main]
+dns=dnsmasq
+`
+}
+
+func dnsmasqDropIn(domains []string, dnsPort int) string {
+	var b strings.Builder
+
+	b.WriteString("# Generated by puma-dev, remove with puma-dev -uninstall\n")
+
+	for _, d := range domains {
+		fmt.Fprintf(&b, "server=/%s/127.0.0.1#%d\n", d, dnsPort)
+	}
+
+	return b.String()
+}
+
+func sysctlDropIn() string {
+	return fmt.Sprintf(`# Generated by puma-dev, remove with puma-dev -uninstall
+# Lets the puma-dev user service listen on ports 80 and 443
+net.ipv4.ip_unprivileged_port_start=%d
+`, DefaultUnprivilegedPort)
+}
+
+// setupFiles returns the contents of the files Setup writes, by path.
+func setupFiles(config *SetupArgs) (map[string]string, error) {
+	files := map[string]string{}
+
+	if config.UnprivilegedPorts {
+		files[sysctlDropInPath] = sysctlDropIn()
+	}
+
+	switch config.Resolver {
+	case ResolverSystemd:
+		files[resolvedDropInPath] = resolvedDropIn(config.Domains, config.DNSPort)
+	case ResolverNetworkManager:
+		files[nmConfDropInPath] = networkManagerDropIn()
+		files[nmDnsmasqDropInPath] = dnsmasqDropIn(config.Domains, config.DNSPort)
+	default:
+		return nil, fmt.Errorf("unable to find systemd-resolved or NetworkManager to configure")
+	}
+
+	return files, nil
+}
+
+// Setup configures the system to send DNS queries for config.Domains to
+// puma-dev and, with config.UnprivilegedPorts, to let it listen on ports 80
+// and 443 unprivileged. It needs to be run with sudo.
+func Setup(config *SetupArgs) error {
+	if config.Resolver == "" {
+		config.Resolver = DetectResolver(config.Root)
+	}
+
+	files, err := setupFiles(config)
+	if err != nil {
+		return err
+	}
+
+	for path, content := range files {
+		full := rootPath(config.Root, path)
+
+		err := os.MkdirAll(filepath.Dir(full), 0755)
+		if err != nil {
+			return errors.Context(err, "creating configuration directory")
+		}
+
+		err = ioutil.WriteFile(full, []byte(content), 0644)
+		if err != nil {
+			return errors.Context(err, "writing "+path)
+		}
+
+		fmt.Printf("* Wrote %s\n", full)
+	}
+
+	if config.UnprivilegedPorts {
+		if err = runCommand("sysctl", "--load", rootPath(config.Root, sysctlDropInPath)); err != nil {
+			return errors.Context(err, "applying sysctl settings")
+		}
+	}
+
+	switch config.Resolver {
+	case ResolverSystemd:
+		err = runCommand("systemctl", "restart", "systemd-resolved")
+	case ResolverNetworkManager:
+		err = runCommand("systemctl", "reload", "NetworkManager")
+	}
+
+	if err != nil {
+		return errors.Context(err, "restarting "+config.Resolver)
+	}
+
+	fmt.Printf("* Configured %s for domains: %s\n", config.Resolver, strings.Join(config.Domains, ", "))
+
+	return nil
+}
+
+// UninstallResolver removes whatever Setup wrote.
+func UninstallResolver(root string) error {
+	var removed []string
+
+	for _, path := range []string{resolvedDropInPath, nmConfDropInPath, nmDnsmasqDropInPath, sysctlDropInPath} {
+		err := os.Remove(rootPath(root, path))
+		if err == nil {
+			removed = append(removed, path)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for _, path := range removed {
+		switch path {
+		case resolvedDropInPath:
+			// nolint:errcheck
+			runCommand("systemctl", "restart", "systemd-resolved")
+		case nmConfDropInPath:
+			// nolint:errcheck
+			runCommand("systemctl", "reload", "NetworkManager")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package dev
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/puma/puma-dev/homedir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubCommands records the commands setup would run instead of running them
+func stubCommands(t *testing.T) *[]string {
+	var ran []string
+
+	orig := runCommand
+	runCommand = func(name string, args ...string) error {
+		ran = append(ran, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	t.Cleanup(func() { runCommand = orig })
+
+	return &ran
+}
+
+func readRootFile(t *testing.T, root, path string) string {
+	data, err := ioutil.ReadFile(rootPath(root, path))
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func TestInstallIntoSystem_Linux(t *testing.T) {
+	ran := stubCommands(t)
+	root := t.TempDir()
+
+	err := InstallIntoSystem(&InstallIntoSystemArgs{
+		ListenPort:         80,
+		TlsPort:            443,
+		DNSPort:            9253,
+		ApplinkDirPath:     "~/.puma-dev",
+		Domains:            "test:localhost",
+		Timeout:            "15m0s",
+		NoServePublicPaths: "/packs",
+		BinPath:            "/opt/puma dev/puma-dev",
+		Root:               root,
+	})
+	require.NoError(t, err)
+
+	unitDir := rootPath(root, homedir.MustExpand(SystemdUnitDirPath))
+
+	service := readRootFile(t, unitDir, SystemdServiceName)
+	assert.Contains(t, service,
+		`ExecStart="/opt/puma dev/puma-dev" -systemd -dir ~/.puma-dev -d test:localhost -dns-port 9253 -timeout 15m0s -no-serve-public-paths /packs`+"\n")
+	assert.Contains(t, service, "Requires=puma-dev-http.socket puma-dev-https.socket\n")
+	assert.Contains(t, service, "WantedBy=default.target\n")
+
+	http := readRootFile(t, unitDir, SystemdHTTPSocket)
+	assert.Contains(t, http, "ListenStream=80\nFileDescriptorName=http\nService=puma-dev.service\n")
+
+	https := readRootFile(t, unitDir, SystemdHTTPSSocket)
+	assert.Contains(t, https, "ListenStream=443\nFileDescriptorName=https\n")
+
+	assert.Equal(t, []string{
+		"systemctl --user daemon-reload",
+		"systemctl --user stop puma-dev.service puma-dev-http.socket puma-dev-https.socket",
+		"systemctl --user enable --now puma-dev-http.socket puma-dev-https.socket puma-dev.service",
+	}, *ran)
+}
+
+func TestInstallIntoSystem_Linux_failsAsSuperuser(t *testing.T) {
+	stubCommands(t)
+
+	os.Setenv("SUDO_USER", "root")
+	defer os.Unsetenv("SUDO_USER")
+
+	err := InstallIntoSystem(&InstallIntoSystemArgs{Root: t.TempDir(), BinPath: "/bin/puma-dev"})
+
+	assert.Error(t, err)
+}
+
+func TestInstallIntoSystem_Linux_privilegedPorts(t *testing.T) {
+	ran := stubCommands(t)
+	root := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(rootPath(root, unprivilegedPortsPath)), 0755))
+	require.NoError(t, ioutil.WriteFile(rootPath(root, unprivilegedPortsPath), []byte("1024\n"), 0644))
+
+	err := InstallIntoSystem(&InstallIntoSystemArgs{ListenPort: 80, TlsPort: 443, BinPath: "/bin/puma-dev", Root: root})
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "port 80 needs root")
+	}
+
+	assert.Empty(t, *ran)
+
+	require.NoError(t, InstallIntoSystem(&InstallIntoSystemArgs{ListenPort: 8080, TlsPort: 8443, BinPath: "/bin/puma-dev", Root: root}))
+}
+
+func TestSetup_Linux_systemdResolved(t *testing.T) {
+	ran := stubCommands(t)
+	root := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "run/systemd/resolve"), 0755))
+
+	err := Setup(&SetupArgs{Domains: []string{"test", "localhost"}, DNSPort: 9253, Root: root})
+	require.NoError(t, err)
+
+	assert.Equal(t, `# Generated by puma-dev, remove with puma-dev -uninstall
+[Resolve]
+DNS=127.0.0.1:9253
+Domains=~test ~localhost
+`, readRootFile(t, root, resolvedDropInPath))
+
+	assert.NoFileExists(t, rootPath(root, sysctlDropInPath))
+	assert.NoFileExists(t, rootPath(root, nmDnsmasqDropInPath))
+
+	assert.Equal(t, []string{
+		"systemctl restart systemd-resolved",
+	}, *ran)
+}
+
+func TestSetup_Linux_unprivilegedPorts(t *testing.T) {
+	ran := stubCommands(t)
+	root := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "run/systemd/resolve"), 0755))
+
+	err := Setup(&SetupArgs{Domains: []string{"test"}, DNSPort: 9253, UnprivilegedPorts: true, Root: root})
+	require.NoError(t, err)
+
+	assert.Contains(t, readRootFile(t, root, sysctlDropInPath), "net.ipv4.ip_unprivileged_port_start=80\n")
+
+	assert.Equal(t, []string{
+		"sysctl --load " + rootPath(root, sysctlDropInPath),
+		"systemctl restart systemd-resolved",
+	}, *ran)
+}
+
+func TestSetup_Linux_networkManager(t *testing.T) {
+	ran := stubCommands(t)
+	root := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc/NetworkManager"), 0755))
+
+	err := Setup(&SetupArgs{Domains: []string{"test", "localhost"}, DNSPort: 9253, Root: root})
+	require.NoError(t, err)
+
+	assert.Equal(t, "# Generated by puma-dev, remove with puma-dev -uninstall\n[main]\ndns=dnsmasq\n",
+		readRootFile(t, root, nmConfDropInPath))
+	assert.Equal(t, `# Generated by puma-dev, remove with puma-dev -uninstall
+server=/test/127.0.0.1#9253
+server=/localhost/127.0.0.1#9253
+`, readRootFile(t, root, nmDnsmasqDropInPath))
+
+	assert.Contains(t, *ran, "systemctl reload NetworkManager")
+}
+
+func TestSetup_Linux_noResolver(t *testing.T) {
+	stubCommands(t)
+
+	err := Setup(&SetupArgs{Domains: []string{"test"}, DNSPort: 9253, Root: t.TempDir()})
+
+	assert.Error(t, err)
+}
+
+func TestUninstall_Linux(t *testing.T) {
+	ran := stubCommands(t)
+	stubLookPath(t)
+	root := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "run/systemd/resolve"), 0755))
+
+	require.NoError(t, InstallIntoSystem(&InstallIntoSystemArgs{ListenPort: 80, TlsPort: 443, BinPath: "/bin/puma-dev", Root: root}))
+	require.NoError(t, Setup(&SetupArgs{Domains: []string{"test"}, DNSPort: 9253, UnprivilegedPorts: true, Root: root}))
+
+	*ran = nil
+
+	require.NoError(t, Uninstall(root, SystemdUnitDirPath, []string{"test"}))
+
+	unitDir := rootPath(root, homedir.MustExpand(SystemdUnitDirPath))
+	for _, name := range []string{SystemdServiceName, SystemdHTTPSocket, SystemdHTTPSSocket} {
+		assert.NoFileExists(t, filepath.Join(unitDir, name))
+	}
+
+	assert.NoFileExists(t, rootPath(root, resolvedDropInPath))
+	assert.NoFileExists(t, rootPath(root, sysctlDropInPath))
+
+	assert.Equal(t, []string{
+		"systemctl --user disable --now puma-dev.service puma-dev-http.socket puma-dev-https.socket",
+		"systemctl --user daemon-reload",
+		"systemctl restart systemd-resolved",
+	}, *ran)
+}
+
+func TestSystemdQuote(t *testing.T) {
+	assert.Equal(t, "/usr/bin/puma-dev", systemdQuote("/usr/bin/puma-dev"))
+	assert.Equal(t, `""`, systemdQuote(""))
+	assert.Equal(t, `"a b"`, systemdQuote("a b"))
+	assert.Equal(t, `"100%% \"sure\" $$HOME"`, systemdQuote(`100% "sure" $HOME`))
+}
@@ -0,0 +1,313 @@
+package dev
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/puma/puma-dev/linebuffer"
+	"github.com/vektra/errors"
+	"gopkg.in/tomb.v2"
+)
+
+const (
+	sidecarMinBackoff = 1 * time.Second
+	sidecarMaxBackoff = 1 * time.Minute
+
+	// a sidecar that stayed up this long is considered healthy again, so a
+	// later crash restarts it without delay
+	sidecarStableAfter = 30 * time.Second
+
+	sidecarStopTimeout = 10 * time.Second
+)
+
+const (
+	SidecarWaiting  = "waiting"
+	SidecarRunning  = "running"
+	SidecarCrashed  = "crashed"
+	SidecarStopped  = "stopped"
+	SidecarStarting = "starting"
+)
+
+type SidecarConfig struct {
+	Command string            `toml:"command" yaml:"command"`
+	Env     map[string]string `toml:"env" yaml:"env"`
+}
+
+// Sidecar is a companion process (a job runner, asset watcher, ...) that
+// runs alongside an app's web process. Sidecars are started once the app is
+// ready and stopped when it shuts down, and are restarted with a backoff if
+// they crash in between.
+type Sidecar struct {
+	Name    string
+	Command string
+
+	app   *App
+	env   []string
+	lines linebuffer.LineBuffer
+
+	lock     sync.Mutex
+	cmd      *exec.Cmd
+	status   string
+	restarts int
+	lastExit string
+	started  bool
+	stopped  bool
+
+	t tomb.Tomb
+}
+
+func newSidecars(a *App, configs map[string]SidecarConfig) []*Sidecar {
+	var names []string
+	for name := range configs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var sidecars []*Sidecar
+
+	for _, name := range names {
+		cfg := configs[name]
+
+		var env []string
+		for k, v := range cfg.Env {
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+
+		sort.Strings(env)
+
+		sidecars = append(sidecars, &Sidecar{
+			Name:    name,
+			Command: cfg.Command,
+			app:     a,
+			env:     env,
+			status:  SidecarWaiting,
+		})
+	}
+
+	return sidecars
+}
+
+func (s *Sidecar) eventAdd(name string, args ...interface{}) {
+	s.app.eventAdd(name, append([]interface{}{"sidecar", s.Name}, args...)...)
+}
+
+// Status returns the sidecar's current state, e.g. SidecarRunning
+func (s *Sidecar) Status() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.status
+}
+
+func (s *Sidecar) Restarts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.restarts
+}
+
+// LastExit describes how the sidecar's process last exited, if it has
+func (s *Sidecar) LastExit() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.lastExit
+}
+
+func (s *Sidecar) Pid() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.cmd == nil || s.cmd.Process == nil || s.status != SidecarRunning {
+		return 0
+	}
+
+	return s.cmd.Process.Pid
+}
+
+func (s *Sidecar) Log() string {
+	var buf bytes.Buffer
+	s.lines.WriteTo(&buf)
+	return buf.String()
+}
+
+func (s *Sidecar) setStatus(status string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status = status
+}
+
+func (s *Sidecar) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started || s.stopped {
+		return
+	}
+
+	s.started = true
+	s.t.Go(s.run)
+}
+
+func (s *Sidecar) stop() {
+	s.lock.Lock()
+	s.stopped = true
+	started := s.started
+	s.lock.Unlock()
+
+	if !started {
+		s.setStatus(SidecarStopped)
+		return
+	}
+
+	s.t.Kill(nil)
+	s.t.Wait()
+}
+
+func (s *Sidecar) run() error {
+	backoff := sidecarMinBackoff
+
+	for {
+		started := time.Now()
+
+		err := s.runOnce()
+
+		select {
+		case <-s.t.Dying():
+			s.setStatus(SidecarStopped)
+			return nil
+		default:
+		}
+
+		if time.Since(started) > sidecarStableAfter {
+			backoff = sidecarMinBackoff
+		}
+
+		s.lock.Lock()
+		s.status = SidecarCrashed
+		s.restarts++
+		s.lastExit = err.Error()
+		s.lock.Unlock()
+
+		s.eventAdd("sidecar_crashed", "error", err.Error(), "restart_in", backoff.String())
+		fmt.Printf("! Sidecar '%s' of '%s' exited (%s), restarting in %s\n", s.Name, s.app.Name, err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-s.t.Dying():
+			s.setStatus(SidecarStopped)
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > sidecarMaxBackoff {
+			backoff = sidecarMaxBackoff
+		}
+	}
+}
+
+// runOnce starts the sidecar's process and waits for it to exit, stopping it
+// if the sidecar is stopped in the meantime.
+func (s *Sidecar) runOnce() error {
+	a := s.app
+
+	cmd := shellCommand(a.Name, a.dir, "")
+	cmd.Env = append(cmd.Env, a.config.environ()...)
+	cmd.Env = append(cmd.Env, s.env...)
+	cmd.Env = append(cmd.Env, "PUMA_DEV_COMMAND="+s.Command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	cmd.Stderr = cmd.Stdout
+
+	s.lock.Lock()
+	s.cmd = cmd
+	s.status = SidecarStarting
+	s.lock.Unlock()
+
+	err = cmd.Start()
+	if err != nil {
+		return errors.Context(err, "starting sidecar")
+	}
+
+	s.setStatus(SidecarRunning)
+	s.eventAdd("sidecar_started", "pid", cmd.Process.Pid, "command", s.Command)
+	fmt.Printf("! Started sidecar '%s' of '%s' (%d)\n", s.Name, a.Name, cmd.Process.Pid)
+
+	done := make(chan error, 1)
+
+	go func() {
+		r := bufio.NewReader(stdout)
+
+		for {
+			line, err := r.ReadString('\n')
+			if line != "" {
+				s.lines.Append(line)
+				fmt.Fprintf(os.Stdout, "%s/%s[%d]: %s", a.Name, s.Name, cmd.Process.Pid, line)
+			}
+
+			if err != nil {
+				break
+			}
+		}
+
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+
+		return err
+	case <-s.t.Dying():
+	}
+
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+
+	select {
+	case <-done:
+	case <-time.After(sidecarStopTimeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+	}
+
+	s.eventAdd("sidecar_stopped", "pid", cmd.Process.Pid)
+
+	return nil
+}
+
+func (a *App) startSidecars() {
+	for _, s := range a.sidecars {
+		s.start()
+	}
+}
+
+func (a *App) stopSidecars() {
+	var wg sync.WaitGroup
+
+	for _, s := range a.sidecars {
+		wg.Add(1)
+
+		go func(s *Sidecar) {
+			defer wg.Done()
+			s.stop()
+		}(s)
+	}
+
+	wg.Wait()
+}
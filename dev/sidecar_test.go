@@ -0,0 +1,126 @@
+package dev
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSidecarApp(t *testing.T, sidecars map[string]SidecarConfig) *App {
+	app := &App{
+		Name:   "sidecar-app",
+		Events: &Events{},
+		dir:    t.TempDir(),
+		config: &AppConfig{Sidecars: sidecars},
+	}
+
+	app.sidecars = newSidecars(app, sidecars)
+
+	return app
+}
+
+func waitFor(t *testing.T, what string, f func() bool) bool {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if f() {
+			return true
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Errorf("timed out waiting for %s", what)
+	return false
+}
+
+func TestLoadAppConfig_sidecars(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.toml", `
+[sidecars.worker]
+command = "bundle exec sidekiq"
+
+[sidecars.css]
+command = "bin/rails tailwindcss:watch"
+env = { TAILWIND_MODE = "watch" }
+`)
+
+	cfg, err := LoadAppConfig(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	app := testSidecarApp(t, cfg.Sidecars)
+
+	if assert.Len(t, app.sidecars, 2) {
+		assert.Equal(t, "css", app.sidecars[0].Name)
+		assert.Equal(t, []string{"TAILWIND_MODE=watch"}, app.sidecars[0].env)
+		assert.Equal(t, "worker", app.sidecars[1].Name)
+		assert.Equal(t, "bundle exec sidekiq", app.sidecars[1].Command)
+	}
+}
+
+func TestLoadAppConfig_sidecarWithoutCommand(t *testing.T) {
+	dir := writeAppConfig(t, ".puma-dev.yml", "sidecars:\n  worker:\n    env:\n      A: b\n")
+
+	_, err := LoadAppConfig(dir)
+
+	assert.EqualError(t, err, "invalid app config "+dir+"/.puma-dev.yml: sidecar 'worker' has no command")
+}
+
+func TestSidecar_startAndStop(t *testing.T) {
+	app := testSidecarApp(t, map[string]SidecarConfig{
+		"worker": {Command: "echo worker up as $WORKER_NAME; sleep 30", Env: map[string]string{"WORKER_NAME": "bob"}},
+	})
+
+	s := app.sidecars[0]
+	assert.Equal(t, SidecarWaiting, s.Status())
+
+	app.startSidecars()
+
+	waitFor(t, "sidecar log", func() bool {
+		return strings.Contains(s.Log(), "worker up as bob")
+	})
+
+	assert.Equal(t, SidecarRunning, s.Status())
+	assert.NotZero(t, s.Pid())
+
+	app.stopSidecars()
+
+	assert.Equal(t, SidecarStopped, s.Status())
+	assert.Zero(t, s.Pid())
+	assert.Equal(t, 0, s.Restarts())
+}
+
+func TestSidecar_restartsOnCrash(t *testing.T) {
+	app := testSidecarApp(t, map[string]SidecarConfig{
+		"flaky": {Command: "echo crashing; exit 3"},
+	})
+
+	s := app.sidecars[0]
+
+	app.startSidecars()
+	defer app.stopSidecars()
+
+	waitFor(t, "sidecar restart", func() bool {
+		return s.Restarts() >= 2
+	})
+
+	assert.Contains(t, s.LastExit(), "exit status 3")
+
+	obj := s.ToJson()
+	assert.Equal(t, "flaky", obj["name"])
+	assert.Contains(t, obj["log"], "crashing")
+}
+
+func TestSidecar_stopBeforeStart(t *testing.T) {
+	app := testSidecarApp(t, map[string]SidecarConfig{
+		"worker": {Command: "sleep 30"},
+	})
+
+	app.stopSidecars()
+	app.startSidecars()
+
+	assert.Equal(t, SidecarStopped, app.sidecars[0].Status())
+}
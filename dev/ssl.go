@@ -14,11 +14,8 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
-	"sync"
 	"time"
 
-	lru "github.com/hashicorp/golang-lru"
-	"github.com/puma/puma-dev/homedir"
 	"github.com/vektra/errors"
 )
 
@@ -48,7 +45,7 @@ func GeneratePumaDevCertificateAuthority(certPath string, keyPath string) error
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
@@ -87,20 +84,22 @@ func GeneratePumaDevCertificateAuthority(certPath string, keyPath string) error
 }
 
 func SetupOurCert() error {
-	dir := homedir.MustExpand(SupportDir)
+	certPath, keyPath := CAPaths()
 
-	err := os.MkdirAll(dir, 0700)
+	err := os.MkdirAll(filepath.Dir(certPath), 0700)
 	if err != nil {
 		return err
 	}
 
-	keyPath := filepath.Join(dir, "key.pem")
-	certPath := filepath.Join(dir, "cert.pem")
-
 	tlsCert, err := tls.LoadX509KeyPair(certPath, keyPath)
 	if err == nil {
 		log.Println("Existing valid puma-dev CA keypair found. Assuming previously trusted.")
 		CACert = &tlsCert
+
+		if ca, err := x509.ParseCertificate(tlsCert.Certificate[0]); err == nil {
+			warnAboutCA(ca)
+		}
+
 		return nil
 	}
 
@@ -115,45 +114,11 @@ func SetupOurCert() error {
 	return nil
 }
 
-type certCache struct {
-	lock  sync.Mutex
-	cache *lru.ARCCache
-}
-
-func NewCertCache() *certCache {
-	cache, err := lru.NewARC(1024)
-	if err != nil {
-		panic(err)
-	}
-
-	return &certCache{
-		cache: cache,
-	}
-}
-
-func (c *certCache) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	name := clientHello.ServerName
-
-	if val, ok := c.cache.Get(name); ok {
-		return val.(*tls.Certificate), nil
-	}
-
-	cert, err := makeCert(CACert, name)
-	if err != nil {
-		return nil, err
-	}
-
-	c.cache.Add(name, cert)
-
-	return cert, nil
-}
-
+// makeCert issues a cert for names, signed by parent. The first name is the
+// cert's common name.
 func makeCert(
 	parent *tls.Certificate,
-	name string,
+	names ...string,
 ) (*tls.Certificate, error) {
 
 	// start by generating private key
@@ -162,9 +127,19 @@ func makeCert(
 		return nil, fmt.Errorf("failed to generate private key: %v", err)
 	}
 
-	// create certificate structure with proper values
+	x509parent, err := x509.ParseCertificate(parent.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// create certificate structure with proper values, never valid for
+	// longer than the CA
 	notBefore := time.Now()
-	notAfter := notBefore.Add(365 * 24 * time.Hour)
+	notAfter := notBefore.Add(LeafValidity)
+	if notAfter.After(x509parent.NotAfter) {
+		notAfter = x509parent.NotAfter
+	}
+
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
@@ -175,7 +150,7 @@ func makeCert(
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{"Puma-dev Signed"},
-			CommonName:   name,
+			CommonName:   names[0],
 		},
 		NotBefore:   notBefore,
 		NotAfter:    notAfter,
@@ -183,12 +158,7 @@ func makeCert(
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
 
-	cert.DNSNames = append(cert.DNSNames, name)
-
-	x509parent, err := x509.ParseCertificate(parent.Certificate[0])
-	if err != nil {
-		return nil, err
-	}
+	cert.DNSNames = append(cert.DNSNames, names...)
 
 	derBytes, err := x509.CreateCertificate(
 		rand.Reader, cert, x509parent, privKey.Public(), parent.PrivateKey)
@@ -197,10 +167,15 @@ func makeCert(
 		return nil, fmt.Errorf("could not create certificate: %v", err)
 	}
 
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	tlsCert := &tls.Certificate{
 		Certificate: [][]byte{derBytes},
 		PrivateKey:  privKey,
-		Leaf:        cert,
+		Leaf:        leaf,
 	}
 
 	return tlsCert, nil
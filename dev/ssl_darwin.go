@@ -34,6 +34,11 @@ func TrustCert(cert string) error {
 	return nil
 }
 
+// UntrustCert removes the Puma-dev CA certs from the macOS default keychain
+func UntrustCert(cert string) error {
+	return DeleteAllPumaDevCAFromDefaultKeychain()
+}
+
 func DeleteAllPumaDevCAFromDefaultKeychain() error {
 	deleteAllBashCommand := `
 	for sha in $(security find-certificate -a -c "Puma-dev CA" -Z | awk '/SHA-1/ {print $3}'); do 
@@ -1,10 +1,284 @@
 package dev
 
-import "fmt"
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/puma/puma-dev/homedir"
+	"github.com/vektra/errors"
+)
 
 const SupportDir = "~/.puma-dev-ssl"
 
-func TrustCert(cert string) error {
-	fmt.Printf("! Add %s to your browser to trust CA\n", cert)
+// the nickname of the CA in NSS databases
+const nssCertName = "Puma-dev CA"
+
+// lookPath finds the commands used to trust the CA. Tests replace it.
+var lookPath = exec.LookPath
+
+// systemTrustStore is a way of adding a CA to the certificates the system
+// trusts.
+type systemTrustStore struct {
+	// Name describes the store in messages
+	Name string
+
+	// Anchor is where the CA is copied to, empty for stores managed only
+	// through commands (p11-kit)
+	Anchor string
+
+	// Update makes the system pick up the anchors, Add and Remove are
+	// run instead for stores without an anchor file.
+	Update []string
+	Add    []string
+	Remove []string
+}
+
+var (
+	debianTrustStore = &systemTrustStore{
+		Name:   "ca-certificates",
+		Anchor: "/usr/local/share/ca-certificates/puma-dev-ca.crt",
+		Update: []string{"update-ca-certificates"},
+	}
+
+	fedoraTrustStore = &systemTrustStore{
+		Name:   "ca-trust",
+		Anchor: "/etc/pki/ca-trust/source/anchors/puma-dev-ca.pem",
+		Update: []string{"update-ca-trust", "extract"},
+	}
+
+	archTrustStore = &systemTrustStore{
+		Name:   "ca-certificates-utils",
+		Anchor: "/etc/ca-certificates/trust-source/anchors/puma-dev-ca.crt",
+		Update: []string{"update-ca-trust", "extract"},
+	}
+
+	suseTrustStore = &systemTrustStore{
+		Name:   "ca-certificates",
+		Anchor: "/etc/pki/trust/anchors/puma-dev-ca.pem",
+		Update: []string{"update-ca-certificates"},
+	}
+
+	p11TrustStore = &systemTrustStore{
+		Name:   "p11-kit",
+		Add:    []string{"trust", "anchor", "--store"},
+		Remove: []string{"trust", "anchor", "--remove"},
+	}
+)
+
+// osRelease returns the ID and ID_LIKE of the distribution, from
+// /etc/os-release.
+func osRelease(root string) []string {
+	f, err := os.Open(rootPath(root, "/etc/os-release"))
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	var ids []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || (key != "ID" && key != "ID_LIKE") {
+			continue
+		}
+
+		ids = append(ids, strings.Fields(strings.Trim(value, `"'`))...)
+	}
+
+	return ids
+}
+
+// detectTrustStore works out how to add a CA to the system's trusted
+// certificates, by distribution. It returns nil if it doesn't know how.
+func detectTrustStore(root string) *systemTrustStore {
+	for _, id := range osRelease(root) {
+		switch id {
+		case "debian", "ubuntu":
+			return debianTrustStore
+		case "fedora", "rhel", "centos":
+			return fedoraTrustStore
+		case "arch":
+			return archTrustStore
+		case "suse", "opensuse":
+			return suseTrustStore
+		}
+	}
+
+	// unknown distribution, go by what's installed
+	for _, store := range []*systemTrustStore{debianTrustStore, fedoraTrustStore, archTrustStore, suseTrustStore} {
+		if _, err := os.Stat(rootPath(root, filepath.Dir(store.Anchor))); err == nil {
+			return store
+		}
+	}
+
+	if _, err := lookPath("trust"); err == nil {
+		return p11TrustStore
+	}
+
+	return nil
+}
+
+// privileged runs a command that changes the system, through sudo unless
+// puma-dev is root or working on a test root.
+func privileged(root string, args ...string) error {
+	if root == "" && os.Geteuid() != 0 {
+		args = append([]string{"sudo"}, args...)
+	}
+
+	return runCommand(args[0], args[1:]...)
+}
+
+func (s *systemTrustStore) add(root, cert string) error {
+	if s.Anchor == "" {
+		return privileged(root, append(s.Add, cert)...)
+	}
+
+	anchor := rootPath(root, s.Anchor)
+
+	data, err := ioutil.ReadFile(cert)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(anchor), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(anchor, data, 0644)
+	}
+
+	if os.IsPermission(err) {
+		err = privileged(root, "install", "-D", "-m", "0644", cert, anchor)
+	}
+
+	if err != nil {
+		return errors.Context(err, "copying CA cert to "+anchor)
+	}
+
+	return privileged(root, s.Update...)
+}
+
+func (s *systemTrustStore) remove(root, cert string) error {
+	if s.Anchor == "" {
+		return privileged(root, append(s.Remove, cert)...)
+	}
+
+	anchor := rootPath(root, s.Anchor)
+
+	err := os.Remove(anchor)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if os.IsPermission(err) {
+		err = privileged(root, "rm", "-f", anchor)
+	}
+
+	if err != nil {
+		return errors.Context(err, "removing "+anchor)
+	}
+
+	return privileged(root, s.Update...)
+}
+
+// nssDatabases returns the NSS databases of the user's browsers, as
+// certutil -d arguments: the shared one Chrome uses, and Firefox's profiles.
+func nssDatabases(root string) []string {
+	home := rootPath(root, homedir.MustExpand("~"))
+
+	var dbs []string
+
+	if _, err := os.Stat(filepath.Join(home, ".pki/nssdb/cert9.db")); err == nil {
+		dbs = append(dbs, "sql:"+filepath.Join(home, ".pki/nssdb"))
+	}
+
+	for _, profiles := range []string{".mozilla/firefox", "snap/firefox/common/.mozilla/firefox"} {
+		matches, _ := filepath.Glob(filepath.Join(home, profiles, "*", "cert*.db"))
+
+		for _, m := range matches {
+			switch filepath.Base(m) {
+			case "cert9.db":
+				dbs = append(dbs, "sql:"+filepath.Dir(m))
+			case "cert8.db":
+				dbs = append(dbs, "dbm:"+filepath.Dir(m))
+			}
+		}
+	}
+
+	return dbs
+}
+
+// trustCert adds cert to the system's trusted certificates and to the NSS
+// databases of browsers, which don't use the system's. Only failing to
+// update the system's is an error.
+func trustCert(root, cert string) error {
+	if _, err := os.Stat(cert); err != nil {
+		return errors.Context(err, "reading CA cert")
+	}
+
+	store := detectTrustStore(root)
+	if store == nil {
+		fmt.Printf("! Unable to find how to trust CAs on this system, add %s to your system's trusted certificates\n", cert)
+	} else {
+		fmt.Printf("* Adding certification to the system's trusted certificates (%s)\n", store.Name)
+
+		if err := store.add(root, cert); err != nil {
+			return errors.Context(err, "adding CA to the system's trusted certificates")
+		}
+	}
+
+	// browsers are optional, failing to add the CA to them isn't an error
+
+	if _, err := lookPath("certutil"); err != nil {
+		fmt.Printf("! certutil not found, add %s to your browser to trust CA\n", cert)
+	} else {
+		for _, db := range nssDatabases(root) {
+			err := runCommand("certutil", "-A", "-d", db, "-t", "C,,", "-n", nssCertName, "-i", cert)
+			if err != nil {
+				fmt.Printf("! Unable to add CA to %s: %s\n", db, err)
+				continue
+			}
+
+			fmt.Printf("* Added CA to %s\n", db)
+		}
+	}
+
+	fmt.Printf("* Certificates setup, ready for https operations!\n")
+
 	return nil
 }
+
+// untrustCert removes what trustCert added.
+func untrustCert(root, cert string) error {
+	if store := detectTrustStore(root); store != nil {
+		if err := store.remove(root, cert); err != nil {
+			return err
+		}
+	}
+
+	if _, err := lookPath("certutil"); err == nil {
+		for _, db := range nssDatabases(root) {
+			// nolint:errcheck
+			runCommand("certutil", "-D", "-d", db, "-n", nssCertName)
+		}
+	}
+
+	return nil
+}
+
+// TrustCert adds the cert at the provided path to the system's trusted
+// certificates and to the NSS databases of browsers
+func TrustCert(cert string) error {
+	return trustCert("", cert)
+}
+
+// UntrustCert removes the cert at the provided path from where TrustCert
+// added it
+func UntrustCert(cert string) error {
+	return untrustCert("", cert)
+}
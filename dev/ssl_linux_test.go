@@ -1,18 +1,162 @@
 package dev
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
-	. "github.com/puma/puma-dev/dev/devtest"
+	"github.com/puma/puma-dev/homedir"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// stubLookPath makes only the given commands look installed
+func stubLookPath(t *testing.T, installed ...string) {
+	orig := lookPath
+	lookPath = func(name string) (string, error) {
+		for _, i := range installed {
+			if i == name {
+				return "/usr/bin/" + name, nil
+			}
+		}
+
+		return "", exec.ErrNotFound
+	}
+
+	t.Cleanup(func() { lookPath = orig })
+}
+
+// newTrustTestRoot returns a root for a distribution with the given
+// os-release, and a CA cert to trust
+func newTrustTestRoot(t *testing.T, osRelease string) (string, string) {
+	root := t.TempDir()
+
+	if osRelease != "" {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "etc/os-release"), []byte(osRelease), 0644))
+	}
+
+	cert := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, ioutil.WriteFile(cert, []byte("-----BEGIN CERTIFICATE-----\n"), 0644))
+
+	return root, cert
+}
+
 func TestTrustCert_Linux_noCertProvided(t *testing.T) {
-	stdOut := WithStdoutCaptured(func() {
-		// TrustCert on Linux is a no-op, so it "succeeds" even if the path isn't found
-		err := TrustCert("/does/not/exist")
-		assert.Nil(t, err)
-	})
+	stubCommands(t)
+
+	err := trustCert(t.TempDir(), "/does/not/exist")
+
+	assert.Error(t, err)
+}
+
+func TestTrustCert_Linux_debian(t *testing.T) {
+	ran := stubCommands(t)
+	stubLookPath(t)
+
+	root, cert := newTrustTestRoot(t, "NAME=\"Ubuntu\"\nID=ubuntu\nID_LIKE=debian\n")
+
+	require.NoError(t, trustCert(root, cert))
+
+	anchor := filepath.Join(root, "usr/local/share/ca-certificates/puma-dev-ca.crt")
+	assert.FileExists(t, anchor)
+	assert.Equal(t, []string{"update-ca-certificates"}, *ran)
+
+	*ran = nil
+
+	require.NoError(t, untrustCert(root, cert))
+
+	assert.NoFileExists(t, anchor)
+	assert.Equal(t, []string{"update-ca-certificates"}, *ran)
+}
+
+func TestTrustCert_Linux_storeFails(t *testing.T) {
+	stubLookPath(t)
+
+	orig := runCommand
+	runCommand = func(name string, args ...string) error {
+		return fmt.Errorf("%s failed", name)
+	}
+	t.Cleanup(func() { runCommand = orig })
+
+	root, cert := newTrustTestRoot(t, "ID=debian\n")
+
+	err := trustCert(root, cert)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "update-ca-certificates failed")
+	}
+}
+
+func TestTrustCert_Linux_fedora(t *testing.T) {
+	ran := stubCommands(t)
+	stubLookPath(t)
+
+	root, cert := newTrustTestRoot(t, "ID=fedora\n")
+
+	require.NoError(t, trustCert(root, cert))
+
+	assert.FileExists(t, filepath.Join(root, "etc/pki/ca-trust/source/anchors/puma-dev-ca.pem"))
+	assert.Equal(t, []string{"update-ca-trust extract"}, *ran)
+}
+
+func TestTrustCert_Linux_detectedByDirectory(t *testing.T) {
+	stubCommands(t)
+	stubLookPath(t)
+
+	root, cert := newTrustTestRoot(t, "")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc/ca-certificates/trust-source/anchors"), 0755))
+
+	require.NoError(t, trustCert(root, cert))
+
+	assert.FileExists(t, filepath.Join(root, "etc/ca-certificates/trust-source/anchors/puma-dev-ca.crt"))
+}
+
+func TestTrustCert_Linux_p11kit(t *testing.T) {
+	ran := stubCommands(t)
+	stubLookPath(t, "trust")
+
+	root, cert := newTrustTestRoot(t, "ID=gentoo\n")
+
+	require.NoError(t, trustCert(root, cert))
+	require.NoError(t, untrustCert(root, cert))
+
+	assert.Equal(t, []string{
+		"trust anchor --store " + cert,
+		"trust anchor --remove " + cert,
+	}, *ran)
+}
+
+func TestTrustCert_Linux_nss(t *testing.T) {
+	ran := stubCommands(t)
+	stubLookPath(t, "certutil")
+
+	root, cert := newTrustTestRoot(t, "ID=unknown\n")
+	home := filepath.Join(root, homedir.MustExpand("~"))
+
+	for _, db := range []string{".pki/nssdb/cert9.db", ".mozilla/firefox/abc.default/cert9.db", ".mozilla/firefox/old.default/cert8.db"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(home, filepath.Dir(db)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(home, db), nil, 0644))
+	}
+
+	require.NoError(t, trustCert(root, cert))
+
+	assert.Equal(t, []string{
+		"certutil -A -d sql:" + filepath.Join(home, ".pki/nssdb") + " -t C,, -n Puma-dev CA -i " + cert,
+		"certutil -A -d sql:" + filepath.Join(home, ".mozilla/firefox/abc.default") + " -t C,, -n Puma-dev CA -i " + cert,
+		"certutil -A -d dbm:" + filepath.Join(home, ".mozilla/firefox/old.default") + " -t C,, -n Puma-dev CA -i " + cert,
+	}, *ran)
+
+	*ran = nil
+
+	require.NoError(t, untrustCert(root, cert))
 
-	assert.Regexp(t, "^! Add /does/not/exist to your browser to trust CA\\n$", stdOut)
+	assert.Equal(t, []string{
+		"certutil -D -d sql:" + filepath.Join(home, ".pki/nssdb") + " -n Puma-dev CA",
+		"certutil -D -d sql:" + filepath.Join(home, ".mozilla/firefox/abc.default") + " -n Puma-dev CA",
+		"certutil -D -d dbm:" + filepath.Join(home, ".mozilla/firefox/old.default") + " -n Puma-dev CA",
+	}, *ran)
 }
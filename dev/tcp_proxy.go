@@ -0,0 +1,356 @@
+package dev
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vektra/errors"
+)
+
+// Schemes of proxy targets that aren't plain HTTP
+const (
+	// SchemeTCP proxies TLS connections to a TCP service, picked by the SNI
+	// of the connection, e.g. tcp://127.0.0.1:5432
+	SchemeTCP = "tcp"
+
+	// SchemeGRPC proxies gRPC to a server speaking h2c, with trailers
+	// intact, e.g. grpc://127.0.0.1:50051
+	SchemeGRPC = "grpc"
+)
+
+// The values of the tls option of tcp proxy targets, e.g.
+// tcp://127.0.0.1:5432?tls=passthrough
+const (
+	// TLSTerminate has puma-dev do the handshake with its own cert, sending
+	// the decrypted stream to the target. It's the default.
+	TLSTerminate = "terminate"
+
+	// TLSPassthrough sends the raw TLS stream to the target, which does the
+	// handshake itself
+	TLSPassthrough = "passthrough"
+)
+
+// clientHelloTimeout is how long a connection has to send its TLS client
+// hello before it's handed to the https server as is
+const clientHelloTimeout = 10 * time.Second
+
+var errHelloRead = errors.New("client hello read")
+
+// readOnlyConn lets a TLS handshake read from a reader, discarding anything
+// written.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn replays what was read from a conn to find its SNI before the
+// rest of it.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// peekServerName reads the TLS client hello from conn, returning the server
+// name it asks for and a conn that reads the hello again. The name is empty
+// if conn doesn't start with a client hello.
+func peekServerName(conn net.Conn) (string, net.Conn) {
+	var (
+		buf  bytes.Buffer
+		name string
+	)
+
+	tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	return name, &peekedConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+}
+
+// TCPProxy is where the TLS connections for a tcp proxy target go.
+type TCPProxy struct {
+	// Name is the app or routing target the proxy was found by, for events
+	Name    string
+	Address string
+
+	// Passthrough has TLS connections sent on as they are, rather than
+	// terminated with the puma-dev cert
+	Passthrough bool
+}
+
+// tcpPassthrough checks a tcp proxy target, returning whether it passes TLS
+// connections through.
+func tcpPassthrough(t *proxyTarget) (bool, error) {
+	if t.Port == 0 {
+		return false, fmt.Errorf("tcp proxy to '%s' needs a port", t.Host)
+	}
+
+	switch mode := t.Query.Get("tls"); mode {
+	case "", TLSTerminate:
+		return false, nil
+	case TLSPassthrough:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown tls mode '%s', use terminate or passthrough", mode)
+	}
+}
+
+// newTCPProxy returns the proxy for target, or nil if it isn't a valid tcp
+// proxy target.
+func newTCPProxy(name, target string) *TCPProxy {
+	t, err := parseProxyTarget(target)
+	if err != nil || t.Scheme != SchemeTCP {
+		return nil
+	}
+
+	passthrough, err := tcpPassthrough(t)
+	if err != nil {
+		return nil
+	}
+
+	return &TCPProxy{Name: name, Address: t.Address(), Passthrough: passthrough}
+}
+
+// FindTCPProxy returns the tcp proxy for the domain name, if it's served by
+// one. It resolves names the way FindAppByDomainName does, but only reads
+// the proxy file, so nothing is launched or added to the pool for the
+// connections that turn out to be https.
+func (a *AppPool) FindTCPProxy(name string) *TCPProxy {
+	app, path, _ := a.resolveName(name)
+	if app == "" {
+		return nil
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil || stat.IsDir() {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || proxyFormat(data) != "" {
+		return nil
+	}
+
+	return newTCPProxy(app, string(bytes.TrimSpace(data)))
+}
+
+// findTCPProxy returns the tcp proxy for host, if it's served by one,
+// following the routing file like findApp.
+func (h *HTTPServer) findTCPProxy(host string) *TCPProxy {
+	route, target := h.Pool.MatchRoute(host, "")
+	if route == nil {
+		return h.Pool.FindTCPProxy(h.removeTLD(host))
+	}
+
+	if !isProxyTarget(target) {
+		return h.Pool.FindTCPProxy(target)
+	}
+
+	return newTCPProxy(target, target)
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// sniListener hands the TLS connections it accepts for tcp proxies to
+// them, and everything else to the https server it's wrapped for.
+type sniListener struct {
+	net.Listener
+
+	h        *HTTPServer
+	accepted chan acceptResult
+
+	// tcpConfig terminates TLS for tcp proxies
+	tcpConfig *tls.Config
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// listenTLS wraps l to serve https with config, and the tcp proxies with
+// TLS connections sent to them.
+func (h *HTTPServer) listenTLS(l net.Listener, config *tls.Config) net.Listener {
+	sl := &sniListener{
+		Listener:  l,
+		h:         h,
+		accepted:  make(chan acceptResult),
+		tcpConfig: tcpTLSConfig(config),
+		done:      make(chan struct{}),
+	}
+
+	go sl.acceptLoop()
+
+	return tls.NewListener(sl, config)
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.deliver(acceptResult{err: err})
+
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+				continue
+			}
+
+			return
+		}
+
+		// peeking waits on the client, so it mustn't hold up other conns
+		go l.route(conn)
+	}
+}
+
+func (l *sniListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	name, conn := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if name != "" {
+		if p := l.h.findTCPProxy(name); p != nil {
+			l.h.proxyTCP(p, conn, l.tcpConfig)
+			return
+		}
+	}
+
+	if !l.deliver(acceptResult{conn: conn}) {
+		conn.Close()
+	}
+}
+
+func (l *sniListener) deliver(res acceptResult) bool {
+	select {
+	case l.accepted <- res:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.accepted:
+		return res.conn, res.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// tcpTLSConfig is config without the HTTP protocols https offers to
+// negotiate, which clients of other protocols would be refused for.
+func tcpTLSConfig(config *tls.Config) *tls.Config {
+	c := config.Clone()
+	c.NextProtos = nil
+
+	if get := config.GetConfigForClient; get != nil {
+		c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cc, err := get(hello)
+			if cc != nil {
+				cc = cc.Clone()
+				cc.NextProtos = nil
+			}
+
+			return cc, err
+		}
+	}
+
+	return c
+}
+
+// proxyTCP copies conn to and from the proxy's target, terminating TLS
+// first unless the proxy passes it through.
+func (h *HTTPServer) proxyTCP(p *TCPProxy, conn net.Conn, config *tls.Config) {
+	defer conn.Close()
+
+	mode := TLSTerminate
+	if p.Passthrough {
+		mode = TLSPassthrough
+	}
+
+	if mode == TLSTerminate {
+		tconn := tls.Server(conn, config)
+
+		conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		err := tconn.Handshake()
+		conn.SetDeadline(time.Time{})
+
+		if err != nil {
+			h.Events.Add("tcp_proxy_error", "app", p.Name, "error", err.Error())
+			return
+		}
+
+		conn = tconn
+	}
+
+	dialer := net.Dialer{
+		Timeout:   dialerTimeout,
+		KeepAlive: keepAlive,
+	}
+
+	upstream, err := dialer.Dial("tcp", p.Address)
+	if err != nil {
+		h.Events.Add("tcp_proxy_error", "app", p.Name, "error", err.Error())
+		return
+	}
+
+	defer upstream.Close()
+
+	h.Events.Add("tcp_proxy", "app", p.Name, "upstream", p.Address, "tls", mode)
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(upstream, conn)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(conn, upstream)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+
+	// both directions have to finish, one side closing its half doesn't
+	// mean it's done reading
+	<-done
+	<-done
+}
+
+// closeWrite signals the end of what's sent on conn, if it can.
+func closeWrite(conn net.Conn) {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		c.CloseWrite()
+	case *peekedConn:
+		closeWrite(c.Conn)
+	}
+}
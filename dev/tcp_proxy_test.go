@@ -0,0 +1,284 @@
+package dev
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestPeekServerName(t *testing.T) {
+	withTestCA(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tls.Client(client, &tls.Config{ServerName: "db.test", InsecureSkipVerify: true}).Handshake()
+	}()
+
+	name, conn := peekServerName(server)
+	assert.Equal(t, "db.test", name)
+
+	// the hello is read again by the real handshake
+	cert, err := makeCert(CACert, "db.test")
+	require.NoError(t, err)
+
+	require.NoError(t, tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}}).Handshake())
+	require.NoError(t, <-errs)
+}
+
+func TestPeekServerName_notTLS(t *testing.T) {
+	client, server := net.Pipe()
+
+	req := "GET / HTTP/1.1\r\nHost: blog.test\r\n\r\n"
+
+	go func() {
+		client.Write([]byte(req))
+		client.Close()
+	}()
+
+	name, conn := peekServerName(server)
+	assert.Equal(t, "", name)
+
+	data, _ := ioutil.ReadAll(conn)
+	assert.Equal(t, req, string(data))
+}
+
+// newEchoBackend accepts connections on l, sending back what it's sent.
+func newEchoBackend(t *testing.T, l net.Listener) string {
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func echo(t *testing.T, conn net.Conn) {
+	_, err := fmt.Fprint(conn, "ping\n")
+	require.NoError(t, err)
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
+
+func TestHttp_tcpProxy_terminate(t *testing.T) {
+	withTestCA(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "db"), []byte("tcp://"+newEchoBackend(t, l)), 0644))
+
+	addr, roots := serveTLSForTest(t, h)
+	config := &tls.Config{RootCAs: roots}
+
+	for _, name := range []string{"db.test", "replica.db.test"} {
+		config.ServerName = name
+
+		// clients of other protocols offer their own ALPN
+		config.NextProtos = []string{"postgresql"}
+
+		conn, err := tls.Dial("tcp", addr, config)
+		require.NoError(t, err, name)
+
+		echo(t, conn)
+		conn.Close()
+	}
+
+	var events bytes.Buffer
+	h.Events.WriteTo(&events)
+	assert.Contains(t, events.String(), `"event":"tcp_proxy","app":"db"`)
+	assert.Contains(t, events.String(), `"tls":"terminate"`)
+}
+
+func TestHttp_tcpProxy_passthrough(t *testing.T) {
+	withTestCA(t)
+
+	backendCert, err := makeCert(CACert, "db.test")
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*backendCert}})
+	require.NoError(t, err)
+
+	h := newTestHTTPServer(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "db"), []byte("tcp://"+newEchoBackend(t, l)+"?tls=passthrough"), 0644))
+
+	addr, roots := serveTLSForTest(t, h)
+	config := &tls.Config{RootCAs: roots}
+
+	config.ServerName = "db.test"
+
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn)
+
+	// the handshake was done by the backend
+	assert.Equal(t, backendCert.Certificate[0], conn.ConnectionState().PeerCertificates[0].Raw)
+
+	var events bytes.Buffer
+	h.Events.WriteTo(&events)
+	assert.Contains(t, events.String(), `"tls":"passthrough"`)
+}
+
+func TestHttp_tcpProxy_overHTTP(t *testing.T) {
+	h := newTestHTTPServer(t)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "db"), []byte("tcp://127.0.0.1:5432"), 0644))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://db.test/", nil))
+
+	assert.Equal(t, http.StatusMisdirectedRequest, w.Code)
+	assert.Equal(t, "tcp proxy only accepts TLS connections", w.Body.String())
+}
+
+func TestAppPool_readProxy_tcp(t *testing.T) {
+	pool := &AppPool{Dir: t.TempDir(), Events: &Events{}}
+	defer pool.Purge()
+
+	for content, expected := range map[string]string{
+		"tcp://127.0.0.1":                 "tcp proxy to '127.0.0.1' needs a port",
+		"tcp://127.0.0.1:5432?tls=always": "unknown tls mode 'always', use terminate or passthrough",
+	} {
+		path := filepath.Join(pool.Dir, "db")
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+
+		_, err := pool.readProxy("db", path)
+		assert.EqualError(t, err, expected, content)
+	}
+
+	path := filepath.Join(pool.Dir, "db")
+	require.NoError(t, ioutil.WriteFile(path, []byte("tcp://127.0.0.1:5432?tls=passthrough"), 0644))
+
+	app, err := pool.readProxy("db", path)
+	require.NoError(t, err)
+
+	assert.Equal(t, SchemeTCP, app.Scheme)
+	assert.Equal(t, "127.0.0.1:5432", app.Address())
+}
+
+func TestAppPool_FindTCPProxy(t *testing.T) {
+	pool := &AppPool{Dir: t.TempDir(), Events: &Events{}}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(pool.Dir, "blog"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(pool.Dir, "db"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(pool.Dir, "db", "primary"), []byte("tcp://127.0.0.1:5432?tls=passthrough\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(pool.Dir, "web"), []byte("http://127.0.0.1:3000"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(pool.Dir, "bad"), []byte("tcp://127.0.0.1"), 0644))
+
+	// names are resolved like HTTP requests are, including db-primary
+	// meaning db/primary
+	for _, name := range []string{"db-primary", "replica.db-primary"} {
+		p := pool.FindTCPProxy(name)
+		if assert.NotNil(t, p, name) {
+			assert.Equal(t, &TCPProxy{Name: "db-primary", Address: "127.0.0.1:5432", Passthrough: true}, p)
+		}
+	}
+
+	for _, name := range []string{"blog", "web", "bad", "nope"} {
+		assert.Nil(t, pool.FindTCPProxy(name), name)
+	}
+
+	// finding proxies doesn't launch anything
+	assert.Empty(t, pool.apps)
+}
+
+func newGRPCBackend(t *testing.T) *httptest.Server {
+	return newH2CBackend(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/grpc" || req.Header.Get("Te") != "trailers" {
+			http.Error(w, "not grpc", http.StatusBadRequest)
+			return
+		}
+
+		msg, _ := ioutil.ReadAll(req.Body)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(bytes.ToUpper(msg))
+
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	})
+}
+
+func grpcRequest(t *testing.T, client *http.Client, url string) {
+	req, err := http.NewRequest("POST", url+"/echo.Echo/Say", strings.NewReader("hello"))
+	require.NoError(t, err)
+
+	req.Host = "grpc.test"
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+
+	assert.Equal(t, http.StatusOK, res.StatusCode, string(body))
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, "HELLO", string(body))
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "ok", res.Trailer.Get("Grpc-Message"))
+}
+
+func TestHttp_grpcProxy(t *testing.T) {
+	withTestCA(t)
+
+	backend := newGRPCBackend(t)
+
+	h := newTestHTTPServer(t)
+
+	target := strings.Replace(backend.URL, "http://", SchemeGRPC+"://", 1)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(h.Pool.Dir, "grpc"), []byte(target), 0644))
+
+	addr, roots := serveTLSForTest(t, h)
+
+	grpcRequest(t, &http.Client{Transport: &http2.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "grpc.test"},
+	}}, "https://"+addr)
+
+	// clients without TLS speak h2c to the http port
+	plain := httptest.NewServer(h.plainHandler())
+	defer plain.Close()
+
+	grpcRequest(t, &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}, plain.URL)
+}
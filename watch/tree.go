@@ -0,0 +1,199 @@
+package watch
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultDebounce is how long WatchTree waits for changes to settle when
+// TreeOptions doesn't say.
+const DefaultDebounce = 500 * time.Millisecond
+
+// TreeOptions configures WatchTree. Globs are matched against paths relative
+// to the watched directory, using "/" as the separator. Besides the usual
+// path.Match syntax, a "**" segment matches any number of directories.
+type TreeOptions struct {
+	// Include are the globs of the files whose changes are reported. With no
+	// Include globs every file is.
+	Include []string
+
+	// Exclude are the globs of the files and directories whose changes
+	// aren't reported, even if they match Include. Excluding a directory
+	// excludes everything in it.
+	Exclude []string
+
+	// Debounce is how long to wait after a change for more changes, so that
+	// e.g. a checkout touching many files is reported once.
+	Debounce time.Duration
+}
+
+// ValidGlob reports whether pattern can be used in TreeOptions.
+func ValidGlob(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty glob")
+	}
+
+	for _, seg := range strings.Split(pattern, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("bad glob '%s': %s", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Match reports whether the slash separated relative path name matches
+// pattern.
+func Match(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// ** matches zero or more segments
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if Match(p, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o *TreeOptions) excluded(rel string) bool {
+	// check the path itself and every directory it's in
+	for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if matchAny(o.Exclude, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o *TreeOptions) included(rel string) bool {
+	if o.excluded(rel) {
+		return false
+	}
+
+	return len(o.Include) == 0 || matchAny(o.Include, rel)
+}
+
+// WatchTree watches the directory root and everything below it until done
+// is closed, calling change with the relative paths of the files that
+// changed, once they stop changing for opts.Debounce.
+func WatchTree(root string, opts TreeOptions, done <-chan struct{}, change func(changed []string)) error {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	if opts.Debounce <= 0 {
+		opts.Debounce = DefaultDebounce
+	}
+
+	relPath := func(p string) (string, bool) {
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return "", false
+		}
+
+		return filepath.ToSlash(rel), true
+	}
+
+	excluded := func(p string) bool {
+		rel, ok := relPath(p)
+		return ok && opts.excluded(rel)
+	}
+
+	changed := make(chan string)
+	errc := make(chan error, 1)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		errc <- watchTree(root, excluded, stop, changed)
+	}()
+
+	var (
+		pending = map[string]struct{}{}
+		timer   *time.Timer
+		fire    <-chan time.Time
+	)
+
+	for {
+		select {
+		case p := <-changed:
+			rel, ok := relPath(p)
+			if !ok || !opts.included(rel) {
+				continue
+			}
+
+			pending[rel] = struct{}{}
+
+			if timer == nil {
+				timer = time.NewTimer(opts.Debounce)
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(opts.Debounce)
+			}
+
+			fire = timer.C
+		case <-fire:
+			var files []string
+			for f := range pending {
+				files = append(files, f)
+			}
+
+			sort.Strings(files)
+
+			pending = map[string]struct{}{}
+			fire = nil
+
+			change(files)
+		case err := <-errc:
+			return err
+		case <-done:
+			if timer != nil {
+				timer.Stop()
+			}
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package watch
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+// watchTree sends the paths that change below root to changed until done is
+// closed. FSEvents streams are recursive, so excluded paths are only
+// filtered out by WatchTree.
+func watchTree(root string, excluded func(string) bool, done <-chan struct{}, changed chan<- string) error {
+	es := &fsevents.EventStream{
+		Paths:   []string{root},
+		Latency: 100 * time.Millisecond,
+		Flags:   fsevents.FileEvents | fsevents.NoDefer,
+	}
+
+	es.Start()
+
+	defer es.Stop()
+
+	for {
+		select {
+		case events, ok := <-es.Events:
+			if !ok {
+				return nil
+			}
+
+			for _, ev := range events {
+				p := ev.Path
+				if !filepath.IsAbs(p) {
+					p = "/" + p
+				}
+
+				if excluded(p) {
+					continue
+				}
+
+				select {
+				case changed <- p:
+				case <-done:
+					return nil
+				}
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package watch
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var errWatchDone = errors.New("watch done")
+
+// watchTree sends the paths that change below root to changed until done is
+// closed. inotify isn't recursive, so every directory is watched, including
+// ones created later on.
+func watchTree(root string, excluded func(string) bool, done <-chan struct{}, changed chan<- string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	defer watcher.Close()
+
+	send := func(p string) bool {
+		select {
+		case changed <- p:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	// addDir watches dir and the directories below it. Files found in a
+	// directory that appeared while watching are reported, as they may have
+	// been created before the directory was watched.
+	addDir := func(dir string, report bool) error {
+		return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// it may have been removed already
+				return nil
+			}
+
+			if excluded(p) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			if !d.IsDir() {
+				if report && !send(p) {
+					return errWatchDone
+				}
+
+				return nil
+			}
+
+			return watcher.Add(p)
+		})
+	}
+
+	err = addDir(root, false)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+
+			if ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					err := addDir(ev.Name, true)
+					if err == errWatchDone {
+						return nil
+					} else if err != nil {
+						return err
+					}
+
+					continue
+				}
+			}
+
+			if !send(ev.Name) {
+				return nil
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			// an overflowed queue drops events, but the next ones still
+			// arrive
+			if err != fsnotify.ErrEventOverflow {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
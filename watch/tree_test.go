@@ -0,0 +1,113 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	assert.True(t, Match("Gemfile.lock", "Gemfile.lock"))
+	assert.False(t, Match("Gemfile.lock", "vendor/Gemfile.lock"))
+	assert.True(t, Match("config/**/*.rb", "config/routes.rb"))
+	assert.True(t, Match("config/**/*.rb", "config/initializers/deep/cors.rb"))
+	assert.False(t, Match("config/**/*.rb", "config/locales/en.yml"))
+	assert.True(t, Match("**/*.rb", "app.rb"))
+	assert.True(t, Match("app/**", "app/models/user.rb"))
+	assert.False(t, Match("*.rb", "lib/app.rb"))
+}
+
+func TestValidGlob(t *testing.T) {
+	assert.NoError(t, ValidGlob("config/**/*.rb"))
+	assert.Error(t, ValidGlob("config/[a-"))
+	assert.Error(t, ValidGlob(""))
+}
+
+func TestTreeOptions_excluded(t *testing.T) {
+	opts := TreeOptions{
+		Include: []string{"**/*.rb"},
+		Exclude: []string{"node_modules", "tmp/**"},
+	}
+
+	assert.True(t, opts.included("lib/app.rb"))
+	assert.False(t, opts.included("node_modules/pkg/index.rb"))
+	assert.False(t, opts.included("tmp/cache/x.rb"))
+	assert.False(t, opts.included("lib/app.js"))
+}
+
+func TestTreeOptions_excludedNested(t *testing.T) {
+	opts := TreeOptions{
+		Exclude: []string{"**/node_modules", "**/tmp"},
+	}
+
+	assert.False(t, opts.included("node_modules/pkg/index.js"))
+	assert.False(t, opts.included("engines/admin/node_modules/pkg/index.js"))
+	assert.False(t, opts.included("engines/admin/tmp/cache/x.rb"))
+	assert.True(t, opts.included("engines/admin/app/models/user.rb"))
+	assert.True(t, opts.included("lib/tmpfile.rb"))
+}
+
+func writeTreeFile(t *testing.T, root, rel string) {
+	p := filepath.Join(root, rel)
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, []byte(time.Now().String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchTree(t *testing.T) {
+	root := t.TempDir()
+
+	writeTreeFile(t, root, "config/routes.rb")
+	writeTreeFile(t, root, "node_modules/pkg/index.rb")
+	writeTreeFile(t, root, "config/engine/node_modules/pkg/index.rb")
+
+	done := make(chan struct{})
+	defer close(done)
+
+	changes := make(chan []string, 10)
+
+	go func() {
+		err := WatchTree(root, TreeOptions{
+			Include:  []string{"Gemfile.lock", "config/**/*.rb"},
+			Exclude:  []string{"**/node_modules"},
+			Debounce: 200 * time.Millisecond,
+		}, done, func(changed []string) {
+			changes <- changed
+		})
+		assert.NoError(t, err)
+	}()
+
+	// give the watcher time to set up
+	time.Sleep(500 * time.Millisecond)
+
+	writeTreeFile(t, root, "node_modules/pkg/index.rb")
+	writeTreeFile(t, root, "config/engine/node_modules/pkg/index.rb")
+	writeTreeFile(t, root, "README.md")
+	writeTreeFile(t, root, "config/routes.rb")
+	writeTreeFile(t, root, "Gemfile.lock")
+
+	select {
+	case changed := <-changes:
+		assert.Equal(t, []string{"Gemfile.lock", "config/routes.rb"}, changed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no changes reported")
+	}
+
+	// directories created while watching are watched too
+	writeTreeFile(t, root, "config/initializers/cors.rb")
+
+	select {
+	case changed := <-changes:
+		assert.Equal(t, []string{"config/initializers/cors.rb"}, changed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no changes reported")
+	}
+}